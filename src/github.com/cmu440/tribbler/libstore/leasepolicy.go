@@ -0,0 +1,147 @@
+package libstore
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cmu440/tribbler/rpc/storagerpc"
+)
+
+// LeasePolicy decides whether a Libstore in Normal mode requests a lease
+// when it reads a key that is not cached. Policies are used concurrently.
+type LeasePolicy interface {
+	// WantLease records that key is being read at time now, and reports
+	// whether a lease should be requested for it.
+	WantLease(key string, now time.Time) bool
+}
+
+// DefaultLeasePolicy returns the policy used when none is configured: a
+// lease is requested once a key has been read QueryCacheThresh times in the
+// last QueryCacheSeconds.
+func DefaultLeasePolicy() LeasePolicy {
+	return ThresholdLeasePolicy(storagerpc.QueryCacheThresh, storagerpc.QueryCacheSeconds*time.Second)
+}
+
+// thresholdPolicy requests a lease once a key has been read n times within
+// window.
+type thresholdPolicy struct {
+	n      int
+	window time.Duration
+
+	lock    sync.Mutex
+	queries map[string][]time.Time // Recent read times by key.
+	swept   time.Time              // When old reads were last discarded.
+}
+
+// ThresholdLeasePolicy returns a policy that requests a lease once a key has
+// been read n times in the last window.
+func ThresholdLeasePolicy(n int, window time.Duration) LeasePolicy {
+	return &thresholdPolicy{n: n, window: window, queries: make(map[string][]time.Time)}
+}
+
+func (p *thresholdPolicy) WantLease(key string, now time.Time) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if now.Sub(p.swept) > p.window {
+		for k, queries := range p.queries {
+			if queries = p.recent(queries, now); len(queries) == 0 {
+				delete(p.queries, k)
+			} else {
+				p.queries[k] = queries
+			}
+		}
+		p.swept = now
+	}
+	queries := append(p.recent(p.queries[key], now), now)
+	p.queries[key] = queries
+	return len(queries) >= p.n
+}
+
+// recent returns the suffix of queries made in the last window.
+func (p *thresholdPolicy) recent(queries []time.Time, now time.Time) []time.Time {
+	cutoff := now.Add(-p.window)
+	for len(queries) > 0 && !queries[0].After(cutoff) {
+		queries = queries[1:]
+	}
+	return queries
+}
+
+// decayPolicy requests a lease once a key's exponentially decayed read
+// count reaches a threshold.
+type decayPolicy struct {
+	threshold float64
+	halfLife  time.Duration
+
+	lock   sync.Mutex
+	counts map[string]*decayCount
+	swept  time.Time // When negligible counts were last discarded.
+}
+
+type decayCount struct {
+	count   float64
+	updated time.Time
+}
+
+// DecayLeasePolicy returns a policy that weighs each read of a key by how
+// recent it is, halving its weight every halfLife, and requests a lease once
+// the weighted count of the key's reads reaches threshold. Unlike
+// ThresholdLeasePolicy, it keeps a single number per key.
+func DecayLeasePolicy(threshold float64, halfLife time.Duration) LeasePolicy {
+	return &decayPolicy{threshold: threshold, halfLife: halfLife, counts: make(map[string]*decayCount)}
+}
+
+func (p *decayPolicy) WantLease(key string, now time.Time) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if now.Sub(p.swept) > p.halfLife {
+		for k, c := range p.counts {
+			if p.decay(c, now) < 0.01 {
+				delete(p.counts, k)
+			}
+		}
+		p.swept = now
+	}
+	c, ok := p.counts[key]
+	if !ok {
+		c = &decayCount{updated: now}
+		p.counts[key] = c
+	}
+	c.count = p.decay(c, now) + 1
+	c.updated = now
+	return c.count >= p.threshold
+}
+
+// decay returns c's count as of now.
+func (p *decayPolicy) decay(c *decayCount, now time.Time) float64 {
+	return c.count * math.Pow(0.5, float64(now.Sub(c.updated))/float64(p.halfLife))
+}
+
+// prefixPolicy overrides another policy for keys with given prefixes.
+type prefixPolicy struct {
+	prefixes []string
+	want     bool
+	next     LeasePolicy
+}
+
+// AlwaysLeasePrefixes returns a policy that always requests a lease for keys
+// starting with any of prefixes, and otherwise defers to next.
+func AlwaysLeasePrefixes(next LeasePolicy, prefixes ...string) LeasePolicy {
+	return &prefixPolicy{prefixes: prefixes, want: true, next: next}
+}
+
+// NeverLeasePrefixes returns a policy that never requests a lease for keys
+// starting with any of prefixes, and otherwise defers to next.
+func NeverLeasePrefixes(next LeasePolicy, prefixes ...string) LeasePolicy {
+	return &prefixPolicy{prefixes: prefixes, want: false, next: next}
+}
+
+func (p *prefixPolicy) WantLease(key string, now time.Time) bool {
+	for _, prefix := range p.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return p.want
+		}
+	}
+	return p.next.WantLease(key, now)
+}
@@ -3,7 +3,10 @@
 package libstore
 
 import (
+	"context"
+	"errors"
 	"hash/fnv"
+	"time"
 
 	"github.com/cmu440/tribbler/rpc/storagerpc"
 )
@@ -26,8 +29,145 @@ type Libstore interface {
 	GetList(key string) ([]string, error)
 	AppendToList(key, newItem string) error
 	RemoveFromList(key, removeItem string) error
+
+	// GetContext, PutContext, GetListContext, AppendToListContext and
+	// RemoveFromListContext are like Get, Put, GetList, AppendToList and
+	// RemoveFromList, but give up once ctx is done, returning ctx.Err().
+	// The methods that do not take a context give up after the Libstore's
+	// default timeout (see Options.Timeout).
+	GetContext(ctx context.Context, key string) (string, error)
+	PutContext(ctx context.Context, key, value string) error
+	GetListContext(ctx context.Context, key string) ([]string, error)
+	AppendToListContext(ctx context.Context, key, newItem string) error
+	RemoveFromListContext(ctx context.Context, key, removeItem string) error
+
+	// CompareAndSwap sets key's value to newValue if its current value is
+	// oldValue, and returns ErrPreconditionFailed otherwise. It allows
+	// read-modify-write sequences to be retried safely by several clients.
+	CompareAndSwap(key, oldValue, newValue string) error
+
+	// GetVersion and GetListVersion are like Get and GetList, but also
+	// return the key's version, which increases with every write to the key,
+	// even across the key's expiry.
+	GetVersion(key string) (string, uint64, error)
+	GetListVersion(key string) ([]string, uint64, error)
+
+	// PutIfVersion, AppendToListIfVersion and RemoveFromListIfVersion are
+	// like Put, AppendToList and RemoveFromList, but write only if key's
+	// current version is version, and return ErrPreconditionFailed otherwise.
+	PutIfVersion(key, value string, version uint64) error
+	AppendToListIfVersion(key, newItem string, version uint64) error
+	RemoveFromListIfVersion(key, removeItem string, version uint64) error
+
+	// GetListRange returns up to limit items (all of them if limit is zero)
+	// of key's list, starting offset items from its head or, if fromTail is
+	// set, ending offset items before its tail. The items are returned in
+	// the list's order. ListLength returns the length of key's list. Ranges
+	// and lengths are cached under leases, as whole lists are.
+	GetListRange(key string, offset, limit int, fromTail bool) ([]string, error)
+	ListLength(key string) (int, error)
+
+	// TrimList removes the oldest items of key's list, keeping its last
+	// length items.
+	TrimList(key string, length int) error
+
+	// GetListRangeContext, ListLengthContext and TrimListContext are like
+	// GetListRange, ListLength and TrimList, but give up once ctx is done,
+	// returning ctx.Err().
+	GetListRangeContext(ctx context.Context, key string, offset, limit int, fromTail bool) ([]string, error)
+	ListLengthContext(ctx context.Context, key string) (int, error)
+	TrimListContext(ctx context.Context, key string, length int) error
+
+	// MultiGet and MultiGetList are like Get and GetList for several keys at
+	// once. Keys that are not cached are fetched with a single request to
+	// each storage server involved. Keys that are not found are left out of
+	// the result.
+	MultiGet(keys []string) (map[string]string, error)
+	MultiGetList(keys []string) (map[string][]string, error)
+
+	// MultiGetContext and MultiGetListContext are like MultiGet and
+	// MultiGetList, but give up once ctx is done, returning ctx.Err().
+	MultiGetContext(ctx context.Context, keys []string) (map[string]string, error)
+	MultiGetListContext(ctx context.Context, keys []string) (map[string][]string, error)
+
+	// ScanPrefix returns, in increasing order, every key (value or list)
+	// that starts with prefix. Each storage server's range is paged through
+	// in parallel. Keys written or moved between servers during the scan
+	// may be missed.
+	ScanPrefix(prefix string) ([]string, error)
+
+	// PutWithTTL and AppendToListWithTTL are like Put and AppendToList, but
+	// make key expire ttl after the write. Expired keys are not found, and
+	// are never served from the cache.
+	PutWithTTL(key, value string, ttl time.Duration) error
+	AppendToListWithTTL(key, newItem string, ttl time.Duration) error
+
+	// Begin starts a transaction, whose writes are buffered until it is
+	// committed.
+	Begin() Transaction
+
+	// CacheStats reports how well the Libstore's cache is doing.
+	CacheStats() CacheStats
+
+	// ConnStats reports on the Libstore's connections to each storage
+	// server it has called, sorted by host:port.
+	ConnStats() []ConnStats
+
+	// Watch calls fn with each write to key, and WatchPrefix with each
+	// write to a key that starts with prefix, until the returned function
+	// is called. The calls of fn are serialized, and each key's writes are
+	// passed in order. Events are lost if the Libstore falls far behind or
+	// a storage server fails; a gap in a key's versions reveals the loss.
+	// Only a Libstore that receives callbacks (i.e. whose mode is not
+	// Never) may watch keys.
+	Watch(key string, fn func(storagerpc.WatchEvent)) (func(), error)
+	WatchPrefix(prefix string, fn func(storagerpc.WatchEvent)) (func(), error)
+}
+
+// CacheStats describes a Libstore's cache. The counters cover the
+// Libstore's whole lifetime.
+type CacheStats struct {
+	Hits      uint64 // Reads of a key served from the cache.
+	Misses    uint64 // Reads of a key sent to a storage server.
+	Evictions uint64 // Keys evicted to keep the cache within its bounds.
+	Updates   uint64 // Writes applied to cached keys under write-through leases.
+	Entries   int    // Number of keys currently cached.
+	Bytes     int    // Approximate size of the keys and values currently cached.
 }
 
+// ConnStats describes a Libstore's connections to one storage server. The
+// counters cover the Libstore's whole lifetime.
+type ConnStats struct {
+	HostPort string
+	Conns    int    // Number of connections currently open.
+	InFlight int    // Number of calls currently awaiting a reply.
+	Calls    uint64 // Calls made.
+	Dials    uint64 // Connections dialed.
+	Failures uint64 // Connections closed because a call or health check failed.
+}
+
+// Transaction is a set of writes, possibly to keys stored on different
+// storage servers, that are made either all together or not at all. The
+// writes are made in order, so a list write sees the effect of earlier
+// writes to the same list. A Transaction must not be used concurrently.
+type Transaction interface {
+	Put(key, value string)
+	AppendToList(key, newItem string)
+	RemoveFromList(key, removeItem string)
+
+	// Commit makes the transaction's writes. If any of them cannot be made
+	// (an AppendToList of an item that is already in the list, say), none
+	// is made and an error is returned.
+	Commit() error
+
+	// Abort discards the transaction's writes.
+	Abort()
+}
+
+// ErrPreconditionFailed is returned by CompareAndSwap and the versioned
+// writes when the key's value or version is not the expected one.
+var ErrPreconditionFailed = errors.New("precondition failed")
+
 // LeaseCallbacks defines the set of methods that a StorageServer can call
 // on a TribServer's local cache.
 type LeaseCallbacks interface {
@@ -37,6 +177,18 @@ type LeaseCallbacks interface {
 	// if the key was successfully revoked, or with status KeyNotFound
 	// if the key did not exist in the cache.
 	RevokeLease(*storagerpc.RevokeLeaseArgs, *storagerpc.RevokeLeaseReply) error
+
+	// KeyChanged is a callback RPC method that is invoked by storage servers
+	// with the writes to the keys that the Libstore watches. It should reply
+	// with status OK once it has handled the events.
+	KeyChanged(*storagerpc.KeyChangedArgs, *storagerpc.KeyChangedReply) error
+
+	// UpdateLease is a callback RPC method that is invoked by storage
+	// servers with the writes to keys on which the Libstore holds
+	// write-through leases. It should reply with status OK if the write was
+	// applied to the cached key, which keeps its lease, or with status
+	// KeyNotFound if the key was instead dropped from the cache.
+	UpdateLease(*storagerpc.UpdateLeaseArgs, *storagerpc.UpdateLeaseReply) error
 }
 
 // StoreHash hashes a string key and returns a 32-bit integer. This function
@@ -1,13 +1,133 @@
 package libstore
 
 import (
+	"container/list"
+	"context"
 	"errors"
+	"fmt"
+	"net/rpc"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/cmu440/tribbler/rpc/librpc"
 	"github.com/cmu440/tribbler/rpc/storagerpc"
 )
 
+const (
+	// Number of times NewLibstore retries GetServers while the ring is not ready.
+	maxGetServersRetries = 5
+
+	// After a storage server replies WrongServer, the Libstore polls the
+	// master this many times (at this interval) for a newer ring.
+	ringRefreshAttempts = 8
+	ringRefreshInterval = 250 * time.Millisecond
+
+	// How often the Libstore refreshes its view of the ring (and thus of
+	// the storage servers' liveness) in the background.
+	ringRefreshPeriod = 2 * time.Second
+
+	// The number of keys that ScanPrefix requests from a storage server at a time.
+	scanPageSize = 100
+
+	// How many times (and at what interval) Commit retries a transaction
+	// whose keys are locked by another transaction.
+	maxTxAttempts   = 5
+	txRetryInterval = 100 * time.Millisecond
+
+	// Requests that fail because a storage server is unreachable are resent
+	// (if they are safe to resend) after a delay that starts at
+	// minRetryBackoff and doubles up to maxRetryBackoff, until retryDeadline
+	// has passed since the first attempt.
+	minRetryBackoff = 50 * time.Millisecond
+	maxRetryBackoff = time.Second
+	retryDeadline   = 10 * time.Second
+
+	// How long the methods that do not take a context wait for a reply, by
+	// default. A write may wait for the key's leases to expire, so this is
+	// longer than the longest lease.
+	defaultTimeout = 30 * time.Second
+)
+
+// cacheEntry is a value or list cached under a lease.
+type cacheEntry struct {
+	value   string
+	list    []string
+	version uint64
+	expiry  time.Time
+	size    int           // Approximate number of bytes the entry holds.
+	elem    *list.Element // The entry's element of the LRU list, whose value is the key.
+	rangeOf string        // The list whose range or length the entry holds, if any.
+	length  int           // The length of the list rangeOf.
+}
+
+// Options holds optional settings for a Libstore. The zero value selects
+// the defaults.
+type Options struct {
+	// LeasePolicy decides when to request leases in Normal mode. If nil,
+	// DefaultLeasePolicy is used.
+	LeasePolicy LeasePolicy
+
+	// MaxCacheEntries and MaxCacheBytes bound the number of keys and the
+	// (approximate) number of bytes of keys and values in the cache. Once
+	// either is exceeded, the least recently used keys are evicted, and
+	// their leases forgotten. Zero values leave the cache unbounded.
+	MaxCacheEntries int
+	MaxCacheBytes   int
+
+	// Timeout bounds how long the methods that do not take a context wait
+	// for the storage servers. If zero, a default of 30 seconds is used.
+	// Storage servers configured to grant leases longer than
+	// storagerpc.MaxLeaseSeconds may hold writes for longer than that.
+	Timeout time.Duration
+
+	// PoolSize is the most connections kept open to each storage server.
+	// If zero, a default of 4 is used.
+	PoolSize int
+
+	// WriteThrough requests write-through leases, under which the storage
+	// servers send writes to cached keys to the Libstore, which applies them
+	// to its cache, instead of revoking the leases.
+	WriteThrough bool
+}
+
 type libstore struct {
-	// TODO: implement this!
+	seeds      []string // Host:ports of storage servers to ask for the ring.
+	myHostPort string
+	mode       LeaseMode
+	policy     LeasePolicy
+	id         string // Prefix of the IDs of this Libstore's writes.
+	timeout    time.Duration
+	requestSeq uint64 // Number of writes sent, accessed atomically.
+	writeThru  bool   // Whether write-through leases are requested.
+
+	ringLock sync.Mutex
+	servers  []storagerpc.Node              // All storage servers sorted by NodeID.
+	index    *storagerpc.Ring               // Index of servers' points.
+	version  uint64                         // Version of servers.
+	liveness map[string]storagerpc.Liveness // Liveness of the storage servers by host:port.
+
+	poolsLock sync.Mutex
+	pools     map[string]*connPool // Storage server connections by host:port.
+	poolSize  int
+
+	watchLock    sync.Mutex
+	watches      map[*watch]bool
+	dispatchLock sync.Mutex    // Serializes the calls of watch functions.
+	ringChanged  chan struct{} // Signaled when a newer ring is fetched.
+
+	cacheLock  sync.Mutex
+	cache      map[string]*cacheEntry
+	lru        *list.List // Keys of cache, most recently used first.
+	cacheBytes int        // Total size of the entries in cache.
+	maxEntries int
+	maxBytes   int
+	stats      CacheStats
+	revokes    uint64                     // Number of RevokeLease and UpdateLease calls received.
+	ranges     map[string]map[string]bool // Cache keys of the ranges and lengths of each list.
 }
 
 // NewLibstore creates a new instance of a TribServer's libstore. masterServerHostPort
@@ -29,35 +149,1138 @@ type libstore struct {
 // To register the Libstore to receive RPCs from the storage servers, the following
 // line of code should suffice:
 //
-//     rpc.RegisterName("LeaseCallbacks", librpc.Wrap(libstore))
+//	rpc.RegisterName("LeaseCallbacks", librpc.Wrap(libstore))
 //
 // Note that unlike in the NewTribServer and NewStorageServer functions, there is no
 // need to create a brand new HTTP handler to serve the requests (the Libstore may
 // simply reuse the TribServer's HTTP handler since the two run in the same process).
 func NewLibstore(masterServerHostPort, myHostPort string, mode LeaseMode) (Libstore, error) {
-	return nil, errors.New("not implemented")
+	return NewLibstoreWithSeeds([]string{masterServerHostPort}, myHostPort, mode)
+}
+
+// NewLibstoreWithSeeds is like NewLibstore, but accepts the host:ports of
+// several storage servers (any nodes of the ring) instead of the master's
+// alone. The Libstore fetches the ring from the first seed that replies, and
+// later from any node of the ring, so it keeps working after the master fails.
+func NewLibstoreWithSeeds(seeds []string, myHostPort string, mode LeaseMode) (Libstore, error) {
+	return NewLibstoreWithOptions(seeds, myHostPort, mode, Options{})
+}
+
+// NewLibstoreWithOptions is like NewLibstoreWithSeeds, but additionally
+// accepts a set of optional settings.
+func NewLibstoreWithOptions(seeds []string, myHostPort string, mode LeaseMode, opts Options) (Libstore, error) {
+	if len(seeds) == 0 {
+		return nil, errors.New("no storage servers given")
+	}
+	ls := &libstore{
+		seeds:       seeds,
+		myHostPort:  myHostPort,
+		mode:        mode,
+		policy:      opts.LeasePolicy,
+		id:          fmt.Sprintf("%s/%x", myHostPort, time.Now().UnixNano()),
+		timeout:     opts.Timeout,
+		writeThru:   opts.WriteThrough,
+		pools:       make(map[string]*connPool),
+		watches:     make(map[*watch]bool),
+		ringChanged: make(chan struct{}, 1),
+		poolSize:    opts.PoolSize,
+		cache:       make(map[string]*cacheEntry),
+		ranges:      make(map[string]map[string]bool),
+		lru:         list.New(),
+		maxEntries:  opts.MaxCacheEntries,
+		maxBytes:    opts.MaxCacheBytes,
+	}
+	if ls.policy == nil {
+		ls.policy = DefaultLeasePolicy()
+	}
+	if ls.timeout <= 0 {
+		ls.timeout = defaultTimeout
+	}
+	if ls.poolSize <= 0 {
+		ls.poolSize = defaultPoolSize
+	}
+
+	for i := 0; ; i++ {
+		ctx, cancel := ls.defaultContext()
+		ok, err := ls.refreshRing(ctx)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			break
+		}
+		if i == maxGetServersRetries {
+			return nil, errors.New("storage servers are not ready")
+		}
+		time.Sleep(time.Second)
+	}
+
+	if mode != Never {
+		if err := rpc.RegisterName("LeaseCallbacks", librpc.Wrap(ls)); err != nil {
+			return nil, err
+		}
+		go ls.renewWatches()
+	}
+	go ls.expireCache()
+	go ls.watchRing()
+	go ls.checkConns()
+	return ls, nil
 }
 
 func (ls *libstore) Get(key string) (string, error) {
-	return "", errors.New("not implemented")
+	ctx, cancel := ls.defaultContext()
+	defer cancel()
+	return ls.GetContext(ctx, key)
+}
+
+func (ls *libstore) GetContext(ctx context.Context, key string) (string, error) {
+	value, _, err := ls.getVersion(ctx, key)
+	return value, err
+}
+
+func (ls *libstore) GetVersion(key string) (string, uint64, error) {
+	ctx, cancel := ls.defaultContext()
+	defer cancel()
+	return ls.getVersion(ctx, key)
+}
+
+func (ls *libstore) getVersion(ctx context.Context, key string) (string, uint64, error) {
+	session := sessionFrom(ctx)
+	if entry, ok := ls.cached(key, session.version(key)); ok {
+		return entry.value, entry.version, nil
+	}
+	revokes := ls.revokeCount()
+	args := &storagerpc.GetArgs{Key: key, WantLease: ls.wantLease(key), HostPort: ls.myHostPort, WriteThrough: ls.writeThru}
+	var reply *storagerpc.GetReply
+	err := ls.retry(ctx, true, func() (storagerpc.Status, error) {
+		reply = new(storagerpc.GetReply)
+		err := ls.read(ctx, "StorageServer.Get", key, args, reply, func() bool {
+			return !session.stale(key, reply.Status, reply.Version)
+		})
+		return reply.Status, err
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	if reply.Status != storagerpc.OK {
+		return "", 0, fmt.Errorf("Get operation failed with status %s", reply.Status)
+	}
+	if reply.Lease.Granted {
+		ls.cacheLease(key, &cacheEntry{value: reply.Value, version: reply.Version}, reply.Lease, reply.TTL, revokes)
+	}
+	return reply.Value, reply.Version, nil
+}
+
+func (ls *libstore) MultiGet(keys []string) (map[string]string, error) {
+	ctx, cancel := ls.defaultContext()
+	defer cancel()
+	return ls.MultiGetContext(ctx, keys)
+}
+
+func (ls *libstore) MultiGetContext(ctx context.Context, keys []string) (map[string]string, error) {
+	values := make(map[string]string, len(keys))
+	session := sessionFrom(ctx)
+	var missing []string
+	for _, key := range dedupe(keys) {
+		if entry, ok := ls.cached(key, session.version(key)); ok {
+			values[key] = entry.value
+		} else {
+			missing = append(missing, key)
+		}
+	}
+	revokes := ls.revokeCount()
+	leases := ls.wantLeases(missing)
+	var valuesLock sync.Mutex
+	err := ls.batch(ctx, missing, func(hostPorts []string, keys []string) ([]storagerpc.Status, error) {
+		args := ls.multiGetArgs(keys, leases)
+		reply := new(storagerpc.MultiGetReply)
+		err := ls.retry(ctx, true, func() (storagerpc.Status, error) {
+			err := ls.readFrom(ctx, hostPorts, "StorageServer.MultiGet", args, reply, func() bool {
+				for i, r := range reply.Replies {
+					if i < len(keys) && session.stale(keys[i], r.Status, r.Version) {
+						return false
+					}
+				}
+				return true
+			})
+			return reply.Status, err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if reply.Status != storagerpc.OK || len(reply.Replies) != len(keys) {
+			return nil, fmt.Errorf("MultiGet operation failed with status %s", reply.Status)
+		}
+		statuses := make([]storagerpc.Status, len(keys))
+		valuesLock.Lock()
+		defer valuesLock.Unlock()
+		for i, r := range reply.Replies {
+			if statuses[i] = r.Status; r.Status != storagerpc.OK {
+				continue
+			}
+			values[keys[i]] = r.Value
+			if r.Lease.Granted {
+				ls.cacheLease(keys[i], &cacheEntry{value: r.Value, version: r.Version}, r.Lease, r.TTL, revokes)
+			}
+		}
+		return statuses, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func (ls *libstore) ScanPrefix(prefix string) ([]string, error) {
+	ctx, cancel := ls.defaultContext()
+	defer cancel()
+	ls.ringLock.Lock()
+	servers := ls.servers
+	ls.ringLock.Unlock()
+
+	type result struct {
+		keys []string
+		err  error
+	}
+	results := make(chan result, len(servers))
+	for _, node := range servers {
+		go func(node storagerpc.Node) {
+			keys, err := ls.scanNode(ctx, node, prefix)
+			results <- result{keys, err}
+		}(node)
+	}
+	var keys []string
+	var err error
+	for range servers {
+		r := <-results
+		if r.err != nil {
+			err = r.err
+		}
+		keys = append(keys, r.keys...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	return dedupe(keys), nil
+}
+
+// scanNode pages through the keys starting with prefix in node's ranges.
+// Should node be unreachable, its ranges are scanned on their replicas
+// instead. A replica returns every key of node's ranges that it stores, so
+// a range need not be scanned again once one of its replicas was scanned.
+func (ls *libstore) scanNode(ctx context.Context, node storagerpc.Node, prefix string) ([]string, error) {
+	keys, err := ls.scanFrom(ctx, node.HostPort, node.NodeID, prefix)
+	if _, ok := err.(rpc.ServerError); err == nil || ok || ctx.Err() != nil {
+		return keys, err
+	}
+	ls.ringLock.Lock()
+	sets := ls.index.ReplicaSets(node.NodeID)
+	ls.ringLock.Unlock()
+	scanned := make(map[string]bool)
+	for _, set := range sets {
+		replicas := set[1:]
+		if anyOf(replicas, scanned) {
+			continue
+		}
+		err = unavailableError(fmt.Sprintf("no live storage server replicates the ranges of %s", node.HostPort))
+		for _, hostPort := range ls.byLiveness(replicas) {
+			var found []string
+			if found, err = ls.scanFrom(ctx, hostPort, node.NodeID, prefix); err == nil {
+				keys = append(keys, found...)
+				scanned[hostPort] = true
+				break
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+func anyOf(list []string, set map[string]bool) bool {
+	for _, s := range list {
+		if set[s] {
+			return true
+		}
+	}
+	return false
+}
+
+// scanFrom pages through the keys starting with prefix in the ranges of the
+// node with the given ID that the storage server at hostPort stores.
+func (ls *libstore) scanFrom(ctx context.Context, hostPort string, nodeID uint32, prefix string) ([]string, error) {
+	args := &storagerpc.ScanArgs{Prefix: prefix, NodeID: nodeID, Limit: scanPageSize}
+	var keys []string
+	for {
+		var reply storagerpc.ScanReply
+		if err := ls.readFrom(ctx, []string{hostPort}, "StorageServer.ScanPrefix", args, &reply, nil); err != nil {
+			return nil, err
+		}
+		if reply.Status != storagerpc.OK {
+			return nil, fmt.Errorf("ScanPrefix operation failed with status %s", reply.Status)
+		}
+		keys = append(keys, reply.Keys...)
+		if reply.Cursor == "" {
+			return keys, nil
+		}
+		args.Cursor = reply.Cursor
+	}
 }
 
 func (ls *libstore) Put(key, value string) error {
-	return errors.New("not implemented")
+	ctx, cancel := ls.defaultContext()
+	defer cancel()
+	return ls.PutContext(ctx, key, value)
+}
+
+func (ls *libstore) PutContext(ctx context.Context, key, value string) error {
+	return ls.write(ctx, "StorageServer.Put", "Put", &storagerpc.PutArgs{Key: key, Value: value})
+}
+
+func (ls *libstore) PutIfVersion(key, value string, version uint64) error {
+	ctx, cancel := ls.defaultContext()
+	defer cancel()
+	return ls.write(ctx, "StorageServer.Put", "Put", &storagerpc.PutArgs{Key: key, Value: value, Version: version})
+}
+
+func (ls *libstore) PutWithTTL(key, value string, ttl time.Duration) error {
+	ctx, cancel := ls.defaultContext()
+	defer cancel()
+	return ls.write(ctx, "StorageServer.Put", "Put", &storagerpc.PutArgs{Key: key, Value: value, TTL: ttl})
 }
 
 func (ls *libstore) GetList(key string) ([]string, error) {
-	return nil, errors.New("not implemented")
+	ctx, cancel := ls.defaultContext()
+	defer cancel()
+	return ls.GetListContext(ctx, key)
+}
+
+func (ls *libstore) GetListContext(ctx context.Context, key string) ([]string, error) {
+	list, _, err := ls.getListVersion(ctx, key)
+	return list, err
+}
+
+func (ls *libstore) GetListVersion(key string) ([]string, uint64, error) {
+	ctx, cancel := ls.defaultContext()
+	defer cancel()
+	return ls.getListVersion(ctx, key)
+}
+
+func (ls *libstore) getListVersion(ctx context.Context, key string) ([]string, uint64, error) {
+	session := sessionFrom(ctx)
+	if entry, ok := ls.cached(key, session.version(key)); ok {
+		return append([]string(nil), entry.list...), entry.version, nil
+	}
+	revokes := ls.revokeCount()
+	args := &storagerpc.GetArgs{Key: key, WantLease: ls.wantLease(key), HostPort: ls.myHostPort, WriteThrough: ls.writeThru}
+	var reply *storagerpc.GetListReply
+	err := ls.retry(ctx, true, func() (storagerpc.Status, error) {
+		reply = new(storagerpc.GetListReply)
+		err := ls.read(ctx, "StorageServer.GetList", key, args, reply, func() bool {
+			return !session.stale(key, reply.Status, reply.Version)
+		})
+		return reply.Status, err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if reply.Status != storagerpc.OK {
+		return nil, 0, fmt.Errorf("GetList operation failed with status %s", reply.Status)
+	}
+	if reply.Lease.Granted {
+		list := append([]string(nil), reply.Value...)
+		ls.cacheLease(key, &cacheEntry{list: list, version: reply.Version}, reply.Lease, reply.TTL, revokes)
+	}
+	return reply.Value, reply.Version, nil
+}
+
+func (ls *libstore) MultiGetList(keys []string) (map[string][]string, error) {
+	ctx, cancel := ls.defaultContext()
+	defer cancel()
+	return ls.MultiGetListContext(ctx, keys)
+}
+
+func (ls *libstore) MultiGetListContext(ctx context.Context, keys []string) (map[string][]string, error) {
+	lists := make(map[string][]string, len(keys))
+	session := sessionFrom(ctx)
+	var missing []string
+	for _, key := range dedupe(keys) {
+		if entry, ok := ls.cached(key, session.version(key)); ok {
+			lists[key] = append([]string(nil), entry.list...)
+		} else {
+			missing = append(missing, key)
+		}
+	}
+	revokes := ls.revokeCount()
+	leases := ls.wantLeases(missing)
+	var listsLock sync.Mutex
+	err := ls.batch(ctx, missing, func(hostPorts []string, keys []string) ([]storagerpc.Status, error) {
+		args := ls.multiGetArgs(keys, leases)
+		reply := new(storagerpc.MultiGetListReply)
+		err := ls.retry(ctx, true, func() (storagerpc.Status, error) {
+			err := ls.readFrom(ctx, hostPorts, "StorageServer.MultiGetList", args, reply, func() bool {
+				for i, r := range reply.Replies {
+					if i < len(keys) && session.stale(keys[i], r.Status, r.Version) {
+						return false
+					}
+				}
+				return true
+			})
+			return reply.Status, err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if reply.Status != storagerpc.OK || len(reply.Replies) != len(keys) {
+			return nil, fmt.Errorf("MultiGetList operation failed with status %s", reply.Status)
+		}
+		statuses := make([]storagerpc.Status, len(keys))
+		listsLock.Lock()
+		defer listsLock.Unlock()
+		for i, r := range reply.Replies {
+			if statuses[i] = r.Status; r.Status != storagerpc.OK {
+				continue
+			}
+			lists[keys[i]] = r.Value
+			if r.Lease.Granted {
+				list := append([]string(nil), r.Value...)
+				ls.cacheLease(keys[i], &cacheEntry{list: list, version: r.Version}, r.Lease, r.TTL, revokes)
+			}
+		}
+		return statuses, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lists, nil
 }
 
 func (ls *libstore) RemoveFromList(key, removeItem string) error {
-	return errors.New("not implemented")
+	ctx, cancel := ls.defaultContext()
+	defer cancel()
+	return ls.RemoveFromListContext(ctx, key, removeItem)
+}
+
+func (ls *libstore) RemoveFromListContext(ctx context.Context, key, removeItem string) error {
+	return ls.write(ctx, "StorageServer.RemoveFromList", "RemoveFromList", &storagerpc.PutArgs{Key: key, Value: removeItem})
+}
+
+func (ls *libstore) RemoveFromListIfVersion(key, removeItem string, version uint64) error {
+	ctx, cancel := ls.defaultContext()
+	defer cancel()
+	return ls.write(ctx, "StorageServer.RemoveFromList", "RemoveFromList", &storagerpc.PutArgs{Key: key, Value: removeItem, Version: version})
 }
 
 func (ls *libstore) AppendToList(key, newItem string) error {
-	return errors.New("not implemented")
+	ctx, cancel := ls.defaultContext()
+	defer cancel()
+	return ls.AppendToListContext(ctx, key, newItem)
+}
+
+func (ls *libstore) AppendToListContext(ctx context.Context, key, newItem string) error {
+	return ls.write(ctx, "StorageServer.AppendToList", "AppendToList", &storagerpc.PutArgs{Key: key, Value: newItem})
+}
+
+func (ls *libstore) AppendToListIfVersion(key, newItem string, version uint64) error {
+	ctx, cancel := ls.defaultContext()
+	defer cancel()
+	return ls.write(ctx, "StorageServer.AppendToList", "AppendToList", &storagerpc.PutArgs{Key: key, Value: newItem, Version: version})
+}
+
+func (ls *libstore) AppendToListWithTTL(key, newItem string, ttl time.Duration) error {
+	ctx, cancel := ls.defaultContext()
+	defer cancel()
+	return ls.write(ctx, "StorageServer.AppendToList", "AppendToList", &storagerpc.PutArgs{Key: key, Value: newItem, TTL: ttl})
+}
+
+func (ls *libstore) CompareAndSwap(key, oldValue, newValue string) error {
+	ctx, cancel := ls.defaultContext()
+	defer cancel()
+	args := &storagerpc.CompareAndSwapArgs{Key: key, OldValue: oldValue, NewValue: newValue}
+	var reply *storagerpc.CompareAndSwapReply
+	err := ls.retry(ctx, false, func() (storagerpc.Status, error) {
+		reply = new(storagerpc.CompareAndSwapReply)
+		err := ls.callPrimary(ctx, key, "StorageServer.CompareAndSwap", args, reply)
+		return reply.Status, err
+	})
+	if err != nil {
+		return err
+	}
+	switch reply.Status {
+	case storagerpc.OK:
+		return nil
+	case storagerpc.PreconditionFailed:
+		return ErrPreconditionFailed
+	}
+	return fmt.Errorf("CompareAndSwap operation failed with status %s", reply.Status)
+}
+
+// transaction buffers writes until it is committed.
+type transaction struct {
+	ls  *libstore
+	ops []storagerpc.TxOp
+}
+
+func (ls *libstore) Begin() Transaction {
+	return &transaction{ls: ls}
+}
+
+func (tx *transaction) Put(key, value string) {
+	tx.ops = append(tx.ops, storagerpc.TxOp{Op: storagerpc.OpPut, Key: key, Value: value})
+}
+
+func (tx *transaction) AppendToList(key, newItem string) {
+	tx.ops = append(tx.ops, storagerpc.TxOp{Op: storagerpc.OpAppendToList, Key: key, Value: newItem})
+}
+
+func (tx *transaction) RemoveFromList(key, removeItem string) {
+	tx.ops = append(tx.ops, storagerpc.TxOp{Op: storagerpc.OpRemoveFromList, Key: key, Value: removeItem})
+}
+
+func (tx *transaction) Commit() error {
+	ops := tx.ops
+	tx.ops = nil
+	if len(ops) == 0 {
+		return nil
+	}
+	return tx.ls.transact(ops)
+}
+
+func (tx *transaction) Abort() {
+	tx.ops = nil
+}
+
+// transact sends a transaction to the primary of its first key, which
+// coordinates it. Transactions that conflict with another are retried a
+// few times.
+func (ls *libstore) transact(ops []storagerpc.TxOp) error {
+	ctx, cancel := ls.defaultContext()
+	defer cancel()
+	args := &storagerpc.TransactArgs{Ops: ops}
+	var reply *storagerpc.TransactReply
+	for i := 1; ; i++ {
+		err := ls.retry(ctx, false, func() (storagerpc.Status, error) {
+			reply = new(storagerpc.TransactReply)
+			err := ls.callPrimary(ctx, ops[0].Key, "StorageServer.Transact", args, reply)
+			return reply.Status, err
+		})
+		if err != nil {
+			return err
+		}
+		if reply.Status != storagerpc.Locked || i == maxTxAttempts {
+			break
+		}
+		if err := sleep(ctx, txRetryInterval); err != nil {
+			return err
+		}
+	}
+	if reply.Status != storagerpc.OK {
+		return fmt.Errorf("Commit operation failed with status %s", reply.Status)
+	}
+	return nil
 }
 
 func (ls *libstore) RevokeLease(args *storagerpc.RevokeLeaseArgs, reply *storagerpc.RevokeLeaseReply) error {
-	return errors.New("not implemented")
+	ls.cacheLock.Lock()
+	defer ls.cacheLock.Unlock()
+	ls.revokes++
+	found := ls.uncacheRangesLocked(args.Key)
+	if _, ok := ls.cache[args.Key]; ok {
+		ls.uncacheLocked(args.Key)
+		found = true
+	}
+	if found {
+		reply.Status = storagerpc.OK
+	} else {
+		reply.Status = storagerpc.KeyNotFound
+	}
+	return nil
+}
+
+func (ls *libstore) UpdateLease(args *storagerpc.UpdateLeaseArgs, reply *storagerpc.UpdateLeaseReply) error {
+	ls.cacheLock.Lock()
+	defer ls.cacheLock.Unlock()
+	ls.revokes++
+	// Cached ranges and lengths cannot be updated, only the whole list.
+	ls.uncacheRangesLocked(args.Key)
+	entry, ok := ls.cache[args.Key]
+	switch {
+	case ok && entry.version >= args.Version:
+		// The entry was fetched after the write was made. Versions keep
+		// increasing across a key's deletion, expiry and transfer between
+		// servers, so an update to a recreated key is never taken for one.
+		reply.Status = storagerpc.OK
+	case ok && entry.version == args.Version-1:
+		ls.applyLocked(args.Key, entry, args)
+		reply.Status = storagerpc.OK
+	default:
+		// The entry missed a write, or is not cached at all.
+		if ok {
+			ls.uncacheLocked(args.Key)
+		}
+		reply.Status = storagerpc.KeyNotFound
+	}
+	return nil
+}
+
+// applyLocked applies the write described by args to key's cache entry.
+func (ls *libstore) applyLocked(key string, entry *cacheEntry, args *storagerpc.UpdateLeaseArgs) {
+	switch args.Op {
+	case storagerpc.OpPut:
+		entry.value = args.Value
+	case storagerpc.OpAppendToList:
+		entry.list = append(entry.list[:len(entry.list):len(entry.list)], args.Value)
+	case storagerpc.OpRemoveFromList:
+		for i, item := range entry.list {
+			if item == args.Value {
+				entry.list = append(entry.list[:i:i], entry.list[i+1:]...)
+				break
+			}
+		}
+	}
+	entry.version = args.Version
+	if args.TTL > 0 {
+		if expiry := time.Now().Add(args.TTL); expiry.Before(entry.expiry) {
+			entry.expiry = expiry
+		}
+	}
+	size := len(key) + len(entry.value)
+	for _, item := range entry.list {
+		size += len(item)
+	}
+	ls.cacheBytes += size - entry.size
+	entry.size = size
+	ls.lru.MoveToFront(entry.elem)
+	ls.stats.Updates++
+	for ls.maxBytes > 0 && ls.cacheBytes > ls.maxBytes {
+		ls.uncacheLocked(ls.lru.Back().Value.(string))
+		ls.stats.Evictions++
+	}
+}
+
+// write sends a modification of a key to the primary of the key's range.
+// The write carries a request ID, so that the primary makes it only once
+// even if it is resent.
+func (ls *libstore) write(ctx context.Context, method, opName string, args *storagerpc.PutArgs) error {
+	args.RequestID = ls.nextRequestID()
+	return ls.sendWrite(ctx, method, opName, args.Key, args)
+}
+
+// nextRequestID returns a new ID for a write.
+func (ls *libstore) nextRequestID() string {
+	return fmt.Sprintf("%s/%d", ls.id, atomic.AddUint64(&ls.requestSeq, 1))
+}
+
+// sendWrite sends a modification of key, whose arguments carry a request ID,
+// to the primary of the key's range, and interprets its reply.
+func (ls *libstore) sendWrite(ctx context.Context, method, opName, key string, args interface{}) error {
+	var reply *storagerpc.PutReply
+	err := ls.retry(ctx, true, func() (storagerpc.Status, error) {
+		reply = new(storagerpc.PutReply)
+		err := ls.callPrimary(ctx, key, method, args, reply)
+		return reply.Status, err
+	})
+	if err != nil {
+		return err
+	}
+	switch reply.Status {
+	case storagerpc.OK:
+		sessionFrom(ctx).wrote(key, reply.Version)
+		return nil
+	case storagerpc.PreconditionFailed:
+		return ErrPreconditionFailed
+	}
+	return fmt.Errorf("%s operation failed with status %s", opName, reply.Status)
+}
+
+// callPrimary sends a request concerning key to the primary of the key's
+// range, failing immediately if the primary is known to be dead.
+func (ls *libstore) callPrimary(ctx context.Context, key, method string, args, reply interface{}) error {
+	hostPort := ls.route(key).HostPort
+	if ls.livenessOf(hostPort) == storagerpc.Dead {
+		return unavailableError(fmt.Sprintf("storage server %s is unavailable", hostPort))
+	}
+	return ls.call(ctx, hostPort, method, args, reply)
+}
+
+// read sends a read of key to the primary of the key's range, falling back
+// to the range's replicas (in order) if the primary is unreachable or its
+// reply is not fresh.
+func (ls *libstore) read(ctx context.Context, method, key string, args, reply interface{}, fresh func() bool) error {
+	return ls.readFrom(ctx, ls.replicaSet(key), method, args, reply, fresh)
+}
+
+// readFrom sends a read to the first of the storage servers at hostPorts,
+// falling back to the others (in order) if it is unreachable. Servers that
+// are suspected to have failed are tried last, and dead servers not at all.
+// Unless fresh is nil, a reply for which fresh returns false (because the
+// server lags behind the writes of the caller's Session) is discarded, and
+// the next server is tried; if every server lags, readFrom returns a
+// staleError.
+func (ls *libstore) readFrom(ctx context.Context, hostPorts []string, method string, args, reply interface{}, fresh func() bool) error {
+	var err error = unavailableError(fmt.Sprintf("no live storage server stores the range of %s", hostPorts[0]))
+	for _, hostPort := range ls.byLiveness(hostPorts) {
+		// Fields missing from a reply are not zeroed by decoding it.
+		v := reflect.ValueOf(reply).Elem()
+		v.Set(reflect.Zero(v.Type()))
+		err = ls.call(ctx, hostPort, method, args, reply)
+		if err == nil && fresh != nil && !fresh() {
+			err = staleError(fmt.Sprintf("storage server %s has yet to apply the session's writes", hostPort))
+			continue
+		}
+		if _, ok := err.(rpc.ServerError); err == nil || ok || ctx.Err() != nil {
+			break
+		}
+	}
+	return err
+}
+
+// byLiveness returns the storage servers at hostPorts that are alive (in
+// order), followed by those suspected to have failed. Dead servers are left out.
+func (ls *libstore) byLiveness(hostPorts []string) []string {
+	var alive, suspect []string
+	for _, hostPort := range hostPorts {
+		switch ls.livenessOf(hostPort) {
+		case storagerpc.Alive:
+			alive = append(alive, hostPort)
+		case storagerpc.Suspect:
+			suspect = append(suspect, hostPort)
+		}
+	}
+	return append(alive, suspect...)
+}
+
+// batch groups keys by the storage servers that store them and calls send
+// once for each group in parallel, passing the servers in the order that
+// readFrom expects. send returns the status of each of the keys it was
+// given. Keys answered with status WrongServer are sent again once a newer
+// ring is available.
+func (ls *libstore) batch(ctx context.Context, keys []string, send func(hostPorts []string, keys []string) ([]storagerpc.Status, error)) error {
+	type result struct {
+		keys     []string
+		statuses []storagerpc.Status
+		err      error
+	}
+	for len(keys) > 0 {
+		version := ls.ringVersion()
+		sets := make(map[string][]string)
+		groups := make(map[string][]string)
+		for _, key := range keys {
+			set := ls.replicaSet(key)
+			id := strings.Join(set, ",")
+			sets[id] = set
+			groups[id] = append(groups[id], key)
+		}
+		results := make(chan result, len(groups))
+		for id, group := range groups {
+			go func(hostPorts []string, keys []string) {
+				statuses, err := send(hostPorts, keys)
+				results <- result{keys, statuses, err}
+			}(sets[id], group)
+		}
+		var err error
+		var moved []string
+		for range groups {
+			r := <-results
+			if r.err != nil {
+				err = r.err
+				continue
+			}
+			for i, status := range r.statuses {
+				switch status {
+				case storagerpc.OK, storagerpc.KeyNotFound:
+				case storagerpc.WrongServer:
+					moved = append(moved, r.keys[i])
+				default:
+					err = fmt.Errorf("read of %s failed with status %s", r.keys[i], status)
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if len(moved) > 0 && !ls.awaitRing(ctx, version) {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return fmt.Errorf("read of %s failed with status %s", moved[0], storagerpc.WrongServer)
+		}
+		keys = moved
+	}
+	return nil
+}
+
+// retry performs op, which sends a request to a storage server and returns
+// the reply's status. A WrongServer status means that the ring has changed
+// (or is changing), so op is retried once a newer ring is available. If
+// resend is true, op is also retried (with backoff, until retryDeadline)
+// after it fails to reach a storage server that is not known to have failed,
+// once the ring is refreshed, or finds that every storage server it reads
+// from lags behind the caller's Session.
+// retry gives up once ctx is done, returning ctx's error.
+func (ls *libstore) retry(ctx context.Context, resend bool, op func() (storagerpc.Status, error)) error {
+	deadline := time.Now().Add(retryDeadline)
+	backoff := minRetryBackoff
+	for {
+		version := ls.ringVersion()
+		status, err := op()
+		if err != nil {
+			if !resend || !resendable(err) || ctx.Err() != nil || time.Now().Add(backoff).After(deadline) {
+				return err
+			}
+			if err := sleep(ctx, backoff); err != nil {
+				return err
+			}
+			if backoff *= 2; backoff > maxRetryBackoff {
+				backoff = maxRetryBackoff
+			}
+			ls.refreshRing(ctx)
+			continue
+		}
+		if status != storagerpc.WrongServer {
+			return nil
+		}
+		if !ls.awaitRing(ctx, version) {
+			return ctx.Err()
+		}
+	}
+}
+
+// staleError reports that the storage servers that could serve a read have
+// yet to apply a write recorded in the caller's Session.
+type staleError string
+
+func (e staleError) Error() string {
+	return string(e)
+}
+
+// unavailableError reports that a request could not be sent because the
+// storage servers that could serve it are known to have failed.
+type unavailableError string
+
+func (e unavailableError) Error() string {
+	return string(e)
+}
+
+// resendable reports whether a request that failed with err may be resent,
+// which is when the storage server did not reply but is not known to have
+// failed, or lags behind the caller's Session. Requests to failed servers
+// fail fast instead.
+func resendable(err error) bool {
+	switch err.(type) {
+	case rpc.ServerError, unavailableError:
+		return false
+	}
+	return true
+}
+
+// awaitRing polls the storage servers until the ring is newer than version,
+// returning false if it does not change within a short while or ctx is
+// done first.
+func (ls *libstore) awaitRing(ctx context.Context, version uint64) bool {
+	for i := 0; i < ringRefreshAttempts; i++ {
+		if _, err := ls.refreshRing(ctx); err == nil && ls.ringVersion() > version {
+			return true
+		}
+		if sleep(ctx, ringRefreshInterval) != nil {
+			return false
+		}
+	}
+	return false
+}
+
+// refreshRing fetches the ring from the first storage server that replies,
+// trying the seeds and then the nodes of the known ring. It returns false if
+// the ring is not ready.
+func (ls *libstore) refreshRing(ctx context.Context) (bool, error) {
+	var reply storagerpc.GetServersReply
+	var err error
+	for _, hostPort := range ls.candidates() {
+		reply = storagerpc.GetServersReply{}
+		if err = ls.call(ctx, hostPort, "StorageServer.GetServers", &storagerpc.GetServersArgs{}, &reply); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+	if reply.Status != storagerpc.OK {
+		return false, nil
+	}
+	sort.Slice(reply.Servers, func(i, j int) bool { return reply.Servers[i].NodeID < reply.Servers[j].NodeID })
+	ls.ringLock.Lock()
+	defer ls.ringLock.Unlock()
+	if ls.servers == nil || reply.Version > ls.version {
+		if ls.servers != nil {
+			select {
+			case ls.ringChanged <- struct{}{}:
+			default:
+			}
+		}
+		ls.servers = reply.Servers
+		ls.index = storagerpc.NewRing(reply.Servers, reply.ReplicationFactor)
+		ls.version = reply.Version
+	}
+	if reply.Version >= ls.version {
+		ls.liveness = reply.Liveness
+	}
+	return true, nil
+}
+
+// watchRing periodically refreshes the ring, so that the Libstore learns of
+// storage servers that have failed.
+func (ls *libstore) watchRing() {
+	for range time.Tick(ringRefreshPeriod) {
+		ctx, cancel := context.WithTimeout(context.Background(), ringRefreshPeriod)
+		ls.refreshRing(ctx)
+		cancel()
+	}
+}
+
+// livenessOf returns the liveness of the storage server at hostPort.
+func (ls *libstore) livenessOf(hostPort string) storagerpc.Liveness {
+	ls.ringLock.Lock()
+	defer ls.ringLock.Unlock()
+	return ls.liveness[hostPort]
+}
+
+// candidates returns the host:ports of the storage servers that may be asked
+// for the ring.
+func (ls *libstore) candidates() []string {
+	ls.ringLock.Lock()
+	defer ls.ringLock.Unlock()
+	hostPorts := append([]string(nil), ls.seeds...)
+	for _, n := range ls.servers {
+		hostPorts = append(hostPorts, n.HostPort)
+	}
+	return hostPorts
+}
+
+func (ls *libstore) ringVersion() uint64 {
+	ls.ringLock.Lock()
+	defer ls.ringLock.Unlock()
+	return ls.version
+}
+
+// route returns the storage server whose range contains key. Keys are
+// partitioned by the portion preceding the first colon, so that all of a
+// user's keys are stored on the same server.
+func (ls *libstore) route(key string) storagerpc.Node {
+	ls.ringLock.Lock()
+	defer ls.ringLock.Unlock()
+	return ls.index.Owner(StoreHash(strings.SplitN(key, ":", 2)[0]))
+}
+
+// replicaSet returns the host:ports of the storage servers that store key:
+// the primary of the key's range followed by its replicas.
+func (ls *libstore) replicaSet(key string) []string {
+	ls.ringLock.Lock()
+	defer ls.ringLock.Unlock()
+	return ls.index.ReplicaSet(StoreHash(strings.SplitN(key, ":", 2)[0]))
+}
+
+// call performs an RPC on the storage server at hostPort, over the least
+// busy of its connections. Connections that fail are discarded, so that a
+// later call redials the server. If ctx is done before the reply arrives,
+// call returns ctx's error, and reply may still be written to later.
+func (ls *libstore) call(ctx context.Context, hostPort, method string, args, reply interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	p := ls.pool(hostPort)
+	pc, err := p.get(ctx)
+	if err != nil {
+		return err
+	}
+	c := pc.cli.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-c.Done:
+		p.release(pc, c.Error)
+		return c.Error
+	case <-ctx.Done():
+		go func() {
+			<-c.Done
+			p.release(pc, c.Error)
+		}()
+		return ctx.Err()
+	}
+}
+
+// defaultContext returns a context that bounds the methods that do not
+// take one.
+func (ls *libstore) defaultContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), ls.timeout)
+}
+
+// sleep waits for d, or until ctx is done, in which case it returns ctx's
+// error.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// wantLease decides whether to request a lease for key. In Normal mode, the
+// Libstore's lease policy decides.
+func (ls *libstore) wantLease(key string) bool {
+	switch ls.mode {
+	case Never:
+		return false
+	case Always:
+		return true
+	}
+	return ls.policy.WantLease(key, time.Now())
+}
+
+// dedupe returns keys without duplicates.
+func dedupe(keys []string) []string {
+	seen := make(map[string]bool, len(keys))
+	var unique []string
+	for _, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, key)
+		}
+	}
+	return unique
+}
+
+// wantLeases decides, like wantLease, whether to request a lease for each
+// of keys.
+func (ls *libstore) wantLeases(keys []string) map[string]bool {
+	leases := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		leases[key] = ls.wantLease(key)
+	}
+	return leases
+}
+
+// multiGetArgs builds a batch of reads of keys, requesting leases as
+// decided by leases.
+func (ls *libstore) multiGetArgs(keys []string, leases map[string]bool) *storagerpc.MultiGetArgs {
+	args := &storagerpc.MultiGetArgs{Args: make([]storagerpc.GetArgs, len(keys))}
+	for i, key := range keys {
+		args.Args[i] = storagerpc.GetArgs{Key: key, WantLease: leases[key], HostPort: ls.myHostPort, WriteThrough: ls.writeThru}
+	}
+	return args
+}
+
+// cached returns key's cache entry, unless there is none, it has expired,
+// or it is older than minVersion.
+func (ls *libstore) cached(key string, minVersion uint64) (*cacheEntry, bool) {
+	ls.cacheLock.Lock()
+	defer ls.cacheLock.Unlock()
+	entry, ok := ls.cache[key]
+	if !ok || time.Now().After(entry.expiry) || entry.version < minVersion {
+		ls.stats.Misses++
+		return nil, false
+	}
+	ls.stats.Hits++
+	ls.lru.MoveToFront(entry.elem)
+	return entry, true
+}
+
+func (ls *libstore) CacheStats() CacheStats {
+	ls.cacheLock.Lock()
+	defer ls.cacheLock.Unlock()
+	stats := ls.stats
+	stats.Entries = len(ls.cache)
+	stats.Bytes = ls.cacheBytes
+	return stats
+}
+
+func (ls *libstore) revokeCount() uint64 {
+	ls.cacheLock.Lock()
+	defer ls.cacheLock.Unlock()
+	return ls.revokes
+}
+
+// cacheLease caches entry under lease, but no longer than ttl (if positive),
+// after which the key expires. The entry is discarded if a lease was revoked
+// since revokes was read, since the revocation may have been meant for this
+// (not yet cached) entry.
+func (ls *libstore) cacheLease(key string, entry *cacheEntry, lease storagerpc.Lease, ttl time.Duration, revokes uint64) {
+	ls.cacheLock.Lock()
+	defer ls.cacheLock.Unlock()
+	if ls.revokes != revokes {
+		return
+	}
+	valid := time.Duration(lease.ValidSeconds) * time.Second
+	if ttl > 0 && ttl < valid {
+		valid = ttl
+	}
+	entry.expiry = time.Now().Add(valid)
+	entry.size = len(key) + len(entry.value)
+	for _, item := range entry.list {
+		entry.size += len(item)
+	}
+	if ls.maxBytes > 0 && entry.size > ls.maxBytes {
+		return
+	}
+	if _, ok := ls.cache[key]; ok {
+		ls.uncacheLocked(key)
+	}
+	entry.elem = ls.lru.PushFront(key)
+	ls.cache[key] = entry
+	ls.cacheBytes += entry.size
+	if entry.rangeOf != "" {
+		if ls.ranges[entry.rangeOf] == nil {
+			ls.ranges[entry.rangeOf] = make(map[string]bool)
+		}
+		ls.ranges[entry.rangeOf][key] = true
+	}
+	for (ls.maxEntries > 0 && len(ls.cache) > ls.maxEntries) || (ls.maxBytes > 0 && ls.cacheBytes > ls.maxBytes) {
+		ls.uncacheLocked(ls.lru.Back().Value.(string))
+		ls.stats.Evictions++
+	}
+}
+
+// uncacheLocked discards key's cache entry, which must exist.
+func (ls *libstore) uncacheLocked(key string) {
+	entry := ls.cache[key]
+	ls.lru.Remove(entry.elem)
+	ls.cacheBytes -= entry.size
+	delete(ls.cache, key)
+	if entry.rangeOf != "" {
+		delete(ls.ranges[entry.rangeOf], key)
+		if len(ls.ranges[entry.rangeOf]) == 0 {
+			delete(ls.ranges, entry.rangeOf)
+		}
+	}
+}
+
+// uncacheRangesLocked discards the cached ranges and length of the list
+// key, reporting whether there were any.
+func (ls *libstore) uncacheRangesLocked(key string) bool {
+	found := false
+	for rangeKey := range ls.ranges[key] {
+		ls.uncacheLocked(rangeKey)
+		found = true
+	}
+	return found
+}
+
+// expireCache periodically discards expired cache entries.
+func (ls *libstore) expireCache() {
+	for range time.Tick(time.Second) {
+		ls.cacheLock.Lock()
+		now := time.Now()
+		for key, entry := range ls.cache {
+			if now.After(entry.expiry) {
+				ls.uncacheLocked(key)
+			}
+		}
+		ls.cacheLock.Unlock()
+	}
 }
@@ -0,0 +1,118 @@
+package libstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/cmu440/tribbler/rpc/storagerpc"
+)
+
+// Ranges and lengths of lists are cached under keys of their own, derived
+// from the list's key, and are indexed by the list's key so that they are
+// discarded along with the list when its lease is revoked or updated.
+
+// rangeKey returns the cache key of a range of the list key.
+func rangeKey(key string, offset, limit int, fromTail bool) string {
+	return fmt.Sprintf("%s\x00range/%d/%d/%t", key, offset, limit, fromTail)
+}
+
+// lengthKey returns the cache key of the length of the list key.
+func lengthKey(key string) string {
+	return key + "\x00length"
+}
+
+func (ls *libstore) GetListRange(key string, offset, limit int, fromTail bool) ([]string, error) {
+	ctx, cancel := ls.defaultContext()
+	defer cancel()
+	return ls.GetListRangeContext(ctx, key, offset, limit, fromTail)
+}
+
+func (ls *libstore) GetListRangeContext(ctx context.Context, key string, offset, limit int, fromTail bool) ([]string, error) {
+	if offset < 0 || limit < 0 {
+		return nil, errors.New("negative offset or limit")
+	}
+	cacheKey := rangeKey(key, offset, limit, fromTail)
+	session := sessionFrom(ctx)
+	if entry, ok := ls.cached(cacheKey, session.version(key)); ok {
+		return append([]string(nil), entry.list...), nil
+	}
+	revokes := ls.revokeCount()
+	args := &storagerpc.GetListRangeArgs{
+		Key:          key,
+		Offset:       offset,
+		Limit:        limit,
+		FromTail:     fromTail,
+		WantLease:    ls.wantLease(key),
+		HostPort:     ls.myHostPort,
+		WriteThrough: ls.writeThru,
+	}
+	var reply *storagerpc.GetListRangeReply
+	err := ls.retry(ctx, true, func() (storagerpc.Status, error) {
+		reply = new(storagerpc.GetListRangeReply)
+		err := ls.read(ctx, "StorageServer.GetListRange", key, args, reply, func() bool {
+			return !session.stale(key, reply.Status, reply.Version)
+		})
+		return reply.Status, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reply.Status != storagerpc.OK {
+		return nil, fmt.Errorf("GetListRange operation failed with status %s", reply.Status)
+	}
+	if reply.Lease.Granted {
+		entry := &cacheEntry{list: append([]string(nil), reply.Value...), version: reply.Version, rangeOf: key, length: reply.Length}
+		ls.cacheLease(cacheKey, entry, reply.Lease, reply.TTL, revokes)
+	}
+	return reply.Value, nil
+}
+
+func (ls *libstore) ListLength(key string) (int, error) {
+	ctx, cancel := ls.defaultContext()
+	defer cancel()
+	return ls.ListLengthContext(ctx, key)
+}
+
+func (ls *libstore) ListLengthContext(ctx context.Context, key string) (int, error) {
+	cacheKey := lengthKey(key)
+	session := sessionFrom(ctx)
+	if entry, ok := ls.cached(cacheKey, session.version(key)); ok {
+		return entry.length, nil
+	}
+	revokes := ls.revokeCount()
+	args := &storagerpc.GetArgs{Key: key, WantLease: ls.wantLease(key), HostPort: ls.myHostPort, WriteThrough: ls.writeThru}
+	var reply *storagerpc.ListLengthReply
+	err := ls.retry(ctx, true, func() (storagerpc.Status, error) {
+		reply = new(storagerpc.ListLengthReply)
+		err := ls.read(ctx, "StorageServer.ListLength", key, args, reply, func() bool {
+			return !session.stale(key, reply.Status, reply.Version)
+		})
+		return reply.Status, err
+	})
+	if err != nil {
+		return 0, err
+	}
+	if reply.Status != storagerpc.OK {
+		return 0, fmt.Errorf("ListLength operation failed with status %s", reply.Status)
+	}
+	if reply.Lease.Granted {
+		entry := &cacheEntry{version: reply.Version, rangeOf: key, length: reply.Length}
+		ls.cacheLease(cacheKey, entry, reply.Lease, reply.TTL, revokes)
+	}
+	return reply.Length, nil
+}
+
+func (ls *libstore) TrimList(key string, length int) error {
+	ctx, cancel := ls.defaultContext()
+	defer cancel()
+	return ls.TrimListContext(ctx, key, length)
+}
+
+func (ls *libstore) TrimListContext(ctx context.Context, key string, length int) error {
+	if length < 0 {
+		return errors.New("negative length")
+	}
+	args := &storagerpc.TrimListArgs{Key: key, Length: length, RequestID: ls.nextRequestID()}
+	return ls.sendWrite(ctx, "StorageServer.TrimList", "TrimList", key, args)
+}
@@ -0,0 +1,224 @@
+package libstore
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cmu440/tribbler/rpc/storagerpc"
+)
+
+// The Libstore keeps a pool of connections to each storage server, so that
+// concurrent calls are not queued behind one another on a single connection.
+// Connections are dialed lazily: a new one is dialed only when every open
+// connection is busy and the pool is not full. Connections that fail a call
+// are closed, and idle connections are checked periodically, so that broken
+// ones are replaced before a call has to fail on them.
+
+const (
+	defaultPoolSize   = 4                // Connections per storage server, by default.
+	healthCheckPeriod = 30 * time.Second // How often idle connections are checked.
+)
+
+// poolConn is a connection of a connPool.
+type poolConn struct {
+	cli      *rpc.Client
+	inFlight int  // Calls awaiting a reply.
+	used     bool // Whether a call was made since the last health check.
+}
+
+// connPool holds the connections to one storage server.
+type connPool struct {
+	hostPort string
+	size     int
+
+	lock    sync.Mutex
+	conns   []*poolConn
+	dialing int // Connections being dialed.
+	stats   ConnStats
+}
+
+func newConnPool(hostPort string, size int) *connPool {
+	return &connPool{hostPort: hostPort, size: size, stats: ConnStats{HostPort: hostPort}}
+}
+
+// get returns the pool's least busy connection, dialing a new one if that
+// is busy and the pool is not full. Should dialing fail, a busy connection
+// is returned if there is one. The caller must release the connection.
+func (p *connPool) get(ctx context.Context) (*poolConn, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	best := p.leastBusyLocked()
+	if best == nil || (best.inFlight > 0 && len(p.conns)+p.dialing < p.size) {
+		p.dialing++
+		p.lock.Unlock()
+		cli, err := dial(ctx, p.hostPort)
+		p.lock.Lock()
+		p.dialing--
+		if err == nil {
+			p.stats.Dials++
+			if len(p.conns) < p.size {
+				best = &poolConn{cli: cli}
+				p.conns = append(p.conns, best)
+			} else {
+				// Others filled the pool while this connection was dialed.
+				cli.Close()
+				best = p.leastBusyLocked()
+			}
+		} else if best = p.leastBusyLocked(); best == nil {
+			// No connection is left to fall back on: the one found
+			// before dialing, if any, was dropped meanwhile.
+			return nil, err
+		}
+	}
+	best.inFlight++
+	best.used = true
+	p.stats.Calls++
+	return best, nil
+}
+
+func (p *connPool) leastBusyLocked() *poolConn {
+	var best *poolConn
+	for _, pc := range p.conns {
+		if best == nil || pc.inFlight < best.inFlight {
+			best = pc
+		}
+	}
+	return best
+}
+
+// release returns a connection obtained from get once its call completes
+// with err. The connection is closed if the call failed to reach the server.
+func (p *connPool) release(pc *poolConn, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	pc.inFlight--
+	if _, ok := err.(rpc.ServerError); err != nil && !ok {
+		p.dropLocked(pc)
+	}
+}
+
+// dropLocked closes pc and removes it from the pool, unless it already was.
+func (p *connPool) dropLocked(pc *poolConn) {
+	for i, c := range p.conns {
+		if c == pc {
+			p.conns = append(p.conns[:i:i], p.conns[i+1:]...)
+			p.stats.Failures++
+			pc.cli.Close()
+			return
+		}
+	}
+}
+
+// check closes the idle connections that have not been used since the last
+// check and do not answer a GetServers call within timeout.
+func (p *connPool) check(timeout time.Duration) {
+	p.lock.Lock()
+	var idle []*poolConn
+	for _, pc := range p.conns {
+		if pc.inFlight == 0 && !pc.used {
+			idle = append(idle, pc)
+		}
+		pc.used = false
+	}
+	p.lock.Unlock()
+	for _, pc := range idle {
+		var reply storagerpc.GetServersReply
+		c := pc.cli.Go("StorageServer.GetServers", &storagerpc.GetServersArgs{}, &reply, make(chan *rpc.Call, 1))
+		var err error
+		select {
+		case <-c.Done:
+			err = c.Error
+		case <-time.After(timeout):
+			err = fmt.Errorf("health check of %s timed out", p.hostPort)
+		}
+		if _, ok := err.(rpc.ServerError); err != nil && !ok {
+			p.lock.Lock()
+			p.dropLocked(pc)
+			p.lock.Unlock()
+		}
+	}
+}
+
+func (p *connPool) connStats() ConnStats {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	stats := p.stats
+	stats.Conns = len(p.conns)
+	for _, pc := range p.conns {
+		stats.InFlight += pc.inFlight
+	}
+	return stats
+}
+
+// pool returns the connection pool of the storage server at hostPort.
+func (ls *libstore) pool(hostPort string) *connPool {
+	ls.poolsLock.Lock()
+	defer ls.poolsLock.Unlock()
+	p, ok := ls.pools[hostPort]
+	if !ok {
+		p = newConnPool(hostPort, ls.poolSize)
+		ls.pools[hostPort] = p
+	}
+	return p
+}
+
+func (ls *libstore) ConnStats() []ConnStats {
+	ls.poolsLock.Lock()
+	pools := make([]*connPool, 0, len(ls.pools))
+	for _, p := range ls.pools {
+		pools = append(pools, p)
+	}
+	ls.poolsLock.Unlock()
+	stats := make([]ConnStats, len(pools))
+	for i, p := range pools {
+		stats[i] = p.connStats()
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].HostPort < stats[j].HostPort })
+	return stats
+}
+
+// checkConns periodically checks the idle connections of every pool.
+func (ls *libstore) checkConns() {
+	for range time.Tick(healthCheckPeriod) {
+		ls.poolsLock.Lock()
+		pools := make([]*connPool, 0, len(ls.pools))
+		for _, p := range ls.pools {
+			pools = append(pools, p)
+		}
+		ls.poolsLock.Unlock()
+		for _, p := range pools {
+			p.check(ringRefreshPeriod)
+		}
+	}
+}
+
+// dial connects to the RPC server at hostPort over HTTP, as rpc.DialHTTP
+// does, but gives up once ctx is done.
+func dial(ctx context.Context, hostPort string) (*rpc.Client, error) {
+	conn, err := new(net.Dialer).DialContext(ctx, "tcp", hostPort)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	io.WriteString(conn, "CONNECT "+rpc.DefaultRPCPath+" HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status != "200 Connected to Go RPC" {
+		err = fmt.Errorf("unexpected HTTP response from %s: %s", hostPort, resp.Status)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return rpc.NewClient(conn), nil
+}
@@ -0,0 +1,160 @@
+package libstore
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cmu440/tribbler/rpc/storagerpc"
+)
+
+// A Session records the version of each key that a client has written, so
+// that the client's later reads see its writes, even when they are made
+// through a different Libstore whose cache holds an older version of a key.
+// A Session travels between Libstores (for instance, through the servers
+// that a client calls, which use the Libstores) as a token.
+//
+// The methods that take a context use the Session attached to it with
+// WithSession, if any: writes record the key's new version in the Session,
+// and reads skip cached values older than the version the Session records.
+// Leases normally keep cached values from outliving a write, but not in a
+// Libstore whose clock runs slow and thus holds leases past their expiry.
+// Replies from storage servers are checked too: a read that falls back to a
+// replica that has yet to apply one of the client's writes (while the key's
+// primary is unreachable) tries the key's other servers, and then tries
+// again until they catch up, rather than return an older value.
+//
+// A Session forgets writes once they are older than sessionTTL, by which
+// time any lease granted before the write has long expired, and keeps at
+// most maxSessionKeys keys, forgetting the oldest writes first, so that
+// its token stays small.
+type Session struct {
+	lock   sync.Mutex
+	writes map[string]sessionWrite
+}
+
+const (
+	sessionTTL     = 5 * time.Minute // How long a Session remembers a write.
+	maxSessionKeys = 100             // Most keys a Session remembers.
+)
+
+// sessionWrite is the last write to a key recorded in a Session.
+type sessionWrite struct {
+	Version uint64 `json:"v"`
+	Time    int64  `json:"t"` // When the write was recorded, in Unix seconds.
+}
+
+// NewSession returns a Session that records no writes.
+func NewSession() *Session {
+	return &Session{writes: make(map[string]sessionWrite)}
+}
+
+// ParseSession returns the Session encoded by token. The empty token
+// encodes a Session that records no writes.
+func ParseSession(token string) (*Session, error) {
+	s := NewSession()
+	if token == "" {
+		return s, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.writes); err != nil {
+		return nil, err
+	}
+	if s.writes == nil {
+		s.writes = make(map[string]sessionWrite)
+	}
+	s.compactLocked()
+	return s, nil
+}
+
+// Token encodes s for ParseSession.
+func (s *Session) Token() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.compactLocked()
+	if len(s.writes) == 0 {
+		return ""
+	}
+	b, _ := json.Marshal(s.writes)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// version returns the version of key last written in s, or zero.
+func (s *Session) version(key string) uint64 {
+	if s == nil {
+		return 0
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	w, ok := s.writes[key]
+	if !ok || time.Since(time.Unix(w.Time, 0)) > sessionTTL {
+		return 0
+	}
+	return w.Version
+}
+
+// stale reports whether a read of key answered with the given status and
+// version misses a write to key recorded in s. Storage servers report the
+// version at which a key they do not find was deleted, if they know it.
+func (s *Session) stale(key string, status storagerpc.Status, version uint64) bool {
+	switch status {
+	case storagerpc.OK, storagerpc.KeyNotFound:
+		return version < s.version(key)
+	}
+	return false
+}
+
+// wrote records that key was written with the given version.
+func (s *Session) wrote(key string, version uint64) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if version > s.writes[key].Version {
+		s.writes[key] = sessionWrite{Version: version, Time: time.Now().Unix()}
+	}
+	if len(s.writes) > maxSessionKeys {
+		s.compactLocked()
+	}
+}
+
+// compactLocked forgets the writes older than sessionTTL, and then the
+// oldest writes beyond maxSessionKeys.
+func (s *Session) compactLocked() {
+	horizon := time.Now().Add(-sessionTTL).Unix()
+	keys := make([]string, 0, len(s.writes))
+	for key, w := range s.writes {
+		if w.Time < horizon {
+			delete(s.writes, key)
+		} else {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) <= maxSessionKeys {
+		return
+	}
+	sort.Slice(keys, func(i, j int) bool { return s.writes[keys[i]].Time > s.writes[keys[j]].Time })
+	for _, key := range keys[maxSessionKeys:] {
+		delete(s.writes, key)
+	}
+}
+
+type sessionKey struct{}
+
+// WithSession returns a copy of ctx to which s is attached.
+func WithSession(ctx context.Context, s *Session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, s)
+}
+
+// sessionFrom returns the Session attached to ctx, or nil.
+func sessionFrom(ctx context.Context) *Session {
+	s, _ := ctx.Value(sessionKey{}).(*Session)
+	return s
+}
@@ -0,0 +1,142 @@
+package libstore
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/cmu440/tribbler/rpc/storagerpc"
+)
+
+// The storage servers keep watches in memory, and only the primary of a key
+// notifies of its writes, so the Libstore registers its watches again
+// periodically and whenever the ring changes.
+
+const watchRenewPeriod = 30 * time.Second // How often watches are registered again.
+
+// watch is a key or prefix watched by the Libstore.
+type watch struct {
+	key    string
+	prefix bool
+	fn     func(storagerpc.WatchEvent)
+}
+
+func (w *watch) matches(key string) bool {
+	if w.prefix {
+		return strings.HasPrefix(key, w.key)
+	}
+	return key == w.key
+}
+
+func (ls *libstore) Watch(key string, fn func(storagerpc.WatchEvent)) (func(), error) {
+	return ls.addWatch(&watch{key: key, fn: fn})
+}
+
+func (ls *libstore) WatchPrefix(prefix string, fn func(storagerpc.WatchEvent)) (func(), error) {
+	return ls.addWatch(&watch{key: prefix, prefix: true, fn: fn})
+}
+
+func (ls *libstore) addWatch(w *watch) (func(), error) {
+	if ls.mode == Never || ls.myHostPort == "" {
+		return nil, errors.New("Libstore does not receive callbacks")
+	}
+	ctx, cancel := ls.defaultContext()
+	defer cancel()
+	if err := ls.sendWatch(ctx, "StorageServer.Watch", w); err != nil {
+		return nil, err
+	}
+	ls.watchLock.Lock()
+	ls.watches[w] = true
+	ls.watchLock.Unlock()
+	return func() { ls.removeWatch(w) }, nil
+}
+
+func (ls *libstore) removeWatch(w *watch) {
+	ls.watchLock.Lock()
+	if !ls.watches[w] {
+		ls.watchLock.Unlock()
+		return
+	}
+	delete(ls.watches, w)
+	for other := range ls.watches {
+		if other.key == w.key && other.prefix == w.prefix {
+			// The storage servers keep a single watch for both.
+			ls.watchLock.Unlock()
+			return
+		}
+	}
+	ls.watchLock.Unlock()
+	ctx, cancel := ls.defaultContext()
+	defer cancel()
+	ls.sendWatch(ctx, "StorageServer.Unwatch", w)
+}
+
+// sendWatch sends a Watch or Unwatch request for w to the storage servers
+// that store the keys it watches: the primary of its key, or every server
+// for a prefix that may span several ranges.
+func (ls *libstore) sendWatch(ctx context.Context, method string, w *watch) error {
+	var hostPorts []string
+	if !w.prefix || strings.Contains(w.key, ":") {
+		// Keys are partitioned by the portion preceding the first colon.
+		hostPorts = []string{ls.route(w.key).HostPort}
+	} else {
+		ls.ringLock.Lock()
+		for _, node := range ls.servers {
+			hostPorts = append(hostPorts, node.HostPort)
+		}
+		ls.ringLock.Unlock()
+	}
+	args := &storagerpc.WatchArgs{Key: w.key, Prefix: w.prefix, HostPort: ls.myHostPort}
+	for _, hostPort := range hostPorts {
+		var reply storagerpc.WatchReply
+		if err := ls.call(ctx, hostPort, method, args, &reply); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renewWatches registers the Libstore's watches again periodically, and
+// whenever the ring changes.
+func (ls *libstore) renewWatches() {
+	ticker := time.NewTicker(watchRenewPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ls.ringChanged:
+		}
+		ls.watchLock.Lock()
+		var watches []*watch
+		for w := range ls.watches {
+			watches = append(watches, w)
+		}
+		ls.watchLock.Unlock()
+		ctx, cancel := ls.defaultContext()
+		for _, w := range watches {
+			ls.sendWatch(ctx, "StorageServer.Watch", w)
+		}
+		cancel()
+	}
+}
+
+func (ls *libstore) KeyChanged(args *storagerpc.KeyChangedArgs, reply *storagerpc.KeyChangedReply) error {
+	ls.watchLock.Lock()
+	var watches []*watch
+	for w := range ls.watches {
+		watches = append(watches, w)
+	}
+	ls.watchLock.Unlock()
+	ls.dispatchLock.Lock()
+	defer ls.dispatchLock.Unlock()
+	for _, event := range args.Events {
+		for _, w := range watches {
+			if w.matches(event.Key) {
+				w.fn(event)
+			}
+		}
+	}
+	reply.Status = storagerpc.OK
+	return nil
+}
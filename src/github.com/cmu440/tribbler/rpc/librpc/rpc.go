@@ -8,6 +8,8 @@ import "github.com/cmu440/tribbler/rpc/storagerpc"
 // STAFF USE ONLY! Students should not use this interface in their code.
 type RemoteLeaseCallbacks interface {
 	RevokeLease(*storagerpc.RevokeLeaseArgs, *storagerpc.RevokeLeaseReply) error
+	KeyChanged(*storagerpc.KeyChangedArgs, *storagerpc.KeyChangedReply) error
+	UpdateLease(*storagerpc.UpdateLeaseArgs, *storagerpc.UpdateLeaseReply) error
 }
 
 type LeaseCallbacks struct {
@@ -3,23 +3,81 @@
 
 package storagerpc
 
+import "time"
+
 // Status represents the status of a RPC's reply.
 type Status int
 
 const (
-	OK           Status = iota + 1 // The RPC was a success.
-	KeyNotFound                    // The specified key does not exist.
-	ItemNotFound                   // The specified item does not exist.
-	WrongServer                    // The specified key does not fall in the server's hash range.
-	ItemExists                     // The item already exists in the list.
-	NotReady                       // The storage servers are still getting ready.
+	OK                 Status = iota + 1 // The RPC was a success.
+	KeyNotFound                          // The specified key does not exist.
+	ItemNotFound                         // The specified item does not exist.
+	WrongServer                          // The specified key does not fall in the server's hash range.
+	ItemExists                           // The item already exists in the list.
+	NotReady                             // The storage servers are still getting ready.
+	PreconditionFailed                   // The key's current value does not match the expected value.
+	Locked                               // The key is locked by another transaction.
 )
 
+var statusNames = map[Status]string{
+	OK:           "OK",
+	KeyNotFound:  "KeyNotFound",
+	ItemNotFound: "ItemNotFound",
+	WrongServer:  "WrongServer",
+	ItemExists:   "ItemExists",
+	NotReady:     "NotReady",
+
+	PreconditionFailed: "PreconditionFailed",
+	Locked:             "Locked",
+}
+
+func (s Status) String() string {
+	if name, ok := statusNames[s]; ok {
+		return name
+	}
+	return "Unknown"
+}
+
+// Op identifies a modification that a primary forwards to its replicas.
+type Op int
+
+const (
+	OpPut            Op = iota + 1 // Set the key's value.
+	OpAppendToList                 // Append an item to the key's list.
+	OpRemoveFromList               // Remove an item from the key's list.
+	OpDelete                       // Delete the key's value and list.
+	OpTrimList                     // Trim the key's list to its last items, whose number is Value.
+)
+
+// Liveness describes whether a storage server is answering the heartbeats
+// of the ring's leader.
+type Liveness int
+
+const (
+	Alive   Liveness = iota // The node answered its latest heartbeats.
+	Suspect                 // The node missed a few heartbeats in a row.
+	Dead                    // The node missed many heartbeats in a row, so requests to it are likely to fail or hang.
+)
+
+var livenessNames = map[Liveness]string{
+	Alive:   "Alive",
+	Suspect: "Suspect",
+	Dead:    "Dead",
+}
+
+func (l Liveness) String() string {
+	if name, ok := livenessNames[l]; ok {
+		return name
+	}
+	return "Unknown"
+}
+
 // Lease constants.
 const (
 	QueryCacheSeconds = 10 // Time period used for tracking queries/determining whether to request leases.
 	QueryCacheThresh  = 3  // If QueryCacheThresh queries in last QueryCacheSeconds, then request a lease.
 	LeaseSeconds      = 10 // Number of seconds a lease should remain valid.
+	MaxLeaseSeconds   = 15 // Number of seconds a lease on a key that is read often but rarely written may remain valid, by default.
 	LeaseGuardSeconds = 2  // Additional seconds a server should wait before invalidating a lease.
 )
 
@@ -30,8 +88,9 @@ type Lease struct {
 }
 
 type Node struct {
-	HostPort string // The host:port address of the storage server node.
-	NodeID   uint32 // The ID identifying this storage server node.
+	HostPort   string   // The host:port address of the storage server node.
+	NodeID     uint32   // The ID identifying this storage server node.
+	VirtualIDs []uint32 // Additional points of the ring owned by this node (its virtual nodes).
 }
 
 type RegisterArgs struct {
@@ -39,8 +98,20 @@ type RegisterArgs struct {
 }
 
 type RegisterReply struct {
-	Status  Status
-	Servers []Node
+	Status            Status
+	Servers           []Node
+	Version           uint64 // Increases every time a node joins or leaves the ring.
+	Leader            string // The host:port of the node coordinating the ring's membership.
+	ReplicationFactor int
+}
+
+type UnregisterArgs struct {
+	ServerInfo Node
+	Failed     bool // Whether the server failed, so that its range is handed off by its replicas.
+}
+
+type UnregisterReply struct {
+	Status Status
 }
 
 type GetServersArgs struct {
@@ -48,37 +119,231 @@ type GetServersArgs struct {
 }
 
 type GetServersReply struct {
-	Status  Status
-	Servers []Node
+	Status            Status
+	Servers           []Node
+	Version           uint64              // Increases every time a node joins or leaves the ring.
+	Liveness          map[string]Liveness // Liveness of each node by host:port, as seen by the leader.
+	ReplicationFactor int                 // The number of nodes that store each range of the ring.
 }
 
 type GetArgs struct {
 	Key       string
 	WantLease bool
 	HostPort  string // The Libstore's callback host:port.
+
+	// If set, writes to the key are pushed to the Libstore (through its
+	// UpdateLease callback) rather than revoking the lease it is granted.
+	WriteThrough bool
 }
 
+// A reply to a read of a key that is not found (status KeyNotFound) carries
+// the version at which the key was deleted, or zero if the node does not
+// know it.
 type GetReply struct {
-	Status Status
-	Value  string
-	Lease  Lease
+	Status  Status
+	Value   string
+	Lease   Lease
+	Version uint64        // The key's version, which increases with every write to the key.
+	TTL     time.Duration // Time left until the key expires, or zero if it never does.
 }
 
 type GetListReply struct {
+	Status  Status
+	Value   []string
+	Lease   Lease
+	Version uint64        // The key's version, which increases with every write to the key.
+	TTL     time.Duration // Time left until the key expires, or zero if it never does.
+}
+
+// MultiGetArgs batches several Gets (or GetLists) sent to the same node.
+type MultiGetArgs struct {
+	Args []GetArgs
+}
+
+type MultiGetReply struct {
+	Status  Status
+	Replies []GetReply // The reply to each of Args, in order.
+}
+
+type MultiGetListReply struct {
+	Status  Status
+	Replies []GetListReply // The reply to each of Args, in order.
+}
+
+type ScanArgs struct {
+	Prefix string
+	NodeID uint32 // The node whose range is scanned.
+	Cursor string // Only keys after Cursor are returned.
+	Limit  int    // The maximum number of keys to return, or zero for no limit.
+}
+
+type ScanReply struct {
 	Status Status
-	Value  []string
-	Lease  Lease
+	Keys   []string // In increasing order.
+	Cursor string   // The cursor from which to fetch the next page, or empty if there is none.
+}
+
+// GetListRangeArgs select a range of a list: up to Limit items (all of them
+// if Limit is zero) starting Offset items from the list's head, or, if
+// FromTail is set, ending Offset items before its tail. Either way, the
+// items are returned in the list's order.
+type GetListRangeArgs struct {
+	Key          string
+	Offset       int
+	Limit        int
+	FromTail     bool
+	WantLease    bool
+	HostPort     string // The Libstore's callback host:port.
+	WriteThrough bool   // As in GetArgs.
+}
+
+type GetListRangeReply struct {
+	Status  Status
+	Value   []string
+	Length  int // The length of the whole list.
+	Lease   Lease
+	Version uint64        // The key's version, which increases with every write to the key.
+	TTL     time.Duration // Time left until the key expires, or zero if it never does.
+}
+
+type ListLengthReply struct {
+	Status  Status
+	Length  int
+	Lease   Lease
+	Version uint64        // The key's version, which increases with every write to the key.
+	TTL     time.Duration // Time left until the key expires, or zero if it never does.
+}
+
+type TrimListArgs struct {
+	Key       string
+	Length    int    // The number of items to keep, from the list's tail.
+	RequestID string // As in PutArgs.
 }
 
 type PutArgs struct {
+	Key     string
+	Value   string
+	Version uint64        // If non-zero, the write is made only if the key's version equals Version.
+	TTL     time.Duration // If positive, the key expires this long after the write.
+
+	// If non-empty, identifies the write so that it can be resent safely:
+	// a primary that has already made a write with the same RequestID
+	// replies as it did then, without making it again.
+	RequestID string
+}
+
+type PutReply struct {
+	Status  Status
+	Version uint64 // The key's version after the write, or its current version if the precondition failed.
+}
+
+type CompareAndSwapArgs struct {
+	Key      string
+	OldValue string // The value the key is expected to have.
+	NewValue string
+}
+
+type CompareAndSwapReply struct {
+	Status  Status
+	Value   string // The key's current value, if the precondition failed.
+	Version uint64 // The key's version after the swap, or its current version if the precondition failed.
+}
+
+type ReplicateArgs struct {
+	Op      Op
+	Key     string
+	Value   string
+	Version uint64 // The key's version after the modification.
+	Expires int64  // When the key expires, in Unix nanoseconds, or zero if it never does.
+
+	// If non-empty, the RequestID of the client's write, whose reply the
+	// replica remembers as the primary does.
+	RequestID string
+	Reply     PutReply
+}
+
+type ReplicateReply struct {
+	Status Status
+}
+
+type RingArgs struct {
+	Version           uint64
+	Servers           []Node
+	Leader            string // The host:port of the node coordinating the change.
+	ReplicationFactor int
+	Failed            []string // The host:ports of failed nodes being removed from the ring.
+}
+
+type RingReply struct {
+	Status Status
+}
+
+type HeartbeatArgs struct {
+	Leader   string              // The host:port of the ring's leader.
+	Version  uint64              // The version of the leader's ring.
+	Liveness map[string]Liveness // Liveness of each node by host:port.
+}
+
+type HeartbeatReply struct {
+	Status  Status
+	Leader  string // The receiver's leader, if it rejected the heartbeat.
+	Version uint64 // The version of the receiver's ring, if it rejected the heartbeat.
+}
+
+type ElectArgs struct {
+	Failed string // The host:port of the failed leader.
+}
+
+type ElectReply struct {
+	Status Status
+}
+
+type TransferArgs struct {
+	Values   map[string]string
+	Lists    map[string][]string
+	Versions map[string]uint64
+	Expires  map[string]int64
+	Requests map[string]RequestReply // Remembered replies to recent writes to the keys, by request ID.
+}
+
+// RequestReply is the reply to a write carrying a request ID.
+type RequestReply struct {
+	Key   string
+	Reply PutReply
+}
+
+type TransferReply struct {
+	Status Status
+}
+
+// TxOp is a single write of a transaction: a Put, AppendToList or
+// RemoveFromList of Key with Value.
+type TxOp struct {
+	Op    Op
 	Key   string
 	Value string
 }
 
-type PutReply struct {
+type TransactArgs struct {
+	Ops []TxOp
+}
+
+type TransactReply struct {
 	Status Status
 }
 
+type TxArgs struct {
+	TxID         string
+	Coordinator  string   // The host:port of the transaction's coordinator (PrepareTx, and TxStatus when asking another participant).
+	Participants []string // The host:ports of the transaction's participants (PrepareTx only).
+	Ops          []TxOp   // The writes to this node's keys (PrepareTx only).
+}
+
+type TxReply struct {
+	Status    Status
+	Committed bool // Whether the transaction committed (TxStatus only).
+}
+
 type RevokeLeaseArgs struct {
 	Key string
 }
@@ -86,3 +351,94 @@ type RevokeLeaseArgs struct {
 type RevokeLeaseReply struct {
 	Status Status
 }
+
+// UpdateLeaseArgs describe a write to a key on which the Libstore holds a
+// write-through lease. Op is OpPut if Value is the key's new value, and
+// OpAppendToList or OpRemoveFromList if Value is the item appended to or
+// removed from the key's list. Version is the key's version after the write,
+// and TTL the time left until the key expires (zero if it never does).
+type UpdateLeaseArgs struct {
+	Key     string
+	Op      Op
+	Value   string
+	Version uint64
+	TTL     time.Duration
+}
+
+type UpdateLeaseReply struct {
+	Status Status
+}
+
+type GetLeasesArgs struct {
+	Key string // If non-empty, only the leases on Key are listed.
+}
+
+// LeaseHolder describes an outstanding lease held by a single Libstore.
+type LeaseHolder struct {
+	HostPort string    // The Libstore's callback host:port.
+	Granted  time.Time // When the lease was (last) granted.
+	Expires  time.Time // When the lease expires, including the guard period.
+
+	WriteThrough bool // Whether writes are pushed to the holder rather than revoking the lease.
+}
+
+// KeyLeases lists the outstanding leases on a single key.
+type KeyLeases struct {
+	Key      string
+	Holders  []LeaseHolder
+	Revoking bool // Whether a write is waiting for the key's leases to be revoked.
+}
+
+// LeaseStats counts a storage server's lease events since it started.
+type LeaseStats struct {
+	Grants             uint64 // Leases granted.
+	Revocations        uint64 // Revocations acknowledged by the lease's holder.
+	RevocationTimeouts uint64 // Revocations given up on because the lease expired first.
+	BlockedWrites      uint64 // Writes that waited for outstanding leases to be revoked.
+	Denials            uint64 // Leases denied to Libstores whose revocations keep timing out.
+	Updates            uint64 // Writes applied by the holders of write-through leases.
+}
+
+// SlowHolder describes a Libstore whose latest lease revocations timed out.
+type SlowHolder struct {
+	HostPort    string    // The Libstore's callback host:port.
+	Timeouts    int       // Number of revocations in a row that timed out.
+	DeniedUntil time.Time // Leases are denied to the Libstore until then (zero if they are not).
+}
+
+type GetLeasesReply struct {
+	Status      Status
+	Leases      []KeyLeases // Sorted by key.
+	Stats       LeaseStats
+	SlowHolders []SlowHolder // Sorted by host:port.
+}
+
+type WatchArgs struct {
+	Key      string // The key watched, or the prefix of the keys watched if Prefix is set.
+	Prefix   bool
+	HostPort string // The watching Libstore's callback host:port.
+}
+
+type WatchReply struct {
+	Status Status
+}
+
+// WatchEvent describes a write to a watched key. Op is OpPut if Value is the
+// key's new value, OpAppendToList or OpRemoveFromList if Value is the item
+// appended to or removed from the key's list, OpTrimList if Value is the
+// number of items the key's list was trimmed to, and OpDelete if the key
+// expired. Version is the key's version after the write (zero if deleted).
+type WatchEvent struct {
+	Key     string
+	Op      Op
+	Value   string
+	Version uint64
+}
+
+type KeyChangedArgs struct {
+	Events []WatchEvent // In the order of the writes.
+}
+
+type KeyChangedReply struct {
+	Status Status
+}
@@ -0,0 +1,100 @@
+package storagerpc
+
+import "sort"
+
+// Ring indexes the points of the consistent hashing ring owned by a set of
+// nodes. Each node owns one or more points of the ring (its NodeID and its
+// VirtualIDs), and is responsible for the hashes between the preceding point
+// (exclusive) and each of its own points (inclusive), wrapping around the
+// ring. The range ending at a point is replicated on the nodes owning the
+// points that follow it, skipping points of nodes already chosen, so that
+// each range is stored by factor distinct nodes (or by every node, if there
+// are fewer).
+type Ring struct {
+	servers []Node
+	points  []point // Sorted by ID.
+	factor  int
+}
+
+// point is a point of the ring, owned by the node servers[node].
+type point struct {
+	id   uint32
+	node int
+}
+
+// NewRing indexes the ring made up of servers, each of whose ranges is stored
+// by factor nodes. Values of factor less than 1 disable replication.
+func NewRing(servers []Node, factor int) *Ring {
+	r := &Ring{servers: servers, factor: factor}
+	if r.factor < 1 {
+		r.factor = 1
+	}
+	if r.factor > len(servers) {
+		r.factor = len(servers)
+	}
+	for i, n := range servers {
+		r.points = append(r.points, point{n.NodeID, i})
+		for _, id := range n.VirtualIDs {
+			r.points = append(r.points, point{id, i})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i].id < r.points[j].id })
+	return r
+}
+
+// search returns the index of the point whose range contains hash.
+func (r *Ring) search(hash uint32) int {
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].id >= hash })
+	if i == len(r.points) {
+		i = 0
+	}
+	return i
+}
+
+// Owner returns the node whose range contains hash.
+func (r *Ring) Owner(hash uint32) Node {
+	return r.servers[r.points[r.search(hash)].node]
+}
+
+// ReplicaSet returns the host:ports of the nodes that store hash: the owner
+// of the range containing it, followed by the range's replicas in failover
+// order.
+func (r *Ring) ReplicaSet(hash uint32) []string {
+	return r.replicaSet(r.search(hash))
+}
+
+// ReplicaSets returns the replica set (as returned by ReplicaSet) of each of
+// the ranges owned by the node with the given ID.
+func (r *Ring) ReplicaSets(nodeID uint32) [][]string {
+	var sets [][]string
+	for i, p := range r.points {
+		if r.servers[p.node].NodeID == nodeID {
+			sets = append(sets, r.replicaSet(i))
+		}
+	}
+	return sets
+}
+
+// replicaSet returns the host:ports of the nodes that store the range ending
+// at r.points[start].
+func (r *Ring) replicaSet(start int) []string {
+	set := make([]string, 0, r.factor)
+	chosen := make([]int, 0, r.factor)
+	for i := start; len(set) < r.factor; i = (i + 1) % len(r.points) {
+		node := r.points[i].node
+		if !containsInt(chosen, node) {
+			chosen = append(chosen, node)
+			set = append(set, r.servers[node].HostPort)
+		}
+	}
+	return set
+}
+
+func containsInt(list []int, n int) bool {
+	for _, v := range list {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
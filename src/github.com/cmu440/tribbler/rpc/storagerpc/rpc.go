@@ -6,12 +6,34 @@ package storagerpc
 // STAFF USE ONLY! Students should not use this interface in their code.
 type RemoteStorageServer interface {
 	RegisterServer(*RegisterArgs, *RegisterReply) error
+	UnregisterServer(*UnregisterArgs, *UnregisterReply) error
 	GetServers(*GetServersArgs, *GetServersReply) error
 	Get(*GetArgs, *GetReply) error
 	GetList(*GetArgs, *GetListReply) error
+	GetListRange(*GetListRangeArgs, *GetListRangeReply) error
+	ListLength(*GetArgs, *ListLengthReply) error
+	MultiGet(*MultiGetArgs, *MultiGetReply) error
+	MultiGetList(*MultiGetArgs, *MultiGetListReply) error
+	ScanPrefix(*ScanArgs, *ScanReply) error
 	Put(*PutArgs, *PutReply) error
 	AppendToList(*PutArgs, *PutReply) error
 	RemoveFromList(*PutArgs, *PutReply) error
+	TrimList(*TrimListArgs, *PutReply) error
+	CompareAndSwap(*CompareAndSwapArgs, *CompareAndSwapReply) error
+	Replicate(*ReplicateArgs, *ReplicateReply) error
+	PrepareRing(*RingArgs, *RingReply) error
+	CommitRing(*RingArgs, *RingReply) error
+	TransferKeys(*TransferArgs, *TransferReply) error
+	Heartbeat(*HeartbeatArgs, *HeartbeatReply) error
+	Elect(*ElectArgs, *ElectReply) error
+	Transact(*TransactArgs, *TransactReply) error
+	PrepareTx(*TxArgs, *TxReply) error
+	CommitTx(*TxArgs, *TxReply) error
+	AbortTx(*TxArgs, *TxReply) error
+	TxStatus(*TxArgs, *TxReply) error
+	GetLeases(*GetLeasesArgs, *GetLeasesReply) error
+	Watch(*WatchArgs, *WatchReply) error
+	Unwatch(*WatchArgs, *WatchReply) error
 }
 
 type StorageServer struct {
@@ -15,6 +15,11 @@ const (
 	Exists                             // The specified UserID or TargerUserID already exists.
 )
 
+// Every call carries a session token, and the reply to each write returns
+// the token updated with the write. A client that passes the latest token it
+// was given on its later calls, to any TribServer, reads its own writes. The
+// empty token is valid, and libstore.ParseSession decodes a token.
+
 // Tribble stores the contents and information identifying a unique
 // tribble message.
 type Tribble struct {
@@ -24,33 +29,40 @@ type Tribble struct {
 }
 
 type CreateUserArgs struct {
-	UserID string
+	UserID  string
+	Session string
 }
 
 type CreateUserReply struct {
-	Status Status
+	Status  Status
+	Session string
 }
 
 type SubscriptionArgs struct {
 	UserID       string // The subscribing user.
 	TargetUserID string // The user being subscribed to.
+	Session      string
 }
 
 type SubscriptionReply struct {
-	Status Status
+	Status  Status
+	Session string
 }
 
 type PostTribbleArgs struct {
 	UserID   string
 	Contents string
+	Session  string
 }
 
 type PostTribbleReply struct {
-	Status Status
+	Status  Status
+	Session string
 }
 
 type GetSubscriptionsArgs struct {
-	UserID string
+	UserID  string
+	Session string
 }
 
 type GetSubscriptionsReply struct {
@@ -59,7 +71,8 @@ type GetSubscriptionsReply struct {
 }
 
 type GetTribblesArgs struct {
-	UserID string
+	UserID  string
+	Session string
 }
 
 type GetTribblesReply struct {
@@ -40,6 +40,9 @@ func init() {
 		fmt.Fprintln(os.Stderr, "  GetList:        lg key")
 		fmt.Fprintln(os.Stderr, "  AddToList:      la key value")
 		fmt.Fprintln(os.Stderr, "  RemoveFromList: lr key value")
+		fmt.Fprintln(os.Stderr, "  MultiGet:       mg key [key ...]")
+		fmt.Fprintln(os.Stderr, "  ScanPrefix:     sp prefix")
+		fmt.Fprintln(os.Stderr, "  Transaction:    tx op key value [op key value ...]  (op is p, la or lr)")
 	}
 }
 
@@ -54,6 +57,9 @@ var cmdList = map[string]int{
 	"la": 2,
 	"lr": 2,
 	"lg": 1,
+	"mg": 1,
+	"sp": 1,
+	"tx": 3,
 }
 
 func main() {
@@ -128,6 +134,51 @@ func main() {
 					fmt.Println(i)
 				}
 			}
+		case "mg":
+			vals, err := ls.MultiGet(flag.Args()[1:])
+			if err != nil {
+				fmt.Println("ERROR:", err)
+			} else {
+				for _, key := range flag.Args()[1:] {
+					if val, ok := vals[key]; ok {
+						fmt.Println(key, val)
+					}
+				}
+			}
+		case "sp":
+			keys, err := ls.ScanPrefix(flag.Arg(1))
+			if err != nil {
+				fmt.Println("ERROR:", err)
+			} else {
+				for _, key := range keys {
+					fmt.Println(key)
+				}
+			}
+		case "tx":
+			args := flag.Args()[1:]
+			if len(args)%3 != 0 {
+				flag.Usage()
+				os.Exit(1)
+			}
+			tx := ls.Begin()
+			for j := 0; j < len(args); j += 3 {
+				switch args[j] {
+				case "p":
+					tx.Put(args[j+1], args[j+2])
+				case "la":
+					tx.AppendToList(args[j+1], args[j+2])
+				case "lr":
+					tx.RemoveFromList(args[j+1], args[j+2])
+				default:
+					flag.Usage()
+					os.Exit(1)
+				}
+			}
+			if err := tx.Commit(); err == nil {
+				fmt.Println("OK")
+			} else {
+				fmt.Println("ERROR:", err)
+			}
 		case "p", "la", "lr":
 			var err error
 			switch cmd {
@@ -4,12 +4,18 @@ package main
 
 import (
 	crand "crypto/rand"
+	"encoding/json"
 	"flag"
 	"log"
 	"math"
 	"math/big"
 	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/cmu440/tribbler/rpc/storagerpc"
 	"github.com/cmu440/tribbler/storageserver"
 )
 
@@ -20,6 +26,14 @@ var (
 	masterHostPort = flag.String("master", "", "master storage server host port (if non-empty then this storage server is a slave)")
 	numNodes       = flag.Int("N", 1, "the number of nodes in the ring (including the master)")
 	nodeID         = flag.Uint("id", 0, "a 32-bit unsigned node ID to use for consistent hashing")
+	dataDir        = flag.String("data", "", "directory in which to persist data (if empty then data is kept only in memory)")
+	replicas       = flag.Int("replicas", 1, "(master only) the number of nodes that store each key, including the key's primary")
+	suspectAfter   = flag.Int("suspect", 2, "the number of heartbeats a node must miss in a row to be suspected of failure")
+	deadAfter      = flag.Int("dead", 5, "the number of heartbeats a node must miss in a row to be considered dead")
+	virtualNodes   = flag.Int("vnodes", 1, "the number of points of the consistent hashing ring owned by this node")
+	engine         = flag.String("engine", "memory", "how to store data: 'memory' keeps it in memory, 'log' in an append-only file (in the data directory, if any)")
+	maxLease       = flag.Int("maxlease", storagerpc.MaxLeaseSeconds, "the most seconds a lease remains valid")
+	leaseAddr      = flag.String("leasehttp", "", "address on which to serve the server's leases and lease counters as JSON over HTTP (if empty then they are not served)")
 )
 
 func init() {
@@ -42,11 +56,47 @@ func main() {
 	}
 
 	// Create and start the StorageServer.
-	_, err := storageserver.NewStorageServer(*masterHostPort, *numNodes, *port, randID)
+	opts := storageserver.Options{
+		DataDir:           *dataDir,
+		ReplicationFactor: *replicas,
+		SuspectAfter:      *suspectAfter,
+		DeadAfter:         *deadAfter,
+		VirtualNodes:      *virtualNodes,
+		Engine:            storageserver.Engine(*engine),
+		MaxLeaseSeconds:   *maxLease,
+	}
+	server, err := storageserver.NewStorageServerWithOptions(*masterHostPort, *numNodes, *port, randID, opts)
 	if err != nil {
 		log.Fatalln("Failed to create storage server:", err)
 	}
+	if *leaseAddr != "" {
+		go serveLeases(server, *leaseAddr)
+	}
+
+	// Run the storage server until interrupted, then leave the ring
+	// gracefully (slaves only).
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	if err := server.Leave(); err != nil {
+		log.Println("Failed to leave the ring:", err)
+	}
+	os.Exit(0)
+}
 
-	// Run the storage server forever.
-	select {}
+// serveLeases serves the server's leases as JSON at addr. The optional "key"
+// query parameter restricts the listing to a single key.
+func serveLeases(server storageserver.StorageServer, addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/leases", func(w http.ResponseWriter, r *http.Request) {
+		args := &storagerpc.GetLeasesArgs{Key: r.URL.Query().Get("key")}
+		var reply storagerpc.GetLeasesReply
+		if err := server.GetLeases(args, &reply); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&reply)
+	})
+	log.Println("Failed to serve leases:", http.ListenAndServe(addr, mux))
 }
@@ -0,0 +1,105 @@
+package storageserver
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cmu440/tribbler/rpc/storagerpc"
+)
+
+// A Libstore that loses the reply to a write cannot tell whether the write
+// was made, so it resends the write under the same request ID. The primary
+// remembers its reply to each write carrying a request ID for a while, and
+// answers a resent write with the original reply rather than making it
+// again. The primary sends the request ID and reply along with the write to
+// the key's replicas, which remember the reply too, and the replies to writes
+// to the keys handed off in a ring change are handed off with them, so that a
+// write resent to the key's new primary is not made again either. Replies are
+// kept in memory only, so a write resent after every replica of its key has
+// restarted is made again.
+//
+// A write that some replicas failed to apply is remembered along with those
+// replicas, and answered with status WrongServer until none of them remains
+// in the key's replica set, so that the client resends it until the ring has
+// changed.
+
+const requestTTL = time.Minute // How long the reply to a write is remembered.
+
+// doneRequest is the remembered reply to a write.
+type doneRequest struct {
+	reply   storagerpc.PutReply
+	key     string
+	failed  []string // Replicas that failed to apply the write, by host:port.
+	expires time.Time
+}
+
+// replayRequest stores in reply the remembered reply to the write with the
+// given request ID, if there is one, answering with status WrongServer while
+// a replica that failed to apply the write remains in the key's replica set.
+// The caller must hold the write's key lock, so that the original write has
+// completed.
+func (ss *storageServer) replayRequest(requestID string, reply *storagerpc.PutReply) bool {
+	if requestID == "" {
+		return false
+	}
+	ss.dataLock.Lock()
+	done, ok := ss.requests[requestID]
+	ss.dataLock.Unlock()
+	if !ok || time.Now().After(done.expires) {
+		return false
+	}
+	*reply = done.reply
+	if len(done.failed) > 0 {
+		replicas := ss.replicasOf(done.key)
+		for _, hostPort := range done.failed {
+			if containsString(replicas, hostPort) {
+				ss.evict(done.failed)
+				reply.Status = storagerpc.WrongServer
+				break
+			}
+		}
+	}
+	return true
+}
+
+// settleRequest returns the result of the write with the given request ID,
+// whose handler returned err, remembering its reply unless err is set. If
+// the write's own record was made but some replicas failed to apply it, the
+// reply is remembered along with those replicas and the write is answered
+// with status WrongServer; without a request ID, it fails instead.
+func (ss *storageServer) settleRequest(requestID, key string, reply *storagerpc.PutReply, err error) error {
+	var replicaErr *replicaError
+	if err == nil {
+		ss.rememberRequest(requestID, key, reply, nil)
+	} else if requestID != "" && errors.As(err, &replicaErr) {
+		// An expired copy of the key deleted before the write carries no
+		// version: the write itself was not made.
+		if replicaErr.key == key && replicaErr.version != 0 {
+			ss.rememberRequest(requestID, key, reply, replicaErr.failed)
+		}
+		reply.Status = storagerpc.WrongServer
+		return nil
+	}
+	return err
+}
+
+// rememberRequest remembers reply as the reply to the write to key with the
+// given request ID, which the replicas in failed did not apply, and forgets
+// the replies that have been kept long enough.
+func (ss *storageServer) rememberRequest(requestID, key string, reply *storagerpc.PutReply, failed []string) {
+	if requestID == "" {
+		return
+	}
+	ss.dataLock.Lock()
+	defer ss.dataLock.Unlock()
+	now := time.Now()
+	if now.Sub(ss.requestsSwept) > requestTTL {
+		for id, done := range ss.requests {
+			if now.After(done.expires) {
+				delete(ss.requests, id)
+			}
+		}
+		ss.requestsSwept = now
+	}
+	ss.requests[requestID] = doneRequest{reply: *reply, key: key, failed: failed, expires: now.Add(requestTTL)}
+}
@@ -0,0 +1,144 @@
+package storageserver
+
+import (
+	"errors"
+	"log"
+	"net/rpc"
+	"time"
+
+	"github.com/cmu440/tribbler/rpc/storagerpc"
+)
+
+// The master is the ring's first leader. If a node stops receiving the
+// leader's heartbeats, the nodes elect a new leader using the bully
+// algorithm: a node asks every node with a higher NodeID to take over, and
+// becomes the leader itself if none of them replies. The new leader removes
+// the failed node from the ring, announcing itself to the remaining nodes as
+// part of the ring change, and takes over only once every node has committed
+// the change; should the change fail, it runs the election again. A node that
+// is no longer part of the ring (such as a former leader that was cut off and
+// replaced) takes no part in elections.
+
+const (
+	maxMissedLeaderBeats = 3           // Elect a new leader after this many heartbeats are missed in a row.
+	electTimeout         = time.Second // How long to wait for a node to reply during an election.
+	electRetryInterval   = time.Second // How long to wait before running a failed election again.
+)
+
+// monitorLeader starts an election whenever several heartbeats in a row
+// have failed to arrive from the ring's leader.
+func (ss *storageServer) monitorLeader() {
+	ss.ringLock.Lock()
+	ss.lastBeat = time.Now()
+	ss.ringLock.Unlock()
+	for range time.Tick(heartbeatInterval) {
+		ss.ringLock.Lock()
+		leader, lastBeat, member := ss.leader, ss.lastBeat, containsNode(ss.servers, ss.nodeID)
+		ss.ringLock.Unlock()
+		if leader == ss.hostPort || !member || time.Since(lastBeat) < maxMissedLeaderBeats*heartbeatInterval {
+			continue
+		}
+		ss.elect(leader, nil)
+		// Give the winner of the election time to announce itself.
+		ss.ringLock.Lock()
+		ss.lastBeat = time.Now()
+		ss.ringLock.Unlock()
+	}
+}
+
+func (ss *storageServer) Elect(args *storagerpc.ElectArgs, reply *storagerpc.ElectReply) error {
+	reply.Status = storagerpc.OK
+	go ss.elect(args.Failed, nil)
+	return nil
+}
+
+// elect runs an election to replace the failed leader. If a node with a
+// higher NodeID replies, that node takes over the election; otherwise this
+// server removes the failed node from the ring (along with the nodes in
+// unreachable) and becomes the leader, or runs the election again if the ring
+// change fails, also removing the nodes that could not be reached.
+func (ss *storageServer) elect(failed string, unreachable []string) {
+	ss.ringLock.Lock()
+	if ss.electing || ss.leader != failed {
+		ss.ringLock.Unlock()
+		return
+	}
+	ss.electing = true
+	servers := ss.servers
+	ss.ringLock.Unlock()
+	defer func() {
+		ss.ringLock.Lock()
+		ss.electing = false
+		ss.ringLock.Unlock()
+	}()
+
+	var higher []string
+	for _, n := range servers {
+		if n.NodeID > ss.nodeID && n.HostPort != failed {
+			higher = append(higher, n.HostPort)
+		}
+	}
+	replies := make(chan bool, len(higher))
+	for _, hostPort := range higher {
+		go func(hostPort string) {
+			var reply storagerpc.ElectReply
+			err := ss.callTimeout(hostPort, "StorageServer.Elect", &storagerpc.ElectArgs{Failed: failed}, &reply, electTimeout)
+			replies <- err == nil && reply.Status == storagerpc.OK
+		}(hostPort)
+	}
+	outranked := false
+	for range higher {
+		if <-replies {
+			outranked = true
+		}
+	}
+	if outranked {
+		return
+	}
+
+	log.Printf("Taking over as leader from %s", failed)
+	ss.membershipLock.Lock()
+	defer ss.membershipLock.Unlock()
+	dead := append([]string{failed}, unreachable...)
+	servers, _ = ss.ring()
+	var next []storagerpc.Node
+	for _, n := range servers {
+		if !containsString(dead, n.HostPort) {
+			next = append(next, n)
+		}
+	}
+	if err := ss.changeRing(next, dead); err != nil {
+		log.Printf("Failed to remove %s from the ring, electing again: %s", failed, err)
+		var bErr *broadcastError
+		if errors.As(err, &bErr) {
+			for _, hostPort := range bErr.unreachable {
+				if hostPort != ss.hostPort && !containsString(unreachable, hostPort) {
+					unreachable = append(unreachable, hostPort)
+				}
+			}
+		}
+		time.AfterFunc(electRetryInterval, func() { ss.elect(failed, unreachable) })
+		return
+	}
+	ss.ringLock.Lock()
+	ss.leader = ss.hostPort
+	ss.ringLock.Unlock()
+}
+
+// callTimeout is like call, but gives up once timeout has elapsed.
+func (ss *storageServer) callTimeout(hostPort, method string, args, reply interface{}, timeout time.Duration) error {
+	cli, err := ss.client(hostPort)
+	if err != nil {
+		return err
+	}
+	call := cli.Go(method, args, reply, nil)
+	select {
+	case <-call.Done:
+		if _, ok := call.Error.(rpc.ServerError); call.Error != nil && !ok {
+			ss.dropClient(hostPort, cli)
+		}
+		return call.Error
+	case <-time.After(timeout):
+		return errors.New("call to " + hostPort + " timed out")
+	}
+}
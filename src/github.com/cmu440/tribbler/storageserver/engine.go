@@ -0,0 +1,189 @@
+package storageserver
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Engine names a way for a storage server to store its values and lists.
+type Engine string
+
+const (
+	MemoryEngine Engine = "memory" // Values and lists are kept in memory.
+	LogEngine    Engine = "log"    // Values and lists are kept in an append-only file, indexed in memory.
+)
+
+// engine stores a server's values and lists. Each write is made on behalf of
+// a write-ahead log record, numbered seq (or zero if the server is not
+// durable). An engine that is not durable starts out empty and is filled
+// from the latest snapshot and log records when the server recovers. A
+// durable engine recovers its own data when it is opened; the snapshot then
+// leaves the values and lists to it, and writes of log records that it
+// already holds are ignored when the log is replayed. Engines are not safe
+// for concurrent use; the server calls them with its data lock held.
+type engine interface {
+	// get and getList return key's value and list, respectively. The list
+	// must not be modified by the caller.
+	get(key string) (string, bool, error)
+	getList(key string) ([]string, bool, error)
+
+	// listLength returns the length of key's list, and listRange the items
+	// of key's list from position start up to (but excluding) end, which
+	// must lie within the list.
+	listLength(key string) (int, bool, error)
+	listRange(key string, start, end int) ([]string, error)
+
+	// put sets key's value. appendToList appends item to key's list unless
+	// the list already contains it, and removeFromList removes the first
+	// occurrence of item from key's list. delete removes key's value and list.
+	put(seq uint64, key, value string) error
+	appendToList(seq uint64, key, item string) error
+	removeFromList(seq uint64, key, item string) error
+	delete(seq uint64, key string) error
+
+	// trimList removes all but the last n items of key's list.
+	trimList(seq uint64, key string, n int) error
+
+	// scan returns the keys (values or lists) that start with prefix, in no
+	// particular order.
+	scan(prefix string) []string
+
+	// snapshot returns every value and list, for writing to a snapshot. The
+	// maps must not be modified, and are valid only until the next write.
+	snapshot() (map[string]string, map[string][]string, error)
+
+	// restore replaces every value and list with those of a snapshot as of
+	// the log record numbered seq.
+	restore(seq uint64, values map[string]string, lists map[string][]string) error
+
+	// durable reports whether the engine keeps its data across restarts.
+	// applied returns the number of the last log record whose write a
+	// durable engine holds, and checkpoint makes its writes durable,
+	// recording that it holds those of every log record up to seq.
+	durable() bool
+	applied() uint64
+	checkpoint(seq uint64) error
+}
+
+// newEngine creates the engine named by opts.Engine. A file-backed engine
+// keeps its file in opts.DataDir, or in a temporary file if it is empty.
+func newEngine(opts Options) (engine, error) {
+	switch opts.Engine {
+	case "", MemoryEngine:
+		return newMemoryEngine(), nil
+	case LogEngine:
+		return newLogEngine(opts.DataDir)
+	}
+	return nil, fmt.Errorf("unknown storage engine %q", opts.Engine)
+}
+
+// memoryEngine keeps values and lists in maps.
+type memoryEngine struct {
+	values map[string]string
+	lists  map[string][]string
+}
+
+func newMemoryEngine() *memoryEngine {
+	return &memoryEngine{
+		values: make(map[string]string),
+		lists:  make(map[string][]string),
+	}
+}
+
+func (e *memoryEngine) get(key string) (string, bool, error) {
+	value, ok := e.values[key]
+	return value, ok, nil
+}
+
+func (e *memoryEngine) getList(key string) ([]string, bool, error) {
+	list, ok := e.lists[key]
+	return list, ok, nil
+}
+
+func (e *memoryEngine) listLength(key string) (int, bool, error) {
+	list, ok := e.lists[key]
+	return len(list), ok, nil
+}
+
+func (e *memoryEngine) listRange(key string, start, end int) ([]string, error) {
+	return append([]string(nil), e.lists[key][start:end]...), nil
+}
+
+func (e *memoryEngine) put(seq uint64, key, value string) error {
+	e.values[key] = value
+	return nil
+}
+
+func (e *memoryEngine) appendToList(seq uint64, key, item string) error {
+	if !containsString(e.lists[key], item) {
+		e.lists[key] = append(e.lists[key], item)
+	}
+	return nil
+}
+
+func (e *memoryEngine) removeFromList(seq uint64, key, item string) error {
+	list := e.lists[key]
+	for i, v := range list {
+		if v == item {
+			e.lists[key] = append(list[:i:i], list[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (e *memoryEngine) delete(seq uint64, key string) error {
+	delete(e.values, key)
+	delete(e.lists, key)
+	return nil
+}
+
+func (e *memoryEngine) trimList(seq uint64, key string, n int) error {
+	if list := e.lists[key]; len(list) > n {
+		// Copy the kept items, so that the removed ones can be freed.
+		e.lists[key] = append([]string{}, list[len(list)-n:]...)
+	}
+	return nil
+}
+
+func (e *memoryEngine) scan(prefix string) []string {
+	var keys []string
+	for key := range e.values {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	for key := range e.lists {
+		if _, ok := e.values[key]; !ok && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (e *memoryEngine) snapshot() (map[string]string, map[string][]string, error) {
+	return e.values, e.lists, nil
+}
+
+func (e *memoryEngine) restore(seq uint64, values map[string]string, lists map[string][]string) error {
+	e.values, e.lists = make(map[string]string), make(map[string][]string)
+	for key, value := range values {
+		e.values[key] = value
+	}
+	for key, list := range lists {
+		e.lists[key] = list
+	}
+	return nil
+}
+
+func (e *memoryEngine) durable() bool {
+	return false
+}
+
+func (e *memoryEngine) applied() uint64 {
+	return 0
+}
+
+func (e *memoryEngine) checkpoint(seq uint64) error {
+	return nil
+}
@@ -0,0 +1,146 @@
+package storageserver
+
+import (
+	"log"
+	"time"
+
+	"github.com/cmu440/tribbler/rpc/storagerpc"
+)
+
+// A key written with a time-to-live expires at a fixed time, which is
+// logged and replicated along with the write. Reads answer KeyNotFound for
+// expired keys straight away, while each key's primary periodically deletes
+// its expired keys from itself and its replicas.
+
+const expiryInterval = time.Second // How often a server deletes its expired keys.
+
+// A deleted key's version is forgotten along with it, but only once
+// deletedTTL has passed, so that a key written again soon after it was
+// deleted gets a higher version than before: a Libstore's cache (or a client's
+// session) holding the old version must not take the new value for an older
+// one. deletedTTL outlasts every lease, and the writes that sessions remember.
+// Reads that do not find a key report the version at which it was deleted,
+// so that a client can tell a deletion from a replica lagging behind a write.
+const deletedTTL = 10 * time.Minute
+
+// deletedKey is the version of a deleted key.
+type deletedKey struct {
+	Version uint64
+	Expires int64 // When the version is forgotten, in Unix nanoseconds.
+}
+
+// lastVersionLocked returns the version of key's latest write, including
+// its deletion, or zero if it is not known.
+func (ss *storageServer) lastVersionLocked(key string) uint64 {
+	if version, ok := ss.versions[key]; ok {
+		return version
+	}
+	return ss.deleted[key].Version
+}
+
+// nextVersionLocked returns the version of key's next write.
+func (ss *storageServer) nextVersionLocked(key string) uint64 {
+	return ss.lastVersionLocked(key) + 1
+}
+
+// forgetVersionLocked moves key's version, or version if it is higher, to
+// the deleted keys, as key is deleted.
+func (ss *storageServer) forgetVersionLocked(key string, version uint64) {
+	if v := ss.versions[key]; v > version {
+		version = v
+	}
+	if d := ss.deleted[key]; d.Version > version {
+		version = d.Version
+	}
+	delete(ss.versions, key)
+	if version > 0 {
+		ss.deleted[key] = deletedKey{Version: version, Expires: time.Now().Add(deletedTTL).UnixNano()}
+	}
+}
+
+// expiresAt returns the time (in Unix nanoseconds, or zero for never) at
+// which a write to key with the given time-to-live makes the key expire. A
+// write without a time-to-live keeps the key's current expiry if keep is
+// set, and makes the key permanent otherwise.
+func (ss *storageServer) expiresAt(key string, ttl time.Duration, keep bool) int64 {
+	if ttl > 0 {
+		return time.Now().Add(ttl).UnixNano()
+	}
+	if !keep {
+		return 0
+	}
+	ss.dataLock.Lock()
+	defer ss.dataLock.Unlock()
+	return ss.expires[key]
+}
+
+// expiredLocked reports whether key has expired.
+func (ss *storageServer) expiredLocked(key string) bool {
+	expires, ok := ss.expires[key]
+	return ok && time.Now().UnixNano() >= expires
+}
+
+// ttlLocked returns the time left until key expires, or zero if it never does.
+func (ss *storageServer) ttlLocked(key string) time.Duration {
+	expires, ok := ss.expires[key]
+	if !ok {
+		return 0
+	}
+	return time.Until(time.Unix(0, expires))
+}
+
+// expire deletes key from this server and its replicas if it has expired.
+// The caller must hold the key's write lock.
+func (ss *storageServer) expire(key string) error {
+	ss.dataLock.Lock()
+	expired := ss.expiredLocked(key)
+	ss.dataLock.Unlock()
+	if !expired {
+		return nil
+	}
+	// Libstores stop caching the key when it expires, but their clocks may
+	// lag behind this server's.
+	ss.revokeLeases(key)
+	var version uint64
+	return ss.write(&logRecord{Op: storagerpc.OpDelete, Key: key}, &version)
+}
+
+// expireKeys periodically deletes the expired keys in this server's range,
+// and forgets the versions of keys deleted more than deletedTTL ago.
+func (ss *storageServer) expireKeys() {
+	for range time.Tick(expiryInterval) {
+		ss.dataLock.Lock()
+		var expired []string
+		for key := range ss.expires {
+			if ss.expiredLocked(key) {
+				expired = append(expired, key)
+			}
+		}
+		now := time.Now().UnixNano()
+		for key, d := range ss.deleted {
+			if now >= d.Expires {
+				delete(ss.deleted, key)
+			}
+		}
+		ss.dataLock.Unlock()
+
+		for _, key := range expired {
+			if err := ss.expireKey(key); err != nil {
+				log.Printf("Failed to delete expired key %s: %s", key, err)
+			}
+		}
+	}
+}
+
+// expireKey deletes key if it has expired and falls within this server's
+// range. Replicas leave expired keys to the primary.
+func (ss *storageServer) expireKey(key string) error {
+	ss.ringChange.RLock()
+	defer ss.ringChange.RUnlock()
+	if ss.checkPrimary(key) != storagerpc.OK {
+		return nil
+	}
+	unlock := ss.lockKey(key)
+	defer unlock()
+	return ss.expire(key)
+}
@@ -0,0 +1,145 @@
+package storageserver
+
+import (
+	"log"
+	"time"
+
+	"github.com/cmu440/tribbler/rpc/storagerpc"
+)
+
+const (
+	heartbeatInterval   = time.Second // How often the leader sends heartbeats.
+	defaultSuspectAfter = 2           // Default number of missed heartbeats after which a node is Suspect.
+	defaultDeadAfter    = 5           // Default number of missed heartbeats after which a node is Dead.
+)
+
+// sendHeartbeats periodically sends a heartbeat to every other node of the
+// ring while this server is the leader, counting the heartbeats that each
+// node misses in a row. Nodes that miss enough to be Dead are removed.
+func (ss *storageServer) sendHeartbeats() {
+	for range time.Tick(heartbeatInterval) {
+		ss.ringLock.Lock()
+		if ss.leader != ss.hostPort {
+			ss.ringLock.Unlock()
+			continue
+		}
+		args := &storagerpc.HeartbeatArgs{Leader: ss.hostPort, Version: ss.version, Liveness: ss.livenessLocked()}
+		servers := ss.servers
+		ss.ringLock.Unlock()
+
+		for _, n := range servers {
+			if n.HostPort == ss.hostPort {
+				continue
+			}
+			go func(hostPort string) {
+				var reply storagerpc.HeartbeatReply
+				err := ss.callTimeout(hostPort, "StorageServer.Heartbeat", args, &reply, heartbeatInterval)
+				ss.ringLock.Lock()
+				defer ss.ringLock.Unlock()
+				switch {
+				case err != nil:
+					if ss.missed[hostPort]++; ss.missed[hostPort] >= ss.deadAfter {
+						go ss.removeDead()
+					}
+				case reply.Status == storagerpc.WrongServer && reply.Version > ss.version && ss.leader == ss.hostPort:
+					// Another node took over while this one was cut off.
+					log.Printf("Stepping down as leader in favor of %s", reply.Leader)
+					ss.leader = reply.Leader
+					go ss.refreshRing(reply.Leader)
+				default:
+					delete(ss.missed, hostPort)
+				}
+			}(n.HostPort)
+		}
+	}
+}
+
+// removeDead removes the nodes that are Dead from the ring, handing off
+// their keys from their live replicas, much as a new leader removes the
+// leader it replaces. Should the ring's membership be changing already, or
+// the change fail, the nodes are removed after a later heartbeat instead.
+func (ss *storageServer) removeDead() {
+	if !ss.membershipLock.TryLock() {
+		return
+	}
+	defer ss.membershipLock.Unlock()
+	ss.ringLock.Lock()
+	if ss.leader != ss.hostPort {
+		ss.ringLock.Unlock()
+		return
+	}
+	var next []storagerpc.Node
+	var dead []string
+	for _, n := range ss.servers {
+		if ss.missed[n.HostPort] >= ss.deadAfter {
+			dead = append(dead, n.HostPort)
+		} else {
+			next = append(next, n)
+		}
+	}
+	ss.ringLock.Unlock()
+	if len(dead) == 0 {
+		return
+	}
+	log.Printf("Removing dead nodes %v from the ring", dead)
+	if err := ss.changeRing(next, dead); err != nil {
+		log.Printf("Failed to remove %v from the ring: %s", dead, err)
+		return
+	}
+	ss.ringLock.Lock()
+	for _, hostPort := range dead {
+		delete(ss.missed, hostPort)
+	}
+	ss.ringLock.Unlock()
+}
+
+// livenessLocked returns the liveness of each node of the ring. Only the
+// leader tracks liveness itself; other nodes report what the leader last
+// told them.
+func (ss *storageServer) livenessLocked() map[string]storagerpc.Liveness {
+	if ss.leader != ss.hostPort {
+		return ss.liveness
+	}
+	liveness := make(map[string]storagerpc.Liveness, len(ss.servers))
+	for _, n := range ss.servers {
+		switch missed := ss.missed[n.HostPort]; {
+		case missed >= ss.deadAfter:
+			liveness[n.HostPort] = storagerpc.Dead
+		case missed >= ss.suspectAfter:
+			liveness[n.HostPort] = storagerpc.Suspect
+		default:
+			liveness[n.HostPort] = storagerpc.Alive
+		}
+	}
+	return liveness
+}
+
+// refreshRing replaces this server's ring with that of the storage server
+// at hostPort, if it is newer.
+func (ss *storageServer) refreshRing(hostPort string) {
+	var reply storagerpc.GetServersReply
+	if err := ss.call(hostPort, "StorageServer.GetServers", &storagerpc.GetServersArgs{}, &reply); err != nil || reply.Status != storagerpc.OK {
+		return
+	}
+	ss.ringLock.Lock()
+	defer ss.ringLock.Unlock()
+	ss.setServersLocked(reply.Servers, reply.Version)
+}
+
+func (ss *storageServer) Heartbeat(args *storagerpc.HeartbeatArgs, reply *storagerpc.HeartbeatReply) error {
+	ss.ringLock.Lock()
+	defer ss.ringLock.Unlock()
+	if args.Leader != ss.leader {
+		if args.Version <= ss.version {
+			reply.Status = storagerpc.WrongServer
+			reply.Leader = ss.leader
+			reply.Version = ss.version
+			return nil
+		}
+		ss.leader = args.Leader
+	}
+	ss.lastBeat = time.Now()
+	ss.liveness = args.Liveness
+	reply.Status = storagerpc.OK
+	return nil
+}
@@ -0,0 +1,79 @@
+package storageserver
+
+import (
+	"sort"
+	"time"
+
+	"github.com/cmu440/tribbler/rpc/storagerpc"
+)
+
+const (
+	maxRevokeTimeouts = 3                // Revocations in a row that may time out before a Libstore is denied leases.
+	leaseDenyPeriod   = 60 * time.Second // How long a Libstore is denied leases once it is.
+)
+
+// slowHolder tracks a Libstore whose latest lease revocations timed out.
+type slowHolder struct {
+	timeouts    int       // Revocations in a row that timed out.
+	deniedUntil time.Time // Leases are not granted to the Libstore until then.
+}
+
+// recordRevocation counts a lease revocation, which was either acknowledged
+// by the Libstore at hostPort or given up on once the lease expired. A
+// Libstore whose revocations keep timing out is denied leases for a while,
+// so that it stops stalling writes.
+func (ss *storageServer) recordRevocation(hostPort string, acked bool) {
+	ss.dataLock.Lock()
+	defer ss.dataLock.Unlock()
+	if acked {
+		ss.leaseStats.Revocations++
+		delete(ss.slow, hostPort)
+		return
+	}
+	ss.leaseStats.RevocationTimeouts++
+	sh, ok := ss.slow[hostPort]
+	if !ok {
+		sh = new(slowHolder)
+		ss.slow[hostPort] = sh
+	}
+	sh.timeouts++
+	if sh.timeouts >= maxRevokeTimeouts {
+		sh.deniedUntil = time.Now().Add(leaseDenyPeriod)
+	}
+}
+
+// deniedLocked reports whether leases are denied to the Libstore at hostPort.
+func (ss *storageServer) deniedLocked(hostPort string) bool {
+	sh, ok := ss.slow[hostPort]
+	return ok && time.Now().Before(sh.deniedUntil)
+}
+
+func (ss *storageServer) GetLeases(args *storagerpc.GetLeasesArgs, reply *storagerpc.GetLeasesReply) error {
+	ss.dataLock.Lock()
+	defer ss.dataLock.Unlock()
+	now := time.Now()
+	for key, ls := range ss.leases {
+		if args.Key != "" && key != args.Key {
+			continue
+		}
+		kl := storagerpc.KeyLeases{Key: key, Revoking: ls.revoking}
+		for hostPort, grant := range ls.holders {
+			if now.Before(grant.expires) {
+				kl.Holders = append(kl.Holders, storagerpc.LeaseHolder{HostPort: hostPort, Granted: grant.granted, Expires: grant.expires, WriteThrough: grant.writeThrough})
+			}
+		}
+		if len(kl.Holders) == 0 && !kl.Revoking {
+			continue
+		}
+		sort.Slice(kl.Holders, func(i, j int) bool { return kl.Holders[i].HostPort < kl.Holders[j].HostPort })
+		reply.Leases = append(reply.Leases, kl)
+	}
+	sort.Slice(reply.Leases, func(i, j int) bool { return reply.Leases[i].Key < reply.Leases[j].Key })
+	reply.Stats = ss.leaseStats
+	for hostPort, sh := range ss.slow {
+		reply.SlowHolders = append(reply.SlowHolders, storagerpc.SlowHolder{HostPort: hostPort, Timeouts: sh.timeouts, DeniedUntil: sh.deniedUntil})
+	}
+	sort.Slice(reply.SlowHolders, func(i, j int) bool { return reply.SlowHolders[i].HostPort < reply.SlowHolders[j].HostPort })
+	reply.Status = storagerpc.OK
+	return nil
+}
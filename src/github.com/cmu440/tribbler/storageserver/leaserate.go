@@ -0,0 +1,94 @@
+package storageserver
+
+import (
+	"math"
+	"time"
+
+	"github.com/cmu440/tribbler/rpc/storagerpc"
+)
+
+// Leases are granted for longer on keys that are read often but rarely
+// written, and for less time (or not at all) on keys written often, since a
+// lease is only worth its revocations if the key is read several times
+// before its next write. Each key's reads and writes are counted with
+// exponential decay, so that the counts cover roughly the last rateWindow.
+
+const (
+	rateWindow      = time.Minute // Time constant of the decay of read and write counts.
+	hotReads        = 30          // Reads per rateWindow above which a key is hot.
+	minLeaseSeconds = 2           // Leases shorter than this are not granted at all.
+	minRateCount    = 0.01        // Counts below this are forgotten.
+)
+
+// keyRate counts the recent reads and writes of a key.
+type keyRate struct {
+	reads   float64
+	writes  float64
+	updated time.Time
+}
+
+// decay brings r's counts up to date with now.
+func (r *keyRate) decay(now time.Time) {
+	f := math.Exp(-float64(now.Sub(r.updated)) / float64(rateWindow))
+	r.reads *= f
+	r.writes *= f
+	r.updated = now
+}
+
+// rateLocked returns key's counts, brought up to date.
+func (ss *storageServer) rateLocked(key string) *keyRate {
+	now := time.Now()
+	r, ok := ss.rates[key]
+	if !ok {
+		r = &keyRate{updated: now}
+		ss.rates[key] = r
+	}
+	r.decay(now)
+	return r
+}
+
+func (ss *storageServer) recordReadLocked(key string) {
+	ss.rateLocked(key).reads++
+}
+
+func (ss *storageServer) recordWriteLocked(key string) {
+	ss.rateLocked(key).writes++
+}
+
+// leaseSecondsLocked returns how long a lease on key should be valid for,
+// or zero if no lease should be granted. A lease lasts about half the
+// expected time until the key's next write, but no longer than LeaseSeconds,
+// or the server's maximum if the key is hot (or if the maximum is shorter).
+func (ss *storageServer) leaseSecondsLocked(key string) int {
+	r := ss.rateLocked(key)
+	limit := storagerpc.LeaseSeconds
+	if r.reads >= hotReads || limit > ss.maxLeaseSeconds {
+		limit = ss.maxLeaseSeconds
+	}
+	if r.writes < 1 {
+		return limit
+	}
+	seconds := int(rateWindow.Seconds() / (2 * r.writes))
+	if seconds < minLeaseSeconds {
+		return 0
+	}
+	if seconds > limit {
+		return limit
+	}
+	return seconds
+}
+
+// pruneRates periodically forgets the counts of keys that have been neither
+// read nor written for a long while.
+func (ss *storageServer) pruneRates() {
+	for range time.Tick(rateWindow) {
+		ss.dataLock.Lock()
+		now := time.Now()
+		for key, r := range ss.rates {
+			if r.decay(now); r.reads < minRateCount && r.writes < minRateCount {
+				delete(ss.rates, key)
+			}
+		}
+		ss.dataLock.Unlock()
+	}
+}
@@ -0,0 +1,144 @@
+package storageserver
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/cmu440/tribbler/rpc/storagerpc"
+)
+
+// Lists such as a user's tribble IDs grow without bound, so besides reading
+// and writing whole lists, Libstores may read a range of a list or its
+// length alone, and trim a list to its latest items. Ranges and lengths are
+// leased like whole lists, so the leases on a key cover whatever a Libstore
+// caches of it. A trim cannot be applied to a cached range, so it revokes
+// every lease on the key, including write-through ones.
+
+// listWindow returns the bounds of the items of a list of the given length
+// that a GetListRange with the given arguments selects.
+func listWindow(length, offset, limit int, fromTail bool) (int, int) {
+	var start, end int
+	if fromTail {
+		end = length - offset
+		if limit > 0 {
+			start = end - limit
+		}
+	} else {
+		start = offset
+		end = length
+		if limit > 0 {
+			end = start + limit
+		}
+	}
+	start, end = clamp(start, 0, length), clamp(end, 0, length)
+	if start > end {
+		start = end
+	}
+	return start, end
+}
+
+func clamp(n, lo, hi int) int {
+	if n < lo {
+		return lo
+	}
+	if n > hi {
+		return hi
+	}
+	return n
+}
+
+func (ss *storageServer) GetListRange(args *storagerpc.GetListRangeArgs, reply *storagerpc.GetListRangeReply) error {
+	if args.Offset < 0 || args.Limit < 0 {
+		return errors.New("negative offset or limit")
+	}
+	if reply.Status = ss.checkKey(args.Key); reply.Status != storagerpc.OK {
+		return nil
+	}
+	ss.dataLock.Lock()
+	defer ss.dataLock.Unlock()
+	length, ok, err := ss.store.listLength(args.Key)
+	if err != nil {
+		return err
+	}
+	if !ok || ss.expiredLocked(args.Key) {
+		reply.Status = storagerpc.KeyNotFound
+		reply.Version = ss.lastVersionLocked(args.Key)
+		return nil
+	}
+	start, end := listWindow(length, args.Offset, args.Limit, args.FromTail)
+	if reply.Value, err = ss.store.listRange(args.Key, start, end); err != nil {
+		return err
+	}
+	ss.recordReadLocked(args.Key)
+	reply.Length = length
+	reply.Version = ss.versions[args.Key]
+	reply.TTL = ss.ttlLocked(args.Key)
+	if args.WantLease {
+		reply.Lease = ss.grantLeaseLocked(args.Key, args.HostPort, args.WriteThrough)
+	}
+	return nil
+}
+
+func (ss *storageServer) ListLength(args *storagerpc.GetArgs, reply *storagerpc.ListLengthReply) error {
+	if reply.Status = ss.checkKey(args.Key); reply.Status != storagerpc.OK {
+		return nil
+	}
+	ss.dataLock.Lock()
+	defer ss.dataLock.Unlock()
+	length, ok, err := ss.store.listLength(args.Key)
+	if err != nil {
+		return err
+	}
+	if !ok || ss.expiredLocked(args.Key) {
+		reply.Status = storagerpc.KeyNotFound
+		reply.Version = ss.lastVersionLocked(args.Key)
+		return nil
+	}
+	ss.recordReadLocked(args.Key)
+	reply.Length = length
+	reply.Version = ss.versions[args.Key]
+	reply.TTL = ss.ttlLocked(args.Key)
+	if args.WantLease {
+		reply.Lease = ss.grantLeaseLocked(args.Key, args.HostPort, args.WriteThrough)
+	}
+	return nil
+}
+
+func (ss *storageServer) TrimList(args *storagerpc.TrimListArgs, reply *storagerpc.PutReply) (err error) {
+	if args.Length < 0 {
+		return errors.New("negative length")
+	}
+	ss.ringChange.RLock()
+	defer ss.ringChange.RUnlock()
+	if reply.Status = ss.checkPrimary(args.Key); reply.Status != storagerpc.OK {
+		return nil
+	}
+	unlock := ss.lockKey(args.Key)
+	defer unlock()
+	if ss.replayRequest(args.RequestID, reply) {
+		return nil
+	}
+	defer func() {
+		err = ss.settleRequest(args.RequestID, args.Key, reply, err)
+	}()
+	if err := ss.expire(args.Key); err != nil {
+		return err
+	}
+	ss.dataLock.Lock()
+	length, ok, err := ss.store.listLength(args.Key)
+	reply.Version = ss.versions[args.Key]
+	ss.dataLock.Unlock()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		reply.Status = storagerpc.KeyNotFound
+		return nil
+	}
+	if length <= args.Length {
+		return nil
+	}
+	ss.revokeLeases(args.Key)
+	expires := ss.expiresAt(args.Key, 0, true)
+	return ss.write(&logRecord{Op: storagerpc.OpTrimList, Key: args.Key, Value: strconv.Itoa(args.Length), Expires: expires, requestID: args.RequestID}, &reply.Version)
+}
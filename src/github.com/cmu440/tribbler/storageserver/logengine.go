@@ -0,0 +1,558 @@
+package storageserver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	engineFileName = "data.log"
+	minCompactSize = 1 << 20 // Compact the engine's file only once it holds this many bytes.
+)
+
+// Kinds of entries in a logEngine's file.
+const (
+	entryPut    byte = iota + 1 // Sets the key's value to the entry's data.
+	entryAppend                 // Appends the entry's data to the key's list.
+	entryRemove                 // Removes the item at the position given by the entry's data from the key's list.
+	entryDelete                 // Removes the key's value and list.
+	entryTrim                   // Removes all but the number of items given by the entry's data from the key's list, creating the list if absent.
+	entryMark                   // Records that the engine holds the writes of every log record up to the entry's.
+)
+
+// extent locates a value or list item in a logEngine's file.
+type extent struct {
+	offset int64
+	size   int
+}
+
+// logEngine appends every write to a file, and keeps only the location of
+// each live value and list item in memory. Overwritten values and removed
+// items are left in place until the file is mostly garbage, when the live
+// data is copied to a fresh file. Each entry is framed like a write-ahead
+// log record and tagged with the sequence number of the log record whose
+// write it holds, so that an engine with a directory rebuilds its index from
+// its file when it is opened, and the server need only replay the log
+// records that follow. Entries are not synced as they are written: the
+// server checkpoints the engine before discarding log records, and a tail
+// torn by a crash is truncated away when the file is reopened.
+type logEngine struct {
+	dir    string // Directory of the file, or empty for an unnamed temporary file.
+	file   *os.File
+	size   int64  // Number of bytes in the file.
+	live   int64  // Number of bytes in the file that are live.
+	seq    uint64 // Sequence number of the last log record whose write the engine holds.
+	values map[string]extent
+	lists  map[string][]extent
+}
+
+func newLogEngine(dir string) (*logEngine, error) {
+	e := &logEngine{
+		dir:    dir,
+		values: make(map[string]extent),
+		lists:  make(map[string][]extent),
+	}
+	if dir == "" {
+		file, err := e.create("")
+		if err != nil {
+			return nil, err
+		}
+		e.file = file
+		return e, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, engineFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	e.file = file
+	if err := e.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := e.maybeCompact(); err != nil {
+		e.file.Close()
+		return nil, err
+	}
+	return e, nil
+}
+
+// create creates an empty file for the engine, named after the engine's
+// file plus suffix. Without a directory, the file is removed straight away,
+// so that it disappears once it is closed.
+func (e *logEngine) create(suffix string) (*os.File, error) {
+	if e.dir == "" {
+		file, err := os.CreateTemp("", "storageserver-*.log")
+		if err != nil {
+			return nil, err
+		}
+		os.Remove(file.Name())
+		return file, nil
+	}
+	return os.OpenFile(filepath.Join(e.dir, engineFileName+suffix), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+}
+
+// load rebuilds the engine's index from its file. A torn or corrupt entry
+// (and everything after it) is truncated away.
+func (e *logEngine) load() error {
+	info, err := e.file.Stat()
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(io.NewSectionReader(e.file, 0, info.Size()))
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err == io.EOF {
+			return nil
+		} else if err != nil {
+			break
+		}
+		size := int64(binary.BigEndian.Uint32(header[0:4]))
+		if size > info.Size()-e.size-int64(len(header)) {
+			break
+		}
+		body := make([]byte, size)
+		if _, err := io.ReadFull(r, body); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:8]) {
+			break
+		}
+		if err := e.index(e.size+int64(len(header)), body); err != nil {
+			break
+		}
+		e.size += int64(len(header)) + size
+	}
+	log.Printf("Discarding torn storage engine tail at offset %d", e.size)
+	return e.file.Truncate(e.size)
+}
+
+// index applies the entry whose body starts at offset in the engine's file
+// to the engine's index.
+func (e *logEngine) index(offset int64, body []byte) error {
+	if len(body) == 0 {
+		return errCorruptRecord
+	}
+	kind := body[0]
+	seq, n := binary.Uvarint(body[1:])
+	if n <= 0 {
+		return errCorruptRecord
+	}
+	key, rest, ok := readString(body[1+n:])
+	if !ok {
+		return errCorruptRecord
+	}
+	data, rest, ok := readString(rest)
+	if !ok || len(rest) > 0 {
+		return errCorruptRecord
+	}
+	x := extent{offset: offset + int64(len(body)-len(data)), size: len(data)}
+	switch kind {
+	case entryPut:
+		e.setValue(key, x)
+	case entryAppend:
+		e.addItem(key, x)
+	case entryRemove, entryTrim:
+		i, err := strconv.Atoi(data)
+		if err != nil {
+			return errCorruptRecord
+		}
+		if kind == entryRemove {
+			e.removeItem(key, i)
+		} else {
+			e.trimItems(key, i)
+		}
+	case entryDelete:
+		e.drop(key)
+	case entryMark:
+	default:
+		return errCorruptRecord
+	}
+	if seq > e.seq {
+		e.seq = seq
+	}
+	return nil
+}
+
+// appendEntry writes an entry to the end of file, which holds size bytes,
+// and returns where the entry's data was written.
+func appendEntry(file *os.File, size *int64, kind byte, seq uint64, key, data string) (extent, error) {
+	body := make([]byte, 0, 1+3*binary.MaxVarintLen64+len(key)+len(data))
+	body = append(body, kind)
+	body = binary.AppendUvarint(body, seq)
+	body = appendString(body, key)
+	body = appendString(body, data)
+	buf := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(body))
+	buf = append(buf, body...)
+	if _, err := file.WriteAt(buf, *size); err != nil {
+		return extent{}, err
+	}
+	*size += int64(len(buf))
+	return extent{offset: *size - int64(len(data)), size: len(data)}, nil
+}
+
+// holds reports whether the engine already holds the write of the log
+// record numbered seq, as it may when the record is replayed on recovery.
+func (e *logEngine) holds(seq uint64) bool {
+	return seq != 0 && seq <= e.seq
+}
+
+// write appends an entry for the write of the log record numbered seq.
+func (e *logEngine) write(kind byte, seq uint64, key, data string) (extent, error) {
+	x, err := appendEntry(e.file, &e.size, kind, seq, key, data)
+	if err == nil && seq > e.seq {
+		e.seq = seq
+	}
+	return x, err
+}
+
+func (e *logEngine) read(x extent) (string, error) {
+	buf := make([]byte, x.size)
+	if _, err := e.file.ReadAt(buf, x.offset); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// The following methods update the index, recording which data in the file
+// is live.
+
+func (e *logEngine) setValue(key string, x extent) {
+	if old, ok := e.values[key]; ok {
+		e.live -= int64(old.size)
+	}
+	e.values[key] = x
+	e.live += int64(x.size)
+}
+
+func (e *logEngine) addItem(key string, x extent) {
+	e.lists[key] = append(e.lists[key], x)
+	e.live += int64(x.size)
+}
+
+func (e *logEngine) removeItem(key string, i int) {
+	xs := e.lists[key]
+	if i < 0 || i >= len(xs) {
+		return
+	}
+	e.live -= int64(xs[i].size)
+	e.lists[key] = append(xs[:i:i], xs[i+1:]...)
+}
+
+func (e *logEngine) trimItems(key string, n int) {
+	xs, ok := e.lists[key]
+	if !ok {
+		e.lists[key] = []extent{}
+	}
+	if len(xs) <= n {
+		return
+	}
+	for _, x := range xs[:len(xs)-n] {
+		e.live -= int64(x.size)
+	}
+	e.lists[key] = append([]extent{}, xs[len(xs)-n:]...)
+}
+
+func (e *logEngine) drop(key string) {
+	if x, ok := e.values[key]; ok {
+		e.live -= int64(x.size)
+		delete(e.values, key)
+	}
+	for _, x := range e.lists[key] {
+		e.live -= int64(x.size)
+	}
+	delete(e.lists, key)
+}
+
+func (e *logEngine) get(key string) (string, bool, error) {
+	x, ok := e.values[key]
+	if !ok {
+		return "", false, nil
+	}
+	value, err := e.read(x)
+	return value, true, err
+}
+
+func (e *logEngine) getList(key string) ([]string, bool, error) {
+	xs, ok := e.lists[key]
+	if !ok {
+		return nil, false, nil
+	}
+	list := make([]string, len(xs))
+	for i, x := range xs {
+		item, err := e.read(x)
+		if err != nil {
+			return nil, true, err
+		}
+		list[i] = item
+	}
+	return list, true, nil
+}
+
+func (e *logEngine) listLength(key string) (int, bool, error) {
+	xs, ok := e.lists[key]
+	return len(xs), ok, nil
+}
+
+func (e *logEngine) listRange(key string, start, end int) ([]string, error) {
+	xs := e.lists[key][start:end]
+	items := make([]string, len(xs))
+	for i, x := range xs {
+		item, err := e.read(x)
+		if err != nil {
+			return nil, err
+		}
+		items[i] = item
+	}
+	return items, nil
+}
+
+// find returns the position of item in key's list, or -1 if it is absent.
+func (e *logEngine) find(key, item string) (int, error) {
+	for i, x := range e.lists[key] {
+		if x.size != len(item) {
+			continue
+		}
+		v, err := e.read(x)
+		if err != nil {
+			return -1, err
+		}
+		if v == item {
+			return i, nil
+		}
+	}
+	return -1, nil
+}
+
+func (e *logEngine) put(seq uint64, key, value string) error {
+	if e.holds(seq) {
+		return nil
+	}
+	x, err := e.write(entryPut, seq, key, value)
+	if err != nil {
+		return err
+	}
+	e.setValue(key, x)
+	return e.maybeCompact()
+}
+
+func (e *logEngine) appendToList(seq uint64, key, item string) error {
+	if e.holds(seq) {
+		return nil
+	}
+	if i, err := e.find(key, item); err != nil || i >= 0 {
+		return err
+	}
+	x, err := e.write(entryAppend, seq, key, item)
+	if err != nil {
+		return err
+	}
+	e.addItem(key, x)
+	return e.maybeCompact()
+}
+
+func (e *logEngine) removeFromList(seq uint64, key, item string) error {
+	if e.holds(seq) {
+		return nil
+	}
+	i, err := e.find(key, item)
+	if err != nil || i < 0 {
+		return err
+	}
+	if _, err := e.write(entryRemove, seq, key, strconv.Itoa(i)); err != nil {
+		return err
+	}
+	e.removeItem(key, i)
+	return e.maybeCompact()
+}
+
+func (e *logEngine) delete(seq uint64, key string) error {
+	if e.holds(seq) {
+		return nil
+	}
+	_, isValue := e.values[key]
+	_, isList := e.lists[key]
+	if !isValue && !isList {
+		return nil
+	}
+	if _, err := e.write(entryDelete, seq, key, ""); err != nil {
+		return err
+	}
+	e.drop(key)
+	return e.maybeCompact()
+}
+
+func (e *logEngine) trimList(seq uint64, key string, n int) error {
+	if e.holds(seq) || len(e.lists[key]) <= n {
+		return nil
+	}
+	if _, err := e.write(entryTrim, seq, key, strconv.Itoa(n)); err != nil {
+		return err
+	}
+	e.trimItems(key, n)
+	return e.maybeCompact()
+}
+
+func (e *logEngine) scan(prefix string) []string {
+	var keys []string
+	for key := range e.values {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	for key := range e.lists {
+		if _, ok := e.values[key]; !ok && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (e *logEngine) snapshot() (map[string]string, map[string][]string, error) {
+	values := make(map[string]string, len(e.values))
+	for key := range e.values {
+		value, _, err := e.get(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		values[key] = value
+	}
+	lists := make(map[string][]string, len(e.lists))
+	for key := range e.lists {
+		list, _, err := e.getList(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		lists[key] = list
+	}
+	return values, lists, nil
+}
+
+func (e *logEngine) restore(seq uint64, values map[string]string, lists map[string][]string) error {
+	if err := e.file.Truncate(0); err != nil {
+		return err
+	}
+	e.size, e.live, e.seq = 0, 0, 0
+	e.values = make(map[string]extent, len(values))
+	e.lists = make(map[string][]extent, len(lists))
+	// The restored data is written as of no log record, so that a crash
+	// part of the way through leaves the engine holding nothing newer than
+	// before.
+	for key, value := range values {
+		x, err := e.write(entryPut, 0, key, value)
+		if err != nil {
+			return err
+		}
+		e.setValue(key, x)
+	}
+	for key, list := range lists {
+		if _, err := e.write(entryTrim, 0, key, "0"); err != nil {
+			return err
+		}
+		e.trimItems(key, 0)
+		for _, item := range list {
+			x, err := e.write(entryAppend, 0, key, item)
+			if err != nil {
+				return err
+			}
+			e.addItem(key, x)
+		}
+	}
+	_, err := e.write(entryMark, seq, "", "")
+	return err
+}
+
+func (e *logEngine) durable() bool {
+	return e.dir != ""
+}
+
+func (e *logEngine) applied() uint64 {
+	return e.seq
+}
+
+func (e *logEngine) checkpoint(seq uint64) error {
+	if seq > e.seq {
+		if _, err := e.write(entryMark, seq, "", ""); err != nil {
+			return err
+		}
+	}
+	return e.file.Sync()
+}
+
+// maybeCompact copies the live data to a fresh file once the engine's file
+// is large and mostly garbage. The fresh file is synced before it replaces
+// the old one, since writes that the old file held durably may no longer be
+// in the write-ahead log.
+func (e *logEngine) maybeCompact() error {
+	if e.size < minCompactSize || e.live > e.size/2 {
+		return nil
+	}
+	file, err := e.create(".tmp")
+	if err != nil {
+		return err
+	}
+	var size int64
+	if _, err := appendEntry(file, &size, entryMark, e.seq, "", ""); err != nil {
+		file.Close()
+		return err
+	}
+	values := make(map[string]extent, len(e.values))
+	lists := make(map[string][]extent, len(e.lists))
+	for key, x := range e.values {
+		value, err := e.read(x)
+		if err == nil {
+			values[key], err = appendEntry(file, &size, entryPut, 0, key, value)
+		}
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+	for key, xs := range e.lists {
+		lists[key] = make([]extent, len(xs))
+		if len(xs) == 0 {
+			if _, err := appendEntry(file, &size, entryTrim, 0, key, "0"); err != nil {
+				file.Close()
+				return err
+			}
+		}
+		for i, x := range xs {
+			item, err := e.read(x)
+			if err == nil {
+				lists[key][i], err = appendEntry(file, &size, entryAppend, 0, key, item)
+			}
+			if err != nil {
+				file.Close()
+				return err
+			}
+		}
+	}
+	if e.dir != "" {
+		err := file.Sync()
+		if err == nil {
+			err = os.Rename(file.Name(), filepath.Join(e.dir, engineFileName))
+		}
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+	e.file.Close()
+	e.file, e.size = file, size
+	e.values, e.lists = values, lists
+	if e.dir != "" {
+		return syncDir(e.dir)
+	}
+	return nil
+}
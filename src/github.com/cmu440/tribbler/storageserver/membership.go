@@ -0,0 +1,416 @@
+package storageserver
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"time"
+
+	"github.com/cmu440/tribbler/rpc/storagerpc"
+)
+
+// A change to the ring's membership proceeds in two phases, both driven by
+// the ring's leader. First, every node of the old and new rings is sent the new
+// ring via PrepareRing: each node stops serving keys whose replica set
+// changes, revokes their leases, and (if it is a key's old primary) streams
+// the key to the nodes that newly become responsible for it. Once every
+// node has prepared, the master sends CommitRing, upon which the nodes
+// switch to the new ring and discard the keys they no longer store.
+
+func containsNode(servers []storagerpc.Node, nodeID uint32) bool {
+	for _, n := range servers {
+		if n.NodeID == nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+// leaderHostPort returns the host:port of the ring's leader.
+func (ss *storageServer) leaderHostPort() string {
+	ss.ringLock.Lock()
+	defer ss.ringLock.Unlock()
+	return ss.leader
+}
+
+// factor returns the ring's replication factor.
+func (ss *storageServer) factor() int {
+	ss.ringLock.Lock()
+	defer ss.ringLock.Unlock()
+	return ss.replicationFactor
+}
+
+func (ss *storageServer) UnregisterServer(args *storagerpc.UnregisterArgs, reply *storagerpc.UnregisterReply) error {
+	if leader := ss.leaderHostPort(); leader != ss.hostPort {
+		return ss.call(leader, "StorageServer.UnregisterServer", args, reply)
+	}
+	ss.membershipLock.Lock()
+	defer ss.membershipLock.Unlock()
+	servers, _ := ss.ring()
+	if servers == nil {
+		reply.Status = storagerpc.NotReady
+		return nil
+	}
+	if args.ServerInfo.NodeID == ss.nodeID {
+		return errors.New("the leader cannot leave the ring")
+	}
+	var next []storagerpc.Node
+	for _, n := range servers {
+		if n.NodeID != args.ServerInfo.NodeID {
+			next = append(next, n)
+		}
+	}
+	if len(next) < len(servers) {
+		var failed []string
+		if args.Failed {
+			failed = []string{args.ServerInfo.HostPort}
+		}
+		if err := ss.changeRing(next, failed); err != nil {
+			return err
+		}
+	}
+	reply.Status = storagerpc.OK
+	return nil
+}
+
+// changeRing moves every node to a ring made up of servers, handing off keys
+// between nodes as needed. The nodes in failed (which must not be part of
+// servers) are not contacted, and their keys are handed off by their live
+// replicas instead. If any node fails to prepare, the change is aborted by
+// committing the old ring, whose keys are still held by the nodes that
+// stored them. The caller must hold the membership lock.
+func (ss *storageServer) changeRing(servers []storagerpc.Node, failed []string) error {
+	old, version := ss.ring()
+	factor := ss.factor()
+	servers = append([]storagerpc.Node(nil), servers...)
+	sortNodes(servers)
+
+	targets := make(map[string]bool)
+	for _, n := range old {
+		targets[n.HostPort] = true
+	}
+	for _, n := range servers {
+		targets[n.HostPort] = true
+	}
+	for _, hostPort := range failed {
+		delete(targets, hostPort)
+	}
+
+	args := &storagerpc.RingArgs{
+		Version:           version + 1,
+		Servers:           servers,
+		Leader:            ss.hostPort,
+		ReplicationFactor: factor,
+		Failed:            failed,
+	}
+	if err := ss.broadcast("StorageServer.PrepareRing", targets, args); err != nil {
+		// The abort leaves the leader unchanged, so that a node taking over
+		// from a failed leader does not become the leader.
+		abort := &storagerpc.RingArgs{Version: version + 1, Servers: old, ReplicationFactor: factor}
+		ss.broadcast("StorageServer.CommitRing", targets, abort)
+		return err
+	}
+	return ss.broadcast("StorageServer.CommitRing", targets, args)
+}
+
+// broadcastError reports that some storage servers failed a broadcast.
+type broadcastError struct {
+	err         error
+	unreachable []string // The servers that could not be reached, by host:port.
+}
+
+func (e *broadcastError) Error() string {
+	return e.err.Error()
+}
+
+// broadcast invokes method on each of the storage servers in targets in
+// parallel, returning once all have replied. If any fail, the error is a
+// *broadcastError.
+func (ss *storageServer) broadcast(method string, targets map[string]bool, args *storagerpc.RingArgs) error {
+	type result struct {
+		hostPort    string
+		err         error
+		unreachable bool
+	}
+	results := make(chan result, len(targets))
+	for hostPort := range targets {
+		go func(hostPort string) {
+			var reply storagerpc.RingReply
+			err := ss.call(hostPort, method, args, &reply)
+			_, served := err.(rpc.ServerError)
+			unreachable := err != nil && !served
+			if err == nil && reply.Status != storagerpc.OK {
+				err = fmt.Errorf("%s on %s replied with status %s", method, hostPort, reply.Status)
+			}
+			results <- result{hostPort, err, unreachable}
+		}(hostPort)
+	}
+	var bErr *broadcastError
+	for range targets {
+		r := <-results
+		if r.err == nil {
+			continue
+		}
+		if bErr == nil {
+			bErr = new(broadcastError)
+		}
+		bErr.err = r.err
+		if r.unreachable {
+			bErr.unreachable = append(bErr.unreachable, r.hostPort)
+		}
+	}
+	if bErr == nil {
+		return nil
+	}
+	return bErr
+}
+
+func (ss *storageServer) PrepareRing(args *storagerpc.RingArgs, reply *storagerpc.RingReply) error {
+	// Wait for in-flight writes to finish, so that none straddles the change.
+	ss.ringChange.Lock()
+	ss.ringLock.Lock()
+	old := ss.index
+	next := storagerpc.NewRing(args.Servers, args.ReplicationFactor)
+	ss.pending = next
+	ss.ringLock.Unlock()
+	ss.ringChange.Unlock()
+
+	if err := ss.handOff(old, next, args.Failed); err != nil {
+		return err
+	}
+	reply.Status = storagerpc.OK
+	return nil
+}
+
+// handOff revokes the leases on the keys this server stores whose replica
+// set differs between the old and new rings, and sends the keys for which
+// this server is the first live node of the old replica set (normally the
+// old primary) to the nodes that newly store them.
+func (ss *storageServer) handOff(old, next *storagerpc.Ring, failed []string) error {
+	if old == nil {
+		// This server is joining the ring, so it stores no keys yet.
+		return nil
+	}
+	ss.ringLock.Lock()
+	ss.dataLock.Lock()
+	// Recently deleted keys are handed off too, so that their versions are
+	// kept.
+	var moving []string
+	for key := range ss.versions {
+		if ss.movingLocked(key) {
+			moving = append(moving, key)
+		}
+	}
+	for key := range ss.deleted {
+		if ss.movingLocked(key) {
+			moving = append(moving, key)
+		}
+	}
+	ss.dataLock.Unlock()
+	ss.ringLock.Unlock()
+
+	done := make(chan struct{}, len(moving))
+	for _, key := range moving {
+		go func(key string) {
+			unlock := ss.lockKey(key)
+			ss.revokeLeases(key)
+			ss.dataLock.Lock()
+			delete(ss.leases, key)
+			ss.dataLock.Unlock()
+			unlock()
+			done <- struct{}{}
+		}(key)
+	}
+	for range moving {
+		<-done
+	}
+
+	transfers := make(map[string]*storagerpc.TransferArgs)
+	ss.dataLock.Lock()
+	for _, key := range moving {
+		before := replicaSet(old, key)
+		if source(before, failed) != ss.hostPort {
+			continue
+		}
+		for _, hostPort := range replicaSet(next, key) {
+			if containsString(before, hostPort) {
+				continue
+			}
+			t, ok := transfers[hostPort]
+			if !ok {
+				t = &storagerpc.TransferArgs{
+					Values:   make(map[string]string),
+					Lists:    make(map[string][]string),
+					Versions: make(map[string]uint64),
+					Expires:  make(map[string]int64),
+					Requests: make(map[string]storagerpc.RequestReply),
+				}
+				transfers[hostPort] = t
+			}
+			value, ok, err := ss.store.get(key)
+			if err != nil {
+				ss.dataLock.Unlock()
+				return err
+			}
+			if ok {
+				t.Values[key] = value
+			}
+			list, ok, err := ss.store.getList(key)
+			if err != nil {
+				ss.dataLock.Unlock()
+				return err
+			}
+			if ok {
+				t.Lists[key] = append([]string(nil), list...)
+			}
+			t.Versions[key] = ss.versions[key]
+			if d, ok := ss.deleted[key]; ok {
+				t.Versions[key] = d.Version
+			}
+			if expires, ok := ss.expires[key]; ok {
+				t.Expires[key] = expires
+			}
+		}
+	}
+	now := time.Now()
+	for requestID, done := range ss.requests {
+		if now.After(done.expires) {
+			continue
+		}
+		for _, t := range transfers {
+			if _, ok := t.Versions[done.key]; ok {
+				t.Requests[requestID] = storagerpc.RequestReply{Key: done.key, Reply: done.reply}
+			}
+		}
+	}
+	ss.dataLock.Unlock()
+
+	errs := make(chan error, len(transfers))
+	for hostPort, args := range transfers {
+		go func(hostPort string, args *storagerpc.TransferArgs) {
+			var reply storagerpc.TransferReply
+			err := ss.call(hostPort, "StorageServer.TransferKeys", args, &reply)
+			if err == nil && reply.Status != storagerpc.OK {
+				err = fmt.Errorf("TransferKeys on %s replied with status %s", hostPort, reply.Status)
+			}
+			errs <- err
+		}(hostPort, args)
+	}
+	var err error
+	for range transfers {
+		if e := <-errs; e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// source returns the first node of replicas that has not failed.
+func source(replicas, failed []string) string {
+	for _, hostPort := range replicas {
+		if !containsString(failed, hostPort) {
+			return hostPort
+		}
+	}
+	return ""
+}
+
+func (ss *storageServer) TransferKeys(args *storagerpc.TransferArgs, reply *storagerpc.TransferReply) error {
+	for key := range args.Versions {
+		if err := ss.storeTransferred(key, args); err != nil {
+			return err
+		}
+	}
+	for requestID, r := range args.Requests {
+		ss.rememberRequest(requestID, r.Key, &r.Reply, nil)
+	}
+	reply.Status = storagerpc.OK
+	return nil
+}
+
+// storeTransferred replaces key's value and list with those in args, which
+// are both missing if the key was deleted.
+func (ss *storageServer) storeTransferred(key string, args *storagerpc.TransferArgs) error {
+	unlock := ss.lockKey(key)
+	defer unlock()
+	ss.revokeLeases(key)
+	version, expires := args.Versions[key], args.Expires[key]
+	recs := []*logRecord{{Op: storagerpc.OpDelete, Key: key, Version: version}}
+	if value, ok := args.Values[key]; ok {
+		recs = append(recs, &logRecord{Op: storagerpc.OpPut, Key: key, Value: value, Version: version, Expires: expires})
+	}
+	for _, item := range args.Lists[key] {
+		recs = append(recs, &logRecord{Op: storagerpc.OpAppendToList, Key: key, Value: item, Version: version, Expires: expires})
+	}
+	for _, rec := range recs {
+		if err := ss.commit(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ss *storageServer) CommitRing(args *storagerpc.RingArgs, reply *storagerpc.RingReply) error {
+	ss.ringChange.Lock()
+	defer ss.ringChange.Unlock()
+	ss.ringLock.Lock()
+	ss.pending = nil
+	// The leader takes over itself only once every node has committed.
+	if args.Leader != "" && args.Leader != ss.hostPort {
+		ss.leader = args.Leader
+	}
+	ss.replicationFactor = args.ReplicationFactor
+	ss.setServersLocked(args.Servers, args.Version)
+	index := ss.index
+	ss.ringLock.Unlock()
+
+	// Discard the keys that this server no longer stores.
+	ss.dataLock.Lock()
+	var stale []string
+	for _, key := range ss.store.scan("") {
+		if !containsString(replicaSet(index, key), ss.hostPort) {
+			stale = append(stale, key)
+		}
+	}
+	ss.dataLock.Unlock()
+	for _, key := range stale {
+		unlock := ss.lockKey(key)
+		err := ss.commit(&logRecord{Op: storagerpc.OpDelete, Key: key})
+		unlock()
+		if err != nil {
+			return err
+		}
+	}
+	// Forget the versions of the keys that this server no longer stores,
+	// which their new replicas were handed.
+	ss.dataLock.Lock()
+	for key := range ss.versions {
+		if !containsString(replicaSet(index, key), ss.hostPort) {
+			delete(ss.versions, key)
+		}
+	}
+	for key := range ss.deleted {
+		if !containsString(replicaSet(index, key), ss.hostPort) {
+			delete(ss.deleted, key)
+		}
+	}
+	ss.dataLock.Unlock()
+	reply.Status = storagerpc.OK
+	return nil
+}
+
+func (ss *storageServer) Leave() error {
+	leader := ss.leaderHostPort()
+	if leader == ss.hostPort {
+		return errors.New("the leader cannot leave the ring")
+	}
+	args := &storagerpc.UnregisterArgs{ServerInfo: storagerpc.Node{HostPort: ss.hostPort, NodeID: ss.nodeID}}
+	var reply storagerpc.UnregisterReply
+	if err := ss.call(leader, "StorageServer.UnregisterServer", args, &reply); err != nil {
+		return err
+	}
+	if reply.Status != storagerpc.OK {
+		return fmt.Errorf("UnregisterServer replied with status %s", reply.Status)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package storageserver
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cmu440/tribbler/rpc/storagerpc"
+)
+
+// A write is acknowledged only once every replica of its key has applied it,
+// so that a replica never serves a value older than an acknowledged write,
+// and never holds leases on it. A replica that fails to apply a write (or
+// does not reply within replicateTimeout) is removed from the ring, as if it
+// had failed, and the write is not acknowledged: the primary has made it, but
+// the client must wait for the ring to change before it can tell. A write
+// resent under the same request ID is acknowledged once no failed replica
+// remains in the key's replica set.
+//
+// Removing a replica changes the ring, which waits for writes in progress, so
+// the removal is left to run in the background rather than awaited.
+
+const replicateTimeout = 2 * time.Second // How long a replica may take to apply a write.
+
+// replicaError reports that a write was made by the primary but not applied
+// by some of the key's replicas.
+type replicaError struct {
+	key     string
+	version uint64   // The version the write was given, if any.
+	failed  []string // The replicas that failed to apply the write, by host:port.
+}
+
+func (e *replicaError) Error() string {
+	return fmt.Sprintf("replicas %s failed to apply a write to %s", strings.Join(e.failed, ", "), e.key)
+}
+
+// write commits rec locally and then forwards it to the key's replicas,
+// returning once every replica has applied it. The key's new version is
+// stored in version. If some replicas fail, they are evicted from the ring
+// and a *replicaError is returned. The caller must hold the key's write lock,
+// so that replicas apply a key's writes in order.
+func (ss *storageServer) write(rec *logRecord, version *uint64) error {
+	if err := ss.commit(rec); err != nil {
+		return err
+	}
+	*version = rec.Version
+	ss.notifyWatchers(rec)
+	var (
+		wg     sync.WaitGroup
+		lock   sync.Mutex
+		failed []string
+	)
+	for _, hostPort := range ss.replicasOf(rec.Key) {
+		wg.Add(1)
+		go func(hostPort string) {
+			defer wg.Done()
+			if err := ss.replicate(hostPort, rec); err != nil {
+				log.Printf("Replica %s failed to apply a write to %s: %s", hostPort, rec.Key, err)
+				lock.Lock()
+				failed = append(failed, hostPort)
+				lock.Unlock()
+			}
+		}(hostPort)
+	}
+	wg.Wait()
+	if len(failed) > 0 {
+		ss.evict(failed)
+		return &replicaError{key: rec.Key, version: rec.Version, failed: failed}
+	}
+	return nil
+}
+
+// replicate forwards rec to the replica at hostPort.
+func (ss *storageServer) replicate(hostPort string, rec *logRecord) error {
+	args := &storagerpc.ReplicateArgs{Op: rec.Op, Key: rec.Key, Value: rec.Value, Version: rec.Version, Expires: rec.Expires}
+	if rec.requestID != "" {
+		args.RequestID = rec.requestID
+		args.Reply = storagerpc.PutReply{Status: storagerpc.OK, Version: rec.Version}
+	}
+	var reply storagerpc.ReplicateReply
+	if err := ss.callTimeout(hostPort, "StorageServer.Replicate", args, &reply, replicateTimeout); err != nil {
+		return err
+	}
+	if reply.Status != storagerpc.OK {
+		return fmt.Errorf("replica %s replied with status %s", hostPort, reply.Status)
+	}
+	return nil
+}
+
+// evict removes the replicas at the given host:ports from the ring in the
+// background, unless their removal is already under way.
+func (ss *storageServer) evict(hostPorts []string) {
+	servers, _ := ss.ring()
+	ss.evictLock.Lock()
+	defer ss.evictLock.Unlock()
+	for _, n := range servers {
+		if containsString(hostPorts, n.HostPort) && !ss.evicting[n.HostPort] {
+			ss.evicting[n.HostPort] = true
+			go ss.removeReplica(n)
+		}
+	}
+}
+
+// removeReplica asks the ring's leader to remove the failed node n.
+func (ss *storageServer) removeReplica(n storagerpc.Node) {
+	defer func() {
+		ss.evictLock.Lock()
+		delete(ss.evicting, n.HostPort)
+		ss.evictLock.Unlock()
+	}()
+	var reply storagerpc.UnregisterReply
+	err := ss.UnregisterServer(&storagerpc.UnregisterArgs{ServerInfo: n, Failed: true}, &reply)
+	if err == nil && reply.Status != storagerpc.OK {
+		err = fmt.Errorf("leader replied with status %s", reply.Status)
+	}
+	if err != nil {
+		log.Printf("Failed to remove replica %s from the ring: %s", n.HostPort, err)
+	}
+}
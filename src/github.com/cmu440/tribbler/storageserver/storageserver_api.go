@@ -4,17 +4,32 @@ package storageserver
 
 import "github.com/cmu440/tribbler/rpc/storagerpc"
 
-// StorageServer defines the set of methods that can be invoked remotely via RPCs.
+// StorageServer defines the set of methods that can be invoked remotely via RPCs
+// (with the exception of Leave).
 type StorageServer interface {
 
 	// RegisterServer adds a storage server to the ring. It replies with
 	// status NotReady if not all nodes in the ring have joined. Once
 	// all nodes have joined, it should reply with status OK and a list
-	// of all connected nodes in the ring.
+	// of all connected nodes in the ring. A server that registers after
+	// the ring is complete joins the running ring: the reply is sent once
+	// its range has been handed off to it. Once the ring is complete, any
+	// node accepts registrations and forwards them to the ring's leader.
 	RegisterServer(*storagerpc.RegisterArgs, *storagerpc.RegisterReply) error
 
+	// UnregisterServer removes a storage server from the ring, handing off
+	// its range to the remaining nodes. It replies with status NotReady if
+	// not all nodes in the ring have joined. Nodes other than the ring's
+	// leader forward the request to the leader. If UnregisterArgs.Failed is
+	// set, the server is not contacted, and its range is handed off by its
+	// replicas instead.
+	UnregisterServer(*storagerpc.UnregisterArgs, *storagerpc.UnregisterReply) error
+
 	// GetServers retrieves a list of all connected nodes in the ring. It
 	// replies with status NotReady if not all nodes in the ring have joined.
+	// Any node of the ring may be asked, not just the master.
+	// Each node lists the nodes that replicate its range, which may serve
+	// reads for the range if the node itself is unreachable.
 	GetServers(*storagerpc.GetServersArgs, *storagerpc.GetServersReply) error
 
 	// Get retrieves the specified key from the data store and replies with
@@ -22,6 +37,12 @@ type StorageServer interface {
 	// fall within the storage server's range, it should reply with status
 	// WrongServer. If the key is not found, it should reply with status
 	// KeyNotFound.
+	//
+	// How long a lease is valid for depends on how often the key is read and
+	// written: keys read often but rarely written are leased for up to
+	// MaxLeaseSeconds (or Options.MaxLeaseSeconds), while keys written often
+	// are leased briefly or not at all. Libstores must honor the lease's
+	// ValidSeconds.
 	Get(*storagerpc.GetArgs, *storagerpc.GetReply) error
 
 	// GetList retrieves the specified key from the data store and replies with
@@ -31,9 +52,53 @@ type StorageServer interface {
 	// KeyNotFound.
 	GetList(*storagerpc.GetArgs, *storagerpc.GetListReply) error
 
+	// GetListRange is like GetList, but replies with only the range of the
+	// list selected by GetListRangeArgs, along with the list's length.
+	// ListLength is like GetList, but replies with the list's length alone.
+	// Both grant leases on the key as GetList does, so that cached ranges
+	// and lengths are revoked when the list changes.
+	GetListRange(*storagerpc.GetListRangeArgs, *storagerpc.GetListRangeReply) error
+	ListLength(*storagerpc.GetArgs, *storagerpc.ListLengthReply) error
+
+	// MultiGet and MultiGetList perform a batch of Gets and GetLists, each
+	// of which is answered exactly as if it had been sent on its own. The
+	// batch as a whole replies with status OK.
+	MultiGet(*storagerpc.MultiGetArgs, *storagerpc.MultiGetReply) error
+	MultiGetList(*storagerpc.MultiGetArgs, *storagerpc.MultiGetListReply) error
+
+	// ScanPrefix replies with a page of the keys (values or lists) that
+	// start with the specified prefix and fall within the range of the node
+	// with ID ScanArgs.NodeID, which must be this server or a node that it
+	// replicates. Keys are returned in increasing order, starting after
+	// ScanArgs.Cursor; if more keys remain, the reply's Cursor is set to
+	// the cursor of the next page.
+	ScanPrefix(*storagerpc.ScanArgs, *storagerpc.ScanReply) error
+
 	// Put inserts the specified key/value pair into the data store. If
 	// the key does not fall within the storage server's range, it should
 	// reply with status WrongServer.
+	//
+	// Every key carries a version, which Get and GetList report and which
+	// increases with every write to the key (whether to its value or to its
+	// list), even across the key's expiry. If PutArgs.Version is non-zero, Put, AppendToList and
+	// RemoveFromList write only if it equals the key's current version, and
+	// otherwise reply with status PreconditionFailed and the current version.
+	//
+	// If PutArgs.TTL is positive, the key (value or list) expires that long
+	// after the write, after which it is reported as KeyNotFound. Put without
+	// a TTL makes the key permanent, while AppendToList and RemoveFromList
+	// without a TTL keep its current expiry. Get and GetList report the time
+	// left until the key expires.
+	//
+	// If PutArgs.RequestID is set, Put, AppendToList and RemoveFromList
+	// remember their reply for a while, and answer a write resent with the
+	// same RequestID with that reply instead of making the write again.
+	//
+	// A write is acknowledged only once every replica of the key has applied
+	// it. Should a replica fail to, the write (which the primary has made)
+	// is answered with status WrongServer if it carries a request ID, and
+	// fails otherwise; the replica is removed from the ring, and a resent
+	// write is acknowledged once it has been.
 	Put(*storagerpc.PutArgs, *storagerpc.PutReply) error
 
 	// AppendToList retrieves the specified key from the data store and appends
@@ -49,4 +114,121 @@ type StorageServer interface {
 	// the specified value is not already contained in the list, it should reply
 	// with status ItemNotFound.
 	RemoveFromList(*storagerpc.PutArgs, *storagerpc.PutReply) error
+
+	// TrimList removes the oldest items of the specified key's list, keeping
+	// its last TrimListArgs.Length items. If the key does not fall within the
+	// receiving server's range, it should reply with status WrongServer. If
+	// the key is not found, it should reply with status KeyNotFound. A list
+	// no longer than Length is left as it is. Trimming revokes the leases on
+	// the key, including write-through ones, and keeps the key's expiry. As
+	// with PutArgs, a resent TrimListArgs.RequestID is answered with the
+	// original reply.
+	TrimList(*storagerpc.TrimListArgs, *storagerpc.PutReply) error
+
+	// CompareAndSwap sets the value of the specified key to NewValue, but
+	// only if its current value is OldValue. If the key does not exist, it
+	// should reply with status KeyNotFound. If its value differs from
+	// OldValue, it should reply with status PreconditionFailed and the
+	// key's current value. As with Put, outstanding leases on the key are
+	// revoked before the new value is stored.
+	CompareAndSwap(*storagerpc.CompareAndSwapArgs, *storagerpc.CompareAndSwapReply) error
+
+	// Replicate applies a modification forwarded by the primary of the
+	// specified key's range. It is invoked only by other storage servers. If
+	// the receiving server does not replicate the key's range, it should
+	// reply with status WrongServer. If it missed an earlier write to the key
+	// (the modification's version is more than one past its own), it should
+	// reply with status NotReady.
+	Replicate(*storagerpc.ReplicateArgs, *storagerpc.ReplicateReply) error
+
+	// PrepareRing begins a change to the ring's membership. It is invoked
+	// only by the master. Until the change is committed, the receiving server
+	// replies with status WrongServer to requests for any key whose replica
+	// set differs between the two rings, and hands off the keys it stores as
+	// primary to the nodes that become responsible for them.
+	PrepareRing(*storagerpc.RingArgs, *storagerpc.RingReply) error
+
+	// CommitRing completes a change to the ring's membership. It is invoked
+	// only by the master. The receiving server switches to the new ring and
+	// discards the keys for which it is no longer responsible.
+	CommitRing(*storagerpc.RingArgs, *storagerpc.RingReply) error
+
+	// TransferKeys stores keys handed off by another storage server during a
+	// change to the ring's membership, replacing any existing values. Keys
+	// that were deleted recently are handed off by their versions alone.
+	TransferKeys(*storagerpc.TransferArgs, *storagerpc.TransferReply) error
+
+	// Heartbeat is invoked periodically by the ring's leader on every other
+	// node, passing along the liveness of each node. A node that stops
+	// receiving heartbeats assumes that the leader has failed. Heartbeats
+	// from any other node are rejected with status WrongServer, unless the
+	// sender's ring is newer, in which case the sender has taken over as
+	// leader. A former leader whose heartbeats are rejected in favor of a
+	// newer ring steps down.
+	Heartbeat(*storagerpc.HeartbeatArgs, *storagerpc.HeartbeatReply) error
+
+	// Elect is invoked by a storage server that has detected the failure of
+	// the ring's leader (initially the master) and whose NodeID is lower
+	// than the receiving server's. The receiving server replies with status
+	// OK and starts an election of its own, which the live node with the
+	// highest NodeID wins.
+	Elect(*storagerpc.ElectArgs, *storagerpc.ElectReply) error
+
+	// Transact applies a batch of writes to keys that may fall within the
+	// ranges of several nodes, either all or none of them. The receiving
+	// server must be the primary of the first key's range, and coordinates
+	// a two-phase commit among the primaries of all the keys. If a write
+	// cannot be made (e.g. because an item already exists in a list), it
+	// replies with that write's status. If another transaction holds one of
+	// the keys, it replies with status Locked.
+	Transact(*storagerpc.TransactArgs, *storagerpc.TransactReply) error
+
+	// PrepareTx locks the specified keys, which must fall within the
+	// receiving server's range, and checks that the transaction's writes to
+	// them can be made. If so, it revokes the keys' leases, durably records
+	// the writes, and replies with status OK, after which the writes are made
+	// only once CommitTx is invoked. A transaction that the receiving server
+	// already aborted is refused with status Locked. It is invoked only by
+	// coordinators.
+	PrepareTx(*storagerpc.TxArgs, *storagerpc.TxReply) error
+
+	// CommitTx and AbortTx complete a prepared transaction, making or
+	// discarding its writes and unlocking its keys. They are invoked only by
+	// coordinators.
+	CommitTx(*storagerpc.TxArgs, *storagerpc.TxReply) error
+	AbortTx(*storagerpc.TxArgs, *storagerpc.TxReply) error
+
+	// TxStatus replies with whether a transaction coordinated by the
+	// receiving server committed, or with status NotReady if it is still
+	// undecided. It is invoked by participants that have not heard the
+	// outcome of a transaction that they prepared. If TxArgs.Coordinator is
+	// another server, the receiving server is asked as a fellow participant:
+	// it replies with status NotReady if it is waiting for the outcome too,
+	// and otherwise with the outcome, first aborting the transaction if it
+	// never prepared it.
+	TxStatus(*storagerpc.TxArgs, *storagerpc.TxReply) error
+
+	// GetLeases lists the outstanding leases on the keys stored by the
+	// receiving server (or only on GetLeasesArgs.Key, if set), along with
+	// counts of the server's lease grants, revocations and writes blocked on
+	// revocations. It also lists the Libstores whose latest revocations timed
+	// out; those that time out repeatedly are denied leases for a while. It is
+	// meant for debugging and monitoring.
+	GetLeases(*storagerpc.GetLeasesArgs, *storagerpc.GetLeasesReply) error
+
+	// Watch registers the Libstore at WatchArgs.HostPort to be notified of
+	// the writes to WatchArgs.Key (or, if WatchArgs.Prefix is set, to every
+	// key that starts with it) through its KeyChanged callback. Each server
+	// notifies of the writes to the keys for which it is the primary, in the
+	// order they are made, and forgets watches once their Libstore stops
+	// answering or falls too far behind. Watches are kept in memory only, so
+	// Libstores renew them periodically and whenever the ring changes.
+	// Unwatch cancels a watch.
+	Watch(*storagerpc.WatchArgs, *storagerpc.WatchReply) error
+	Unwatch(*storagerpc.WatchArgs, *storagerpc.WatchReply) error
+
+	// Leave gracefully removes this storage server from the ring, returning
+	// once its range has been handed off to the remaining nodes. The leader
+	// cannot leave the ring. It is not invoked remotely.
+	Leave() error
 }
@@ -1,13 +1,135 @@
 package storageserver
 
 import (
-	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/rpc"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/cmu440/tribbler/libstore"
 	"github.com/cmu440/tribbler/rpc/storagerpc"
 )
 
+// Options holds optional settings for a storage server. The zero value
+// describes a purely in-memory server.
+type Options struct {
+	// DataDir is the directory in which the server keeps its write-ahead log
+	// and snapshots. If empty, data is kept only in memory.
+	DataDir string
+
+	// ReplicationFactor is the number of nodes that store each key: the
+	// primary of the key's range and the nodes owning the next
+	// ReplicationFactor-1 distinct nodes' points clockwise on the ring.
+	// Values less than 2 disable replication. Only the master's setting is
+	// used, since the master passes it on to every node.
+	ReplicationFactor int
+
+	// SuspectAfter and DeadAfter are the numbers of heartbeats in a row that
+	// a node must miss to be reported as Suspect and Dead, respectively.
+	// The leader removes Dead nodes from the ring. Zero values select
+	// defaults. Only the leader's settings are used.
+	SuspectAfter int
+	DeadAfter    int
+
+	// VirtualNodes is the number of points of the ring that the server owns,
+	// including its NodeID. Owning many points spreads the server's share of
+	// the keys evenly around the ring. Values less than 2 give the server a
+	// single point.
+	VirtualNodes int
+
+	// Engine selects how the server stores its values and lists. The zero
+	// value selects MemoryEngine. Whichever engine is used, the data survives
+	// restarts only if DataDir is set.
+	Engine Engine
+
+	// MaxLeaseSeconds caps how long a lease remains valid; keys read often
+	// but rarely written are leased for this long. If zero,
+	// storagerpc.MaxLeaseSeconds is used. A write to a leased key may wait
+	// for this long (plus storagerpc.LeaseGuardSeconds), so Libstores'
+	// timeouts should be longer.
+	MaxLeaseSeconds int
+}
+
+// leaseState tracks the outstanding leases for a single key.
+type leaseState struct {
+	holders  map[string]leaseGrant // By Libstore callback host:port.
+	revoking bool                  // Whether a write is revoking the key's leases.
+}
+
+// leaseGrant records when a lease was granted and when it expires.
+type leaseGrant struct {
+	granted      time.Time
+	expires      time.Time
+	writeThrough bool // Whether writes are pushed to the holder rather than revoking the lease.
+}
+
 type storageServer struct {
-	// TODO: implement this!
+	nodeID            uint32
+	hostPort          string
+	numNodes          int
+	replicationFactor int
+	suspectAfter      int
+	deadAfter         int
+	maxLeaseSeconds   int
+
+	membershipLock sync.Mutex   // Serializes changes to the ring's membership (leader only).
+	ringChange     sync.RWMutex // Held for reading by writes, and for writing while switching rings.
+
+	ringLock  sync.Mutex
+	leader    string                         // Host:port of the node coordinating membership (initially the master).
+	electing  bool                           // Whether this server is running a leader election.
+	lastBeat  time.Time                      // When the latest heartbeat from the leader arrived.
+	missed    map[string]int                 // Heartbeats missed in a row by host:port (leader only).
+	liveness  map[string]storagerpc.Liveness // Liveness of each node, as last reported by the leader (non-leaders only).
+	nodes     map[uint32]storagerpc.Node     // Nodes that have registered (master only).
+	servers   []storagerpc.Node              // All nodes sorted by NodeID, or nil if not ready.
+	index     *storagerpc.Ring               // Index of servers' points.
+	version   uint64                         // Version of servers.
+	pending   *storagerpc.Ring               // Index of the ring being changed to, or nil.
+	ready     chan struct{}                  // Closed once all nodes have joined the ring.
+	readyOnce sync.Once
+
+	dataLock   sync.Mutex
+	store      engine                // Values and lists.
+	versions   map[string]uint64     // Version of each stored key's latest write.
+	deleted    map[string]deletedKey // Versions of keys deleted within deletedTTL.
+	expires    map[string]int64      // When each expiring key expires, in Unix nanoseconds.
+	leases     map[string]*leaseState
+	leaseStats storagerpc.LeaseStats
+	slow       map[string]*slowHolder // Libstores whose latest revocations timed out, by callback host:port.
+	rates      map[string]*keyRate    // Recent reads and writes of each key.
+	keyLocks   map[string]*sync.Mutex // Serializes writers of each key.
+	wal        *writeAheadLog         // Nil unless the server is durable.
+
+	evictLock sync.Mutex
+	evicting  map[string]bool // Replicas being removed from the ring after missing a write, by host:port.
+
+	requests      map[string]doneRequest // Replies to recent writes, by request ID.
+	requestsSwept time.Time              // When expired replies were last discarded.
+
+	watchLock sync.Mutex
+	watchers  map[string]*watcher // Watches by Libstore host:port.
+
+	txLock    sync.Mutex             // Serializes preparing transactions with aborting those not prepared.
+	prepared  map[string]*preparedTx // Transactions prepared but not yet completed, by ID.
+	completed map[string]completedTx // Outcomes of transactions completed within txOutcomeTTL, by ID.
+	committed map[string][]string    // Transactions coordinated by this server that committed, by ID, with the participants yet to acknowledge them.
+	active    map[string]bool        // Transactions that this server is coordinating.
+	txSeq     uint64                 // Number of transactions this server has coordinated.
+
+	// Writes are held until this time so that leases granted before a
+	// restart have expired (zero if no leases had been granted).
+	recoveryLeaseDeadline time.Time
+	leaseHorizon          int64 // When every lease granted so far expires, in Unix nanoseconds (durable servers only).
+
+	clientsLock sync.Mutex
+	clients     map[string]*rpc.Client // Connections to storage servers and libstores by host:port.
 }
 
 // NewStorageServer creates and starts a new StorageServer. masterServerHostPort
@@ -19,33 +141,851 @@ type storageServer struct {
 // This function should return only once all storage servers have joined the ring,
 // and should return a non-nil error if the storage server could not be started.
 func NewStorageServer(masterServerHostPort string, numNodes, port int, nodeID uint32) (StorageServer, error) {
-	return nil, errors.New("not implemented")
+	return NewStorageServerWithOptions(masterServerHostPort, numNodes, port, nodeID, Options{})
+}
+
+// NewStorageServerWithOptions is like NewStorageServer, but additionally accepts
+// a set of optional settings. If opts.DataDir is non-empty, the server replays
+// any data persisted there before joining the ring, and persists every
+// subsequent modification before acknowledging it.
+func NewStorageServerWithOptions(masterServerHostPort string, numNodes, port int, nodeID uint32, opts Options) (StorageServer, error) {
+	ss := &storageServer{
+		nodeID:            nodeID,
+		leader:            masterServerHostPort,
+		numNodes:          numNodes,
+		replicationFactor: opts.ReplicationFactor,
+		suspectAfter:      opts.SuspectAfter,
+		deadAfter:         opts.DeadAfter,
+		maxLeaseSeconds:   opts.MaxLeaseSeconds,
+		nodes:             make(map[uint32]storagerpc.Node),
+		missed:            make(map[string]int),
+		ready:             make(chan struct{}),
+		versions:          make(map[string]uint64),
+		deleted:           make(map[string]deletedKey),
+		expires:           make(map[string]int64),
+		leases:            make(map[string]*leaseState),
+		slow:              make(map[string]*slowHolder),
+		rates:             make(map[string]*keyRate),
+		evicting:          make(map[string]bool),
+		requests:          make(map[string]doneRequest),
+		watchers:          make(map[string]*watcher),
+		keyLocks:          make(map[string]*sync.Mutex),
+		prepared:          make(map[string]*preparedTx),
+		completed:         make(map[string]completedTx),
+		committed:         make(map[string][]string),
+		active:            make(map[string]bool),
+		clients:           make(map[string]*rpc.Client),
+	}
+
+	if ss.suspectAfter <= 0 {
+		ss.suspectAfter = defaultSuspectAfter
+	}
+	if ss.maxLeaseSeconds <= 0 {
+		ss.maxLeaseSeconds = storagerpc.MaxLeaseSeconds
+	}
+	if ss.deadAfter <= 0 {
+		ss.deadAfter = defaultDeadAfter
+	}
+
+	store, err := newEngine(opts)
+	if err != nil {
+		return nil, err
+	}
+	ss.store = store
+
+	// Recover persisted data before serving any requests.
+	if opts.DataDir != "" {
+		if err := ss.recover(opts.DataDir); err != nil {
+			return nil, err
+		}
+		ss.resumeTxs()
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	_, listenPort, _ := net.SplitHostPort(listener.Addr().String())
+	ss.hostPort = net.JoinHostPort("localhost", listenPort)
+	if masterServerHostPort == "" {
+		ss.leader = ss.hostPort
+	}
+
+	if err := rpc.RegisterName("StorageServer", storagerpc.Wrap(ss)); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	rpc.HandleHTTP()
+	go http.Serve(listener, nil)
+
+	self := storagerpc.Node{HostPort: ss.hostPort, NodeID: nodeID, VirtualIDs: VirtualIDs(nodeID, opts.VirtualNodes)}
+	if masterServerHostPort == "" {
+		ss.addNode(self)
+	} else if err := ss.joinRing(masterServerHostPort, self); err != nil {
+		return nil, err
+	}
+
+	// Wait until all nodes have joined the ring.
+	<-ss.ready
+	go ss.sendHeartbeats()
+	go ss.monitorLeader()
+	go ss.expireKeys()
+	go ss.pruneRates()
+	go ss.confirmTxs()
+	return ss, nil
+}
+
+// joinRing registers this slave with the master, retrying once per second
+// until the master is reachable and all nodes have joined.
+func (ss *storageServer) joinRing(masterServerHostPort string, self storagerpc.Node) error {
+	var master *rpc.Client
+	for {
+		var err error
+		if master, err = rpc.DialHTTP("tcp", masterServerHostPort); err == nil {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	defer master.Close()
+
+	args := &storagerpc.RegisterArgs{ServerInfo: self}
+	for {
+		var reply storagerpc.RegisterReply
+		if err := master.Call("StorageServer.RegisterServer", args, &reply); err != nil {
+			return err
+		}
+		if reply.Status == storagerpc.OK {
+			ss.ringLock.Lock()
+			if reply.Leader != "" {
+				ss.leader = reply.Leader
+			}
+			ss.replicationFactor = reply.ReplicationFactor
+			ss.setServersLocked(reply.Servers, reply.Version)
+			ss.ringLock.Unlock()
+			return nil
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// addNode records that node has joined the initial ring. Once numNodes nodes
+// have joined, the ring becomes ready. Returns the ring and its version, or
+// nil if not yet ready.
+func (ss *storageServer) addNode(node storagerpc.Node) ([]storagerpc.Node, uint64) {
+	ss.ringLock.Lock()
+	defer ss.ringLock.Unlock()
+	if ss.servers != nil {
+		return ss.servers, ss.version
+	}
+	ss.nodes[node.NodeID] = node
+	if len(ss.nodes) < ss.numNodes {
+		return nil, 0
+	}
+	servers := make([]storagerpc.Node, 0, len(ss.nodes))
+	for _, n := range ss.nodes {
+		servers = append(servers, n)
+	}
+	ss.setServersLocked(servers, 1)
+	return ss.servers, ss.version
+}
+
+// ring returns the current ring and its version.
+func (ss *storageServer) ring() ([]storagerpc.Node, uint64) {
+	ss.ringLock.Lock()
+	defer ss.ringLock.Unlock()
+	return ss.servers, ss.version
+}
+
+func sortNodes(servers []storagerpc.Node) {
+	sort.Slice(servers, func(i, j int) bool { return servers[i].NodeID < servers[j].NodeID })
+}
+
+func (ss *storageServer) setServersLocked(servers []storagerpc.Node, version uint64) {
+	if version < ss.version {
+		return
+	}
+	sortNodes(servers)
+	ss.servers = servers
+	ss.index = storagerpc.NewRing(servers, ss.replicationFactor)
+	ss.version = version
+	ss.readyOnce.Do(func() { close(ss.ready) })
+}
+
+// keyHash hashes the portion of key preceding the first colon, so that all
+// of a user's keys are stored on the same node.
+func keyHash(key string) uint32 {
+	return libstore.StoreHash(strings.SplitN(key, ":", 2)[0])
+}
+
+// ownerOf returns the node of ring whose range contains key.
+func ownerOf(ring *storagerpc.Ring, key string) storagerpc.Node {
+	return ring.Owner(keyHash(key))
+}
+
+// VirtualIDs returns the n-1 points of the ring, in addition to nodeID
+// itself, that a storage server with n virtual nodes owns. The points are
+// derived from nodeID, so a restarted server owns the same ranges as before.
+func VirtualIDs(nodeID uint32, n int) []uint32 {
+	var ids []uint32
+	for i := 1; i < n; i++ {
+		// Scramble (nodeID, i) with MurmurHash3's 64-bit finalizer, whose
+		// output is far more uniform than StoreHash's for similar inputs.
+		x := uint64(nodeID)<<32 | uint64(i)
+		x ^= x >> 33
+		x *= 0xff51afd7ed558ccd
+		x ^= x >> 33
+		x *= 0xc4ceb9fe1a85ec53
+		x ^= x >> 33
+		ids = append(ids, uint32(x))
+	}
+	return ids
+}
+
+// replicaSet returns the host:ports of the nodes of ring that store key: the
+// primary of the key's range followed by its replicas.
+func replicaSet(ring *storagerpc.Ring, key string) []string {
+	return ring.ReplicaSet(keyHash(key))
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// movingLocked reports whether key is stored by a different set of nodes
+// under the pending ring than under the current one.
+func (ss *storageServer) movingLocked(key string) bool {
+	if ss.pending == nil {
+		return false
+	}
+	current, next := replicaSet(ss.index, key), replicaSet(ss.pending, key)
+	if len(current) != len(next) {
+		return true
+	}
+	for _, hostPort := range current {
+		if !containsString(next, hostPort) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkKey replies with status OK if this server stores key, i.e. if key
+// falls within this server's range or within a range that it replicates.
+// Keys that are moving between nodes are not served until the move completes.
+func (ss *storageServer) checkKey(key string) storagerpc.Status {
+	ss.ringLock.Lock()
+	defer ss.ringLock.Unlock()
+	if ss.servers == nil {
+		return storagerpc.NotReady
+	}
+	if ss.movingLocked(key) || !containsString(replicaSet(ss.index, key), ss.hostPort) {
+		return storagerpc.WrongServer
+	}
+	return storagerpc.OK
+}
+
+// checkPrimary replies with status OK if key falls within this server's
+// range. Only a key's primary accepts writes from Libstores.
+func (ss *storageServer) checkPrimary(key string) storagerpc.Status {
+	ss.ringLock.Lock()
+	defer ss.ringLock.Unlock()
+	if ss.servers == nil {
+		return storagerpc.NotReady
+	}
+	if ss.movingLocked(key) || ownerOf(ss.index, key).HostPort != ss.hostPort {
+		return storagerpc.WrongServer
+	}
+	return storagerpc.OK
+}
+
+// checkReplica replies with status OK if this server stores key under either
+// the current ring or the pending ring (if any).
+func (ss *storageServer) checkReplica(key string) storagerpc.Status {
+	ss.ringLock.Lock()
+	defer ss.ringLock.Unlock()
+	if ss.servers == nil {
+		return storagerpc.NotReady
+	}
+	if containsString(replicaSet(ss.index, key), ss.hostPort) {
+		return storagerpc.OK
+	}
+	if ss.pending != nil && containsString(replicaSet(ss.pending, key), ss.hostPort) {
+		return storagerpc.OK
+	}
+	return storagerpc.WrongServer
+}
+
+// replicasOf returns the host:ports of the nodes that replicate key.
+func (ss *storageServer) replicasOf(key string) []string {
+	ss.ringLock.Lock()
+	defer ss.ringLock.Unlock()
+	return replicaSet(ss.index, key)[1:]
 }
 
 func (ss *storageServer) RegisterServer(args *storagerpc.RegisterArgs, reply *storagerpc.RegisterReply) error {
-	return errors.New("not implemented")
+	if leader := ss.leaderHostPort(); leader != ss.hostPort {
+		return ss.call(leader, "StorageServer.RegisterServer", args, reply)
+	}
+	ss.membershipLock.Lock()
+	defer ss.membershipLock.Unlock()
+	servers, version := ss.ring()
+	if servers == nil {
+		servers, version = ss.addNode(args.ServerInfo)
+	} else if !containsNode(servers, args.ServerInfo.NodeID) {
+		// A late joiner: hand off its range before replying.
+		next := append(servers[:len(servers):len(servers)], args.ServerInfo)
+		if err := ss.changeRing(next, nil); err != nil {
+			return err
+		}
+		servers, version = ss.ring()
+	}
+	if servers != nil {
+		reply.Status = storagerpc.OK
+		reply.Servers = servers
+		reply.Version = version
+		reply.Leader = ss.hostPort
+		reply.ReplicationFactor = ss.factor()
+	} else {
+		reply.Status = storagerpc.NotReady
+	}
+	return nil
 }
 
 func (ss *storageServer) GetServers(args *storagerpc.GetServersArgs, reply *storagerpc.GetServersReply) error {
-	return errors.New("not implemented")
+	ss.ringLock.Lock()
+	defer ss.ringLock.Unlock()
+	if ss.servers != nil {
+		reply.Status = storagerpc.OK
+		reply.Servers = ss.servers
+		reply.Version = ss.version
+		reply.Liveness = ss.livenessLocked()
+		reply.ReplicationFactor = ss.replicationFactor
+	} else {
+		reply.Status = storagerpc.NotReady
+	}
+	return nil
 }
 
 func (ss *storageServer) Get(args *storagerpc.GetArgs, reply *storagerpc.GetReply) error {
-	return errors.New("not implemented")
+	if reply.Status = ss.checkKey(args.Key); reply.Status != storagerpc.OK {
+		return nil
+	}
+	ss.dataLock.Lock()
+	defer ss.dataLock.Unlock()
+	value, ok, err := ss.store.get(args.Key)
+	if err != nil {
+		return err
+	}
+	if !ok || ss.expiredLocked(args.Key) {
+		reply.Status = storagerpc.KeyNotFound
+		reply.Version = ss.lastVersionLocked(args.Key)
+		return nil
+	}
+	ss.recordReadLocked(args.Key)
+	reply.Value = value
+	reply.Version = ss.versions[args.Key]
+	reply.TTL = ss.ttlLocked(args.Key)
+	if args.WantLease {
+		reply.Lease = ss.grantLeaseLocked(args.Key, args.HostPort, args.WriteThrough)
+	}
+	return nil
 }
 
 func (ss *storageServer) GetList(args *storagerpc.GetArgs, reply *storagerpc.GetListReply) error {
-	return errors.New("not implemented")
+	if reply.Status = ss.checkKey(args.Key); reply.Status != storagerpc.OK {
+		return nil
+	}
+	ss.dataLock.Lock()
+	defer ss.dataLock.Unlock()
+	list, ok, err := ss.store.getList(args.Key)
+	if err != nil {
+		return err
+	}
+	if !ok || ss.expiredLocked(args.Key) {
+		reply.Status = storagerpc.KeyNotFound
+		reply.Version = ss.lastVersionLocked(args.Key)
+		return nil
+	}
+	ss.recordReadLocked(args.Key)
+	reply.Value = append([]string(nil), list...)
+	reply.Version = ss.versions[args.Key]
+	reply.TTL = ss.ttlLocked(args.Key)
+	if args.WantLease {
+		reply.Lease = ss.grantLeaseLocked(args.Key, args.HostPort, args.WriteThrough)
+	}
+	return nil
+}
+
+func (ss *storageServer) MultiGet(args *storagerpc.MultiGetArgs, reply *storagerpc.MultiGetReply) error {
+	reply.Status = storagerpc.OK
+	reply.Replies = make([]storagerpc.GetReply, len(args.Args))
+	for i := range args.Args {
+		if err := ss.Get(&args.Args[i], &reply.Replies[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ss *storageServer) MultiGetList(args *storagerpc.MultiGetArgs, reply *storagerpc.MultiGetListReply) error {
+	reply.Status = storagerpc.OK
+	reply.Replies = make([]storagerpc.GetListReply, len(args.Args))
+	for i := range args.Args {
+		if err := ss.GetList(&args.Args[i], &reply.Replies[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ss *storageServer) ScanPrefix(args *storagerpc.ScanArgs, reply *storagerpc.ScanReply) error {
+	ss.ringLock.Lock()
+	defer ss.ringLock.Unlock()
+	if ss.servers == nil {
+		reply.Status = storagerpc.NotReady
+		return nil
+	}
+	ss.dataLock.Lock()
+	var keys []string
+	for _, key := range ss.store.scan(args.Prefix) {
+		if key <= args.Cursor || ss.expiredLocked(key) {
+			continue
+		}
+		if ownerOf(ss.index, key).NodeID == args.NodeID && containsString(replicaSet(ss.index, key), ss.hostPort) {
+			keys = append(keys, key)
+		}
+	}
+	ss.dataLock.Unlock()
+	sort.Strings(keys)
+	if args.Limit > 0 && len(keys) > args.Limit {
+		keys = keys[:args.Limit]
+		reply.Cursor = keys[len(keys)-1]
+	}
+	reply.Status = storagerpc.OK
+	reply.Keys = keys
+	return nil
+}
+
+func (ss *storageServer) Put(args *storagerpc.PutArgs, reply *storagerpc.PutReply) (err error) {
+	ss.ringChange.RLock()
+	defer ss.ringChange.RUnlock()
+	if reply.Status = ss.checkPrimary(args.Key); reply.Status != storagerpc.OK {
+		return nil
+	}
+	unlock := ss.lockKey(args.Key)
+	defer unlock()
+	if ss.replayRequest(args.RequestID, reply) {
+		return nil
+	}
+	defer func() {
+		err = ss.settleRequest(args.RequestID, args.Key, reply, err)
+	}()
+	if err := ss.expire(args.Key); err != nil {
+		return err
+	}
+	if reply.Status, reply.Version = ss.checkVersion(args.Key, args.Version); reply.Status != storagerpc.OK {
+		return nil
+	}
+	expires := ss.expiresAt(args.Key, args.TTL, false)
+	return ss.writeThrough(&logRecord{Op: storagerpc.OpPut, Key: args.Key, Value: args.Value, Expires: expires, requestID: args.RequestID}, &reply.Version)
+}
+
+func (ss *storageServer) AppendToList(args *storagerpc.PutArgs, reply *storagerpc.PutReply) (err error) {
+	ss.ringChange.RLock()
+	defer ss.ringChange.RUnlock()
+	if reply.Status = ss.checkPrimary(args.Key); reply.Status != storagerpc.OK {
+		return nil
+	}
+	unlock := ss.lockKey(args.Key)
+	defer unlock()
+	if ss.replayRequest(args.RequestID, reply) {
+		return nil
+	}
+	defer func() {
+		err = ss.settleRequest(args.RequestID, args.Key, reply, err)
+	}()
+	if err := ss.expire(args.Key); err != nil {
+		return err
+	}
+	if reply.Status, reply.Version = ss.checkVersion(args.Key, args.Version); reply.Status != storagerpc.OK {
+		return nil
+	}
+	if found, err := ss.listContains(args.Key, args.Value); err != nil {
+		return err
+	} else if found {
+		reply.Status = storagerpc.ItemExists
+		return nil
+	}
+	expires := ss.expiresAt(args.Key, args.TTL, true)
+	return ss.writeThrough(&logRecord{Op: storagerpc.OpAppendToList, Key: args.Key, Value: args.Value, Expires: expires, requestID: args.RequestID}, &reply.Version)
+}
+
+func (ss *storageServer) RemoveFromList(args *storagerpc.PutArgs, reply *storagerpc.PutReply) (err error) {
+	ss.ringChange.RLock()
+	defer ss.ringChange.RUnlock()
+	if reply.Status = ss.checkPrimary(args.Key); reply.Status != storagerpc.OK {
+		return nil
+	}
+	unlock := ss.lockKey(args.Key)
+	defer unlock()
+	if ss.replayRequest(args.RequestID, reply) {
+		return nil
+	}
+	defer func() {
+		err = ss.settleRequest(args.RequestID, args.Key, reply, err)
+	}()
+	if err := ss.expire(args.Key); err != nil {
+		return err
+	}
+	if reply.Status, reply.Version = ss.checkVersion(args.Key, args.Version); reply.Status != storagerpc.OK {
+		return nil
+	}
+	if found, err := ss.listContains(args.Key, args.Value); err != nil {
+		return err
+	} else if !found {
+		reply.Status = storagerpc.ItemNotFound
+		return nil
+	}
+	expires := ss.expiresAt(args.Key, args.TTL, true)
+	return ss.writeThrough(&logRecord{Op: storagerpc.OpRemoveFromList, Key: args.Key, Value: args.Value, Expires: expires, requestID: args.RequestID}, &reply.Version)
+}
+
+func (ss *storageServer) CompareAndSwap(args *storagerpc.CompareAndSwapArgs, reply *storagerpc.CompareAndSwapReply) error {
+	ss.ringChange.RLock()
+	defer ss.ringChange.RUnlock()
+	if reply.Status = ss.checkPrimary(args.Key); reply.Status != storagerpc.OK {
+		return nil
+	}
+	// Holding the key's write lock makes the comparison and the write atomic.
+	unlock := ss.lockKey(args.Key)
+	defer unlock()
+	if err := ss.expire(args.Key); err != nil {
+		return err
+	}
+	ss.dataLock.Lock()
+	value, ok, err := ss.store.get(args.Key)
+	version := ss.versions[args.Key]
+	expires := ss.expires[args.Key]
+	ss.dataLock.Unlock()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		reply.Status = storagerpc.KeyNotFound
+		return nil
+	}
+	if value != args.OldValue {
+		reply.Status = storagerpc.PreconditionFailed
+		reply.Value = value
+		reply.Version = version
+		return nil
+	}
+	return ss.writeThrough(&logRecord{Op: storagerpc.OpPut, Key: args.Key, Value: args.NewValue, Expires: expires}, &reply.Version)
+}
+
+func (ss *storageServer) Replicate(args *storagerpc.ReplicateArgs, reply *storagerpc.ReplicateReply) error {
+	// The check is made under the key's write lock, so that a replicated
+	// write cannot resurrect a key that a ring change has just discarded.
+	unlock := ss.lockKey(args.Key)
+	defer unlock()
+	if reply.Status = ss.checkReplica(args.Key); reply.Status != storagerpc.OK {
+		return nil
+	}
+	// A replica that missed an earlier write to the key must not apply a
+	// later one; the primary then removes it from the ring.
+	ss.dataLock.Lock()
+	current, ok := ss.versions[args.Key]
+	ss.dataLock.Unlock()
+	if ok && args.Version > current+1 {
+		reply.Status = storagerpc.NotReady
+		return nil
+	}
+	ss.revokeLeases(args.Key)
+	if err := ss.commit(&logRecord{Op: args.Op, Key: args.Key, Value: args.Value, Version: args.Version, Expires: args.Expires}); err != nil {
+		return err
+	}
+	ss.rememberRequest(args.RequestID, args.Key, &args.Reply, nil)
+	return nil
+}
+
+// lockKey acquires the write lock for key and returns a function that
+// releases it. Writers of a key must hold its write lock, so that a key's
+// leases are revoked by only one writer at a time.
+func (ss *storageServer) lockKey(key string) func() {
+	l := ss.keyLock(key)
+	l.Lock()
+	return l.Unlock
+}
+
+// keyLock returns the write lock for key.
+func (ss *storageServer) keyLock(key string) *sync.Mutex {
+	ss.dataLock.Lock()
+	defer ss.dataLock.Unlock()
+	l, ok := ss.keyLocks[key]
+	if !ok {
+		l = new(sync.Mutex)
+		ss.keyLocks[key] = l
+	}
+	return l
+}
+
+// checkVersion replies with status PreconditionFailed unless version is zero
+// or equal to key's current version, which it also returns.
+func (ss *storageServer) checkVersion(key string, version uint64) (storagerpc.Status, uint64) {
+	ss.dataLock.Lock()
+	defer ss.dataLock.Unlock()
+	current := ss.versions[key]
+	if version != 0 && version != current {
+		return storagerpc.PreconditionFailed, current
+	}
+	return storagerpc.OK, current
+}
+
+func (ss *storageServer) listContains(key, item string) (bool, error) {
+	ss.dataLock.Lock()
+	defer ss.dataLock.Unlock()
+	list, _, err := ss.store.getList(key)
+	return containsString(list, item), err
+}
+
+// commit discards the leases on rec's key, which the caller must already
+// have revoked, then persists rec (if the server is durable) and applies it.
+// Unless rec already carries a version, the key's next version is assigned.
+func (ss *storageServer) commit(rec *logRecord) error {
+	ss.dataLock.Lock()
+	defer ss.dataLock.Unlock()
+	delete(ss.leases, rec.Key)
+	if rec.Version == 0 && rec.Op != storagerpc.OpDelete && !isTxOp(rec.Op) {
+		rec.Version = ss.nextVersionLocked(rec.Key)
+	}
+	if ss.wal != nil {
+		if err := ss.wal.append(rec); err != nil {
+			return err
+		}
+	}
+	if err := ss.applyLocked(rec); err != nil {
+		return err
+	}
+	if ss.wal != nil && ss.wal.records >= maxLogRecords {
+		// The record is already durable, so a failed compaction is not fatal.
+		if err := ss.compactLocked(); err != nil {
+			log.Println("Failed to compact write-ahead log:", err)
+		}
+	}
+	return nil
+}
+
+// applyLocked applies a single modification to the server's data.
+func (ss *storageServer) applyLocked(rec *logRecord) error {
+	if isTxOp(rec.Op) {
+		ss.applyTxLocked(rec)
+		return nil
+	}
+	if rec.Op == opLeaseHorizon {
+		if rec.Expires > ss.leaseHorizon {
+			ss.leaseHorizon = rec.Expires
+		}
+		return nil
+	}
+	switch {
+	case rec.Op == storagerpc.OpDelete:
+		// A deletion carries a version only when it stands for a key
+		// handed off by another node.
+		ss.forgetVersionLocked(rec.Key, rec.Version)
+	case rec.Version == 0:
+		// The record was logged before keys were versioned.
+		ss.versions[rec.Key] = ss.nextVersionLocked(rec.Key)
+		delete(ss.deleted, rec.Key)
+	default:
+		ss.versions[rec.Key] = rec.Version
+		delete(ss.deleted, rec.Key)
+	}
+	if rec.Expires != 0 {
+		ss.expires[rec.Key] = rec.Expires
+	} else {
+		delete(ss.expires, rec.Key)
+	}
+	switch rec.Op {
+	case storagerpc.OpPut:
+		return ss.store.put(rec.Seq, rec.Key, rec.Value)
+	case storagerpc.OpAppendToList:
+		return ss.store.appendToList(rec.Seq, rec.Key, rec.Value)
+	case storagerpc.OpRemoveFromList:
+		return ss.store.removeFromList(rec.Seq, rec.Key, rec.Value)
+	case storagerpc.OpDelete:
+		return ss.store.delete(rec.Seq, rec.Key)
+	case storagerpc.OpTrimList:
+		n, err := strconv.Atoi(rec.Value)
+		if err != nil {
+			return err
+		}
+		return ss.store.trimList(rec.Seq, rec.Key, n)
+	}
+	return nil
+}
+
+// grantLeaseLocked grants hostPort a lease on key, unless the key's leases
+// are currently being revoked, the key is written too often to be worth
+// leasing, or hostPort is denied leases.
+func (ss *storageServer) grantLeaseLocked(key, hostPort string, writeThrough bool) storagerpc.Lease {
+	if ss.deniedLocked(hostPort) {
+		ss.leaseStats.Denials++
+		return storagerpc.Lease{Granted: false}
+	}
+	seconds := ss.leaseSecondsLocked(key)
+	if seconds == 0 {
+		return storagerpc.Lease{Granted: false}
+	}
+	ls, ok := ss.leases[key]
+	if !ok {
+		ls = &leaseState{holders: make(map[string]leaseGrant)}
+		ss.leases[key] = ls
+	}
+	if ls.revoking {
+		return storagerpc.Lease{Granted: false}
+	}
+	now := time.Now()
+	expires := now.Add(time.Duration(seconds+storagerpc.LeaseGuardSeconds) * time.Second)
+	if !ss.coverLeaseLocked(expires) {
+		return storagerpc.Lease{Granted: false}
+	}
+	ls.holders[hostPort] = leaseGrant{
+		granted:      now,
+		expires:      expires,
+		writeThrough: writeThrough,
+	}
+	ss.leaseStats.Grants++
+	return storagerpc.Lease{Granted: true, ValidSeconds: seconds}
+}
+
+// revokeLeases revokes every outstanding lease on key, returning once each
+// holder has acknowledged the revocation or its lease has expired. No new
+// leases are granted on key until the pending write is committed.
+func (ss *storageServer) revokeLeases(key string) {
+	ss.revokeLeasesKeeping(key, false)
+}
+
+// revokeLeasesKeeping is like revokeLeases, but if keepWriteThrough is set,
+// it leaves the write-through leases alone and returns them instead.
+func (ss *storageServer) revokeLeasesKeeping(key string, keepWriteThrough bool) map[string]leaseGrant {
+	time.Sleep(time.Until(ss.recoveryLeaseDeadline))
+
+	ss.dataLock.Lock()
+	ss.recordWriteLocked(key)
+	ls, ok := ss.leases[key]
+	if !ok {
+		ss.dataLock.Unlock()
+		return nil
+	}
+	ls.revoking = true
+	holders := make(map[string]leaseGrant, len(ls.holders))
+	kept := make(map[string]leaseGrant)
+	now := time.Now()
+	for hostPort, grant := range ls.holders {
+		switch {
+		case !now.Before(grant.expires):
+		case keepWriteThrough && grant.writeThrough:
+			kept[hostPort] = grant
+		default:
+			holders[hostPort] = grant
+		}
+	}
+	if len(holders) > 0 || len(kept) > 0 {
+		ss.leaseStats.BlockedWrites++
+	}
+	ss.dataLock.Unlock()
+	ss.revokeHolders(key, holders)
+	return kept
+}
+
+// revokeHolders revokes the leases on key of the given holders. They are
+// asked concurrently, so the write waits no longer than for the slowest.
+func (ss *storageServer) revokeHolders(key string, holders map[string]leaseGrant) {
+	done := make(chan struct{}, len(holders))
+	for hostPort, grant := range holders {
+		go func(hostPort string, expiry time.Time) {
+			ss.revokeLease(key, hostPort, expiry)
+			done <- struct{}{}
+		}(hostPort, grant.expires)
+	}
+	for range holders {
+		<-done
+	}
+}
+
+// revokeLease asks the Libstore at hostPort to revoke its lease on key,
+// treating the lease as revoked once it expires.
+func (ss *storageServer) revokeLease(key, hostPort string, expiry time.Time) {
+	timeout := time.After(time.Until(expiry))
+	cli, err := ss.client(hostPort)
+	if err != nil {
+		<-timeout
+		ss.recordRevocation(hostPort, false)
+		return
+	}
+	args := &storagerpc.RevokeLeaseArgs{Key: key}
+	var reply storagerpc.RevokeLeaseReply
+	call := cli.Go("LeaseCallbacks.RevokeLease", args, &reply, nil)
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			ss.dropClient(hostPort, cli)
+			<-timeout
+		}
+		ss.recordRevocation(hostPort, call.Error == nil)
+	case <-timeout:
+		ss.recordRevocation(hostPort, false)
+	}
 }
 
-func (ss *storageServer) Put(args *storagerpc.PutArgs, reply *storagerpc.PutReply) error {
-	return errors.New("not implemented")
+// client returns a (cached) connection to the storage server or Libstore
+// at hostPort.
+func (ss *storageServer) client(hostPort string) (*rpc.Client, error) {
+	ss.clientsLock.Lock()
+	cli, ok := ss.clients[hostPort]
+	ss.clientsLock.Unlock()
+	if ok {
+		return cli, nil
+	}
+	cli, err := rpc.DialHTTP("tcp", hostPort)
+	if err != nil {
+		return nil, err
+	}
+	ss.clientsLock.Lock()
+	defer ss.clientsLock.Unlock()
+	if existing, ok := ss.clients[hostPort]; ok {
+		cli.Close()
+		return existing, nil
+	}
+	ss.clients[hostPort] = cli
+	return cli, nil
 }
 
-func (ss *storageServer) AppendToList(args *storagerpc.PutArgs, reply *storagerpc.PutReply) error {
-	return errors.New("not implemented")
+// call performs an RPC on the storage server at hostPort. Connections that
+// fail are discarded, so that the next call redials the server.
+func (ss *storageServer) call(hostPort, method string, args, reply interface{}) error {
+	cli, err := ss.client(hostPort)
+	if err != nil {
+		return err
+	}
+	err = cli.Call(method, args, reply)
+	if _, ok := err.(rpc.ServerError); err != nil && !ok {
+		ss.dropClient(hostPort, cli)
+	}
+	return err
 }
 
-func (ss *storageServer) RemoveFromList(args *storagerpc.PutArgs, reply *storagerpc.PutReply) error {
-	return errors.New("not implemented")
+// dropClient discards a broken connection so that it is redialed.
+func (ss *storageServer) dropClient(hostPort string, cli *rpc.Client) {
+	ss.clientsLock.Lock()
+	defer ss.clientsLock.Unlock()
+	if ss.clients[hostPort] == cli {
+		delete(ss.clients, hostPort)
+		cli.Close()
+	}
 }
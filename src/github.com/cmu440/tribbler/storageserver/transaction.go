@@ -0,0 +1,582 @@
+package storageserver
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cmu440/tribbler/rpc/storagerpc"
+)
+
+// A transaction is coordinated by the primary of its first key, using
+// two-phase commit among the primaries of all its keys (the participants).
+// Each participant locks its keys, checks that the writes can be made,
+// revokes the keys' leases and logs the writes before voting to commit.
+// The coordinator logs its decision to commit before announcing it, and
+// answers TxStatus queries from participants that missed the announcement;
+// a transaction that the coordinator neither committed nor is still
+// coordinating is presumed to have aborted. The coordinator keeps announcing
+// a commit until every participant has acknowledged it (or left the ring),
+// and only then forgets it. The outcome therefore survives crashes only if
+// the servers are durable.
+//
+// A participant whose coordinator cannot be reached for txOrphanTimeout asks
+// the other participants instead. One that completed the transaction tells
+// its outcome, and one that never prepared it promises never to, so that the
+// transaction can safely abort. If every participant is still waiting, so is
+// the transaction. Participants remember outcomes for txOutcomeTTL.
+
+const (
+	txStatusInterval = 2 * time.Second  // How often a participant asks for the outcome of a prepared transaction.
+	txStatusTimeout  = time.Second      // How long to wait for the coordinator to answer.
+	txOrphanTimeout  = 30 * time.Second // How long a participant waits for an unreachable coordinator before asking the other participants.
+	txOutcomeTTL     = 10 * time.Minute // How long a participant remembers the outcome of a transaction it completed.
+)
+
+// Log records of transactions, whose Key is the transaction's ID. They do
+// not modify any keys themselves.
+const (
+	opPrepareTx storagerpc.Op = iota + 100 // The participant prepared the transaction, encoded in Value.
+	opCommitTx                             // The participant made the transaction's writes.
+	opAbortTx                              // The participant discarded the transaction's writes.
+	opDecideTx                             // The coordinator decided to commit the transaction, among the participants in Value.
+	opAckTx                                // The participants in Value acknowledged the commit.
+)
+
+func isTxOp(op storagerpc.Op) bool {
+	return op >= opPrepareTx && op <= opAckTx
+}
+
+// preparedTx is a transaction that a participant has prepared.
+type preparedTx struct {
+	Coordinator  string
+	Participants []string
+	Ops          []storagerpc.TxOp
+
+	unlock     func()        // Releases the locks on the transaction's keys.
+	completing bool          // Whether the transaction is being committed or aborted.
+	done       chan struct{} // Closed once the transaction is completed.
+}
+
+// completedTx is the outcome of a transaction that a participant completed.
+type completedTx struct {
+	Committed bool
+	Time      int64 // When it was completed, in Unix nanoseconds.
+}
+
+func encodeTx(tx *preparedTx) (string, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(tx); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func decodeTx(value string) (*preparedTx, error) {
+	tx := new(preparedTx)
+	if err := gob.NewDecoder(bytes.NewBufferString(value)).Decode(tx); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// txKeys returns the keys written by ops, sorted and without duplicates.
+func txKeys(ops []storagerpc.TxOp) []string {
+	var keys []string
+	for _, op := range ops {
+		if !containsString(keys, op.Key) {
+			keys = append(keys, op.Key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (ss *storageServer) applyTxLocked(rec *logRecord) {
+	switch rec.Op {
+	case opPrepareTx:
+		tx, err := decodeTx(rec.Value)
+		if err != nil {
+			log.Printf("Failed to decode prepared transaction %s: %s", rec.Key, err)
+			return
+		}
+		ss.prepared[rec.Key] = tx
+	case opCommitTx, opAbortTx:
+		delete(ss.prepared, rec.Key)
+		ss.completed[rec.Key] = completedTx{rec.Op == opCommitTx, time.Now().UnixNano()}
+	case opDecideTx:
+		ss.committed[rec.Key] = strings.Fields(rec.Value)
+	case opAckTx:
+		pending := ss.committed[rec.Key]
+		for _, hostPort := range strings.Fields(rec.Value) {
+			pending = removeString(pending, hostPort)
+		}
+		if len(pending) == 0 {
+			delete(ss.committed, rec.Key)
+		} else {
+			ss.committed[rec.Key] = pending
+		}
+	}
+}
+
+func removeString(list []string, s string) []string {
+	for i, v := range list {
+		if v == s {
+			return append(list[:i:i], list[i+1:]...)
+		}
+	}
+	return list
+}
+
+func (ss *storageServer) Transact(args *storagerpc.TransactArgs, reply *storagerpc.TransactReply) error {
+	if len(args.Ops) == 0 {
+		reply.Status = storagerpc.OK
+		return nil
+	}
+	for _, op := range args.Ops {
+		if op.Op != storagerpc.OpPut && op.Op != storagerpc.OpAppendToList && op.Op != storagerpc.OpRemoveFromList {
+			return errors.New("invalid transaction operation")
+		}
+	}
+	if reply.Status = ss.checkPrimary(args.Ops[0].Key); reply.Status != storagerpc.OK {
+		return nil
+	}
+
+	ss.ringLock.Lock()
+	index := ss.index
+	ss.ringLock.Unlock()
+	participants := make(map[string][]storagerpc.TxOp)
+	var hostPorts []string
+	for _, op := range args.Ops {
+		hostPort := ownerOf(index, op.Key).HostPort
+		if _, ok := participants[hostPort]; !ok {
+			hostPorts = append(hostPorts, hostPort)
+		}
+		participants[hostPort] = append(participants[hostPort], op)
+	}
+
+	ss.dataLock.Lock()
+	ss.txSeq++
+	txID := fmt.Sprintf("%s/%x/%d", ss.hostPort, time.Now().UnixNano(), ss.txSeq)
+	ss.active[txID] = true
+	ss.dataLock.Unlock()
+	defer func() {
+		ss.dataLock.Lock()
+		delete(ss.active, txID)
+		ss.dataLock.Unlock()
+	}()
+
+	type vote struct {
+		status storagerpc.Status
+		err    error
+	}
+	votes := make(chan vote, len(participants))
+	for hostPort, ops := range participants {
+		go func(hostPort string, ops []storagerpc.TxOp) {
+			var reply storagerpc.TxReply
+			args := &storagerpc.TxArgs{TxID: txID, Coordinator: ss.hostPort, Participants: hostPorts, Ops: ops}
+			err := ss.call(hostPort, "StorageServer.PrepareTx", args, &reply)
+			votes <- vote{reply.Status, err}
+		}(hostPort, ops)
+	}
+	status := storagerpc.OK
+	var err error
+	for range participants {
+		v := <-votes
+		if v.err != nil {
+			err = v.err
+		} else if v.status != storagerpc.OK && status == storagerpc.OK {
+			status = v.status
+		}
+	}
+
+	if err == nil && status == storagerpc.OK {
+		// Record the decision before announcing it, so that participants
+		// that miss the announcement can still learn of it.
+		if err = ss.commit(&logRecord{Op: opDecideTx, Key: txID, Value: strings.Join(hostPorts, " ")}); err == nil {
+			ss.acknowledge(txID, ss.announce(txID, "StorageServer.CommitTx", hostPorts))
+			reply.Status = storagerpc.OK
+			return nil
+		}
+	}
+	// Participants whose vote was lost may have prepared, so all are told.
+	ss.announce(txID, "StorageServer.AbortTx", hostPorts)
+	reply.Status = status
+	return err
+}
+
+// announce invokes method (CommitTx or AbortTx) on each of participants in
+// parallel, returning once all have replied with the host:ports of those that
+// succeeded. Participants that cannot be reached ask for the outcome
+// themselves.
+func (ss *storageServer) announce(txID, method string, participants []string) []string {
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		acked []string
+	)
+	for _, hostPort := range participants {
+		wg.Add(1)
+		go func(hostPort string) {
+			defer wg.Done()
+			var reply storagerpc.TxReply
+			if err := ss.call(hostPort, method, &storagerpc.TxArgs{TxID: txID}, &reply); err != nil {
+				log.Printf("%s of transaction %s on %s failed: %s", method, txID, hostPort, err)
+				return
+			}
+			mu.Lock()
+			acked = append(acked, hostPort)
+			mu.Unlock()
+		}(hostPort)
+	}
+	wg.Wait()
+	return acked
+}
+
+// acknowledge records that participants completed the committed transaction
+// with the given ID, which is forgotten once all have.
+func (ss *storageServer) acknowledge(txID string, participants []string) {
+	if len(participants) == 0 {
+		return
+	}
+	if err := ss.commit(&logRecord{Op: opAckTx, Key: txID, Value: strings.Join(participants, " ")}); err != nil {
+		log.Printf("Failed to record acknowledgement of transaction %s: %s", txID, err)
+	}
+}
+
+// confirmTxs periodically announces the transactions that this server
+// committed to the participants that have yet to acknowledge them, and
+// forgets the outcomes of transactions completed over txOutcomeTTL ago.
+// Participants that left the ring are not waited for.
+func (ss *storageServer) confirmTxs() {
+	for range time.Tick(txStatusInterval) {
+		ss.ringLock.Lock()
+		members := make(map[string]bool, len(ss.servers))
+		for _, n := range ss.servers {
+			members[n.HostPort] = true
+		}
+		ss.ringLock.Unlock()
+
+		ss.dataLock.Lock()
+		pending := make(map[string][]string, len(ss.committed))
+		for txID, participants := range ss.committed {
+			pending[txID] = append([]string(nil), participants...)
+		}
+		horizon := time.Now().Add(-txOutcomeTTL).UnixNano()
+		for txID, tx := range ss.completed {
+			if tx.Time < horizon {
+				delete(ss.completed, txID)
+			}
+		}
+		ss.dataLock.Unlock()
+
+		for txID, participants := range pending {
+			var present, gone []string
+			for _, hostPort := range participants {
+				if members[hostPort] {
+					present = append(present, hostPort)
+				} else {
+					gone = append(gone, hostPort)
+				}
+			}
+			ss.acknowledge(txID, append(gone, ss.announce(txID, "StorageServer.CommitTx", present)...))
+		}
+	}
+}
+
+func (ss *storageServer) PrepareTx(args *storagerpc.TxArgs, reply *storagerpc.TxReply) error {
+	ss.ringChange.RLock()
+	defer ss.ringChange.RUnlock()
+	keys := txKeys(args.Ops)
+	for _, key := range keys {
+		if reply.Status = ss.checkPrimary(key); reply.Status != storagerpc.OK {
+			return nil
+		}
+	}
+	unlock, ok := ss.tryLockKeys(keys)
+	if !ok {
+		reply.Status = storagerpc.Locked
+		return nil
+	}
+	for _, key := range keys {
+		if err := ss.expire(key); err != nil {
+			unlock()
+			return err
+		}
+	}
+	ss.dataLock.Lock()
+	status, err := ss.checkTxLocked(args.Ops)
+	ss.dataLock.Unlock()
+	if err != nil || status != storagerpc.OK {
+		unlock()
+		reply.Status = status
+		return err
+	}
+
+	for _, key := range keys {
+		ss.revokeLeases(key)
+	}
+	value, err := encodeTx(&preparedTx{Coordinator: args.Coordinator, Participants: args.Participants, Ops: args.Ops})
+	if err != nil {
+		ss.discardLeases(keys)
+		unlock()
+		return err
+	}
+	// A transaction that is already completed here was aborted by a
+	// participant that asked this server for its outcome.
+	ss.txLock.Lock()
+	ss.dataLock.Lock()
+	_, completed := ss.completed[args.TxID]
+	ss.dataLock.Unlock()
+	if !completed {
+		err = ss.commit(&logRecord{Op: opPrepareTx, Key: args.TxID, Value: value})
+	}
+	ss.txLock.Unlock()
+	if err != nil || completed {
+		ss.discardLeases(keys)
+		unlock()
+		reply.Status = storagerpc.Locked
+		return err
+	}
+	ss.dataLock.Lock()
+	tx := ss.prepared[args.TxID]
+	tx.unlock = unlock
+	tx.done = make(chan struct{})
+	ss.dataLock.Unlock()
+	go ss.awaitOutcome(args.TxID)
+	return nil
+}
+
+// tryLockKeys acquires the write locks for keys without waiting, so that
+// transactions that lock keys in different orders cannot deadlock. It
+// returns a function that releases the locks, or false if any key is
+// already locked.
+func (ss *storageServer) tryLockKeys(keys []string) (func(), bool) {
+	var locks []*sync.Mutex
+	unlock := func() {
+		for _, l := range locks {
+			l.Unlock()
+		}
+	}
+	for _, key := range keys {
+		l := ss.keyLock(key)
+		if !l.TryLock() {
+			unlock()
+			return nil, false
+		}
+		locks = append(locks, l)
+	}
+	return unlock, true
+}
+
+// checkTxLocked replies with the status of the first of ops that cannot be
+// made, given the ops before it, or with status OK if all can be made.
+func (ss *storageServer) checkTxLocked(ops []storagerpc.TxOp) (storagerpc.Status, error) {
+	lists := make(map[string][]string)
+	for _, op := range ops {
+		list, ok := lists[op.Key]
+		if !ok {
+			stored, _, err := ss.store.getList(op.Key)
+			if err != nil {
+				return storagerpc.OK, err
+			}
+			list = append([]string(nil), stored...)
+		}
+		switch op.Op {
+		case storagerpc.OpAppendToList:
+			if containsString(list, op.Value) {
+				return storagerpc.ItemExists, nil
+			}
+			list = append(list, op.Value)
+		case storagerpc.OpRemoveFromList:
+			if !containsString(list, op.Value) {
+				return storagerpc.ItemNotFound, nil
+			}
+			for i, v := range list {
+				if v == op.Value {
+					list = append(list[:i:i], list[i+1:]...)
+					break
+				}
+			}
+		}
+		lists[op.Key] = list
+	}
+	return storagerpc.OK, nil
+}
+
+// discardLeases discards the (revoked) leases on keys, so that new leases
+// can be granted once a transaction writing them aborts.
+func (ss *storageServer) discardLeases(keys []string) {
+	ss.dataLock.Lock()
+	defer ss.dataLock.Unlock()
+	for _, key := range keys {
+		delete(ss.leases, key)
+	}
+}
+
+func (ss *storageServer) CommitTx(args *storagerpc.TxArgs, reply *storagerpc.TxReply) error {
+	reply.Status = storagerpc.OK
+	return ss.completeTx(args.TxID, true)
+}
+
+func (ss *storageServer) AbortTx(args *storagerpc.TxArgs, reply *storagerpc.TxReply) error {
+	reply.Status = storagerpc.OK
+	return ss.completeTx(args.TxID, false)
+}
+
+// completeTx makes the writes of a prepared transaction if commit is set,
+// or discards them otherwise, and then unlocks the transaction's keys.
+// Completing a transaction that is not prepared has no effect.
+func (ss *storageServer) completeTx(txID string, commit bool) error {
+	ss.dataLock.Lock()
+	tx, ok := ss.prepared[txID]
+	if !ok {
+		ss.dataLock.Unlock()
+		return nil
+	}
+	if tx.completing {
+		ss.dataLock.Unlock()
+		<-tx.done
+		return nil
+	}
+	tx.completing = true
+	ss.dataLock.Unlock()
+	defer close(tx.done)
+	defer tx.unlock()
+
+	var err error
+	if commit {
+		// Each write is logged and replicated on its own. Should the server
+		// crash part of the way through, the transaction is still prepared
+		// when it recovers, and its writes (which are idempotent) are made
+		// again once the coordinator confirms the outcome. Reads may observe
+		// some of the writes before others, and leases granted in between
+		// are revoked before the next write to the key.
+		for _, op := range tx.Ops {
+			ss.revokeLeases(op.Key)
+			rec := &logRecord{Op: op.Op, Key: op.Key, Value: op.Value}
+			rec.Expires = ss.expiresAt(op.Key, 0, op.Op != storagerpc.OpPut)
+			var version uint64
+			if e := ss.write(rec, &version); e != nil && err == nil {
+				err = e
+			}
+		}
+		if e := ss.commit(&logRecord{Op: opCommitTx, Key: txID}); e != nil && err == nil {
+			err = e
+		}
+	} else {
+		ss.discardLeases(txKeys(tx.Ops))
+		err = ss.commit(&logRecord{Op: opAbortTx, Key: txID})
+	}
+	return err
+}
+
+// awaitOutcome periodically asks the coordinator of a prepared transaction
+// for its outcome until the transaction completes, in case the coordinator's
+// announcement is lost. Once the coordinator has been unreachable for
+// txOrphanTimeout, the other participants are asked too.
+func (ss *storageServer) awaitOutcome(txID string) {
+	ticker := time.NewTicker(txStatusInterval)
+	defer ticker.Stop()
+	heard := time.Now() // When the coordinator last answered.
+	for range ticker.C {
+		ss.dataLock.Lock()
+		tx, ok := ss.prepared[txID]
+		ss.dataLock.Unlock()
+		if !ok {
+			return
+		}
+		var reply storagerpc.TxReply
+		err := ss.callTimeout(tx.Coordinator, "StorageServer.TxStatus", &storagerpc.TxArgs{TxID: txID}, &reply, txStatusTimeout)
+		if err == nil {
+			heard = time.Now()
+		} else if time.Since(heard) >= txOrphanTimeout {
+			reply, err = ss.askParticipants(txID, tx), nil
+		}
+		if err != nil || reply.Status != storagerpc.OK {
+			continue
+		}
+		if err := ss.completeTx(txID, reply.Committed); err != nil {
+			log.Printf("Failed to complete transaction %s: %s", txID, err)
+		}
+		return
+	}
+}
+
+// askParticipants asks the participants of a prepared transaction other than
+// this server and its coordinator for its outcome, replying with status OK
+// once one of them knows it.
+func (ss *storageServer) askParticipants(txID string, tx *preparedTx) storagerpc.TxReply {
+	for _, hostPort := range tx.Participants {
+		if hostPort == ss.hostPort || hostPort == tx.Coordinator {
+			continue
+		}
+		var reply storagerpc.TxReply
+		args := &storagerpc.TxArgs{TxID: txID, Coordinator: tx.Coordinator}
+		if err := ss.callTimeout(hostPort, "StorageServer.TxStatus", args, &reply, txStatusTimeout); err == nil && reply.Status == storagerpc.OK {
+			return reply
+		}
+	}
+	return storagerpc.TxReply{Status: storagerpc.NotReady}
+}
+
+func (ss *storageServer) TxStatus(args *storagerpc.TxArgs, reply *storagerpc.TxReply) error {
+	if args.Coordinator != "" && args.Coordinator != ss.hostPort {
+		return ss.participantStatus(args.TxID, reply)
+	}
+	ss.dataLock.Lock()
+	defer ss.dataLock.Unlock()
+	if ss.active[args.TxID] {
+		reply.Status = storagerpc.NotReady
+		return nil
+	}
+	_, reply.Committed = ss.committed[args.TxID]
+	reply.Status = storagerpc.OK
+	return nil
+}
+
+// participantStatus replies to another participant of the transaction with
+// the given ID with its outcome, or with status NotReady if this server is
+// still waiting for it too. A transaction that this server never prepared is
+// aborted, so that it cannot be prepared later.
+func (ss *storageServer) participantStatus(txID string, reply *storagerpc.TxReply) error {
+	ss.txLock.Lock()
+	defer ss.txLock.Unlock()
+	ss.dataLock.Lock()
+	_, prepared := ss.prepared[txID]
+	tx, completed := ss.completed[txID]
+	ss.dataLock.Unlock()
+	if prepared {
+		reply.Status = storagerpc.NotReady
+		return nil
+	}
+	if !completed {
+		if err := ss.commit(&logRecord{Op: opAbortTx, Key: txID}); err != nil {
+			return err
+		}
+	}
+	reply.Status = storagerpc.OK
+	reply.Committed = tx.Committed
+	return nil
+}
+
+// resumeTxs relocks the keys of the transactions that were prepared but not
+// completed before the server restarted, and resumes waiting for their
+// outcomes. No two of them can share a key, since each held its keys' locks.
+func (ss *storageServer) resumeTxs() {
+	for txID, tx := range ss.prepared {
+		keys := txKeys(tx.Ops)
+		tx.unlock, _ = ss.tryLockKeys(keys)
+		tx.done = make(chan struct{})
+		for _, key := range keys {
+			ss.leases[key] = &leaseState{holders: make(map[string]leaseGrant), revoking: true}
+		}
+		go ss.awaitOutcome(txID)
+	}
+}
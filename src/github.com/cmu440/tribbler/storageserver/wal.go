@@ -0,0 +1,378 @@
+package storageserver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cmu440/tribbler/rpc/storagerpc"
+)
+
+const (
+	logFileName      = "wal.log"
+	snapshotFileName = "snapshot"
+	maxLogRecords    = 1000        // Compact the log once it holds this many records.
+	snapshotInterval = time.Minute // Compact a non-empty log at least this often.
+)
+
+// opLeaseHorizon records, in Expires, a time by which every lease that the
+// server has granted expires. It does not modify any keys.
+const opLeaseHorizon storagerpc.Op = 90
+
+// leaseHorizonSlack is how far beyond the expiry of a new lease the lease
+// horizon is pushed, so that the horizon is logged once per slack rather
+// than once per lease.
+const leaseHorizonSlack = storagerpc.MaxLeaseSeconds * time.Second
+
+var errCorruptRecord = errors.New("corrupt log record")
+
+// logRecord describes a single modification to a storage server's data.
+type logRecord struct {
+	Seq     uint64 // Position of the record in the server's history.
+	Op      storagerpc.Op
+	Key     string
+	Value   string
+	Version uint64 // The key's version after the modification.
+	Expires int64  // When the key expires, in Unix nanoseconds, or zero if it never does.
+
+	requestID string // The ID of the client's write, if any (not persisted).
+}
+
+// snapshot is a storage server's data as of the log record numbered Seq.
+type snapshot struct {
+	Seq       uint64
+	Values    map[string]string
+	Lists     map[string][]string
+	Versions  map[string]uint64
+	Deleted   map[string]deletedKey
+	Expires   map[string]int64
+	Prepared  map[string]*preparedTx
+	Completed map[string]completedTx
+	Decided   map[string][]string // Committed transactions awaiting acknowledgement.
+
+	LeaseHorizon int64 // When every lease granted so far expires, in Unix nanoseconds.
+	InEngine     bool  // Whether Values and Lists were left to a durable engine.
+}
+
+// writeAheadLog appends modifications to a file in dir. Each record is
+// framed by its length and CRC-32 checksum, so that a record torn by a
+// crash can be detected and discarded on recovery.
+type writeAheadLog struct {
+	dir     string
+	file    *os.File
+	seq     uint64 // Sequence number of the last record written.
+	records int    // Number of records written since the last snapshot.
+}
+
+// append durably writes rec to the log, assigning it the next sequence number.
+func (w *writeAheadLog) append(rec *logRecord) error {
+	rec.Seq = w.seq + 1
+	payload := rec.encode()
+	buf := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	buf = append(buf, payload...)
+	if _, err := w.file.Write(buf); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.seq = rec.Seq
+	w.records++
+	return nil
+}
+
+// truncate discards every record in the log.
+func (w *writeAheadLog) truncate() error {
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	w.records = 0
+	return w.file.Sync()
+}
+
+func (rec *logRecord) encode() []byte {
+	buf := make([]byte, 0, 5*binary.MaxVarintLen64+1+len(rec.Key)+len(rec.Value))
+	buf = binary.AppendUvarint(buf, rec.Seq)
+	buf = append(buf, byte(rec.Op))
+	buf = appendString(buf, rec.Key)
+	buf = appendString(buf, rec.Value)
+	buf = binary.AppendUvarint(buf, rec.Version)
+	buf = binary.AppendVarint(buf, rec.Expires)
+	return buf
+}
+
+func decodeRecord(buf []byte) (*logRecord, error) {
+	rec := new(logRecord)
+	var n int
+	if rec.Seq, n = binary.Uvarint(buf); n <= 0 || n >= len(buf) {
+		return nil, errCorruptRecord
+	}
+	rec.Op, buf = storagerpc.Op(buf[n]), buf[n+1:]
+	var ok bool
+	if rec.Key, buf, ok = readString(buf); !ok {
+		return nil, errCorruptRecord
+	}
+	if rec.Value, buf, ok = readString(buf); !ok {
+		return nil, errCorruptRecord
+	}
+	// Records written before keys were versioned end here.
+	if len(buf) == 0 {
+		return rec, nil
+	}
+	if rec.Version, n = binary.Uvarint(buf); n <= 0 {
+		return nil, errCorruptRecord
+	}
+	// Records written before keys could expire end here.
+	if buf = buf[n:]; len(buf) > 0 {
+		if rec.Expires, n = binary.Varint(buf); n <= 0 {
+			return nil, errCorruptRecord
+		}
+	}
+	return rec, nil
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func readString(buf []byte) (string, []byte, bool) {
+	size, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < size {
+		return "", nil, false
+	}
+	return string(buf[n : n+int(size)]), buf[n+int(size):], true
+}
+
+// recover loads the latest snapshot in dir, replays the log records written
+// after it, and opens the log for appending. It also starts a background
+// goroutine that periodically compacts the log.
+func (ss *storageServer) recover(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	seq, err := ss.loadSnapshot(filepath.Join(dir, snapshotFileName))
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, logFileName), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w := &writeAheadLog{dir: dir, file: file, seq: seq}
+	if err := ss.replay(w); err != nil {
+		file.Close()
+		return err
+	}
+	ss.wal = w
+
+	// Libstores may still cache values under leases granted before the
+	// restart, so hold writes until any such lease has expired.
+	if ss.leaseHorizon > 0 {
+		ss.recoveryLeaseDeadline = time.Unix(0, ss.leaseHorizon)
+	}
+
+	go ss.compactPeriodically()
+	return nil
+}
+
+// loadSnapshot reads the snapshot at path (if any) into the server's data
+// and returns the sequence number of the last record it reflects.
+func (ss *storageServer) loadSnapshot(path string) (uint64, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	var snap snapshot
+	if err := gob.NewDecoder(bufio.NewReader(file)).Decode(&snap); err != nil {
+		return 0, err
+	}
+	switch {
+	case ss.store.durable() && ss.store.applied() >= snap.Seq:
+		// The engine recovered data at least as recent as the snapshot.
+	case snap.InEngine:
+		return 0, errors.New("storage engine lost data written before the latest snapshot")
+	default:
+		if err := ss.store.restore(snap.Seq, snap.Values, snap.Lists); err != nil {
+			return 0, err
+		}
+	}
+	if snap.Versions != nil {
+		ss.versions = snap.Versions
+	}
+	if snap.Deleted != nil {
+		ss.deleted = snap.Deleted
+	}
+	if snap.Expires != nil {
+		ss.expires = snap.Expires
+	}
+	if snap.Prepared != nil {
+		ss.prepared = snap.Prepared
+	}
+	if snap.Completed != nil {
+		ss.completed = snap.Completed
+	}
+	if snap.Decided != nil {
+		ss.committed = snap.Decided
+	}
+	ss.leaseHorizon = snap.LeaseHorizon
+	return snap.Seq, nil
+}
+
+// replay applies the records in w's log that follow its last snapshot. A
+// torn or corrupt record (and everything after it) is truncated away.
+func (ss *storageServer) replay(w *writeAheadLog) error {
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	info, err := w.file.Stat()
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(w.file)
+	var offset int64
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err == io.EOF {
+			return nil
+		} else if err != nil {
+			break
+		}
+		size := int64(binary.BigEndian.Uint32(header[0:4]))
+		if size > info.Size()-offset-int64(len(header)) {
+			break
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+			break
+		}
+		rec, err := decodeRecord(payload)
+		if err != nil {
+			break
+		}
+		if rec.Seq > w.seq {
+			if err := ss.applyLocked(rec); err != nil {
+				return err
+			}
+			w.seq = rec.Seq
+		}
+		offset += int64(len(header) + len(payload))
+		w.records++
+	}
+	log.Printf("Discarding torn write-ahead log tail at offset %d", offset)
+	return w.file.Truncate(offset)
+}
+
+// compactLocked writes a snapshot of the server's data and then empties
+// the log. The snapshot is written to a temporary file and renamed into
+// place, so a crash leaves either the old or the new snapshot intact.
+func (ss *storageServer) compactLocked() error {
+	w := ss.wal
+	snap := snapshot{
+		Seq:       w.seq,
+		Versions:  ss.versions,
+		Deleted:   ss.deleted,
+		Expires:   ss.expires,
+		Prepared:  ss.prepared,
+		Completed: ss.completed,
+		Decided:   ss.committed,
+
+		LeaseHorizon: ss.leaseHorizon,
+	}
+	if ss.store.durable() {
+		// The engine's data need only be durable before the log records
+		// that wrote it are discarded.
+		if err := ss.store.checkpoint(w.seq); err != nil {
+			return err
+		}
+		snap.InEngine = true
+	} else {
+		var err error
+		if snap.Values, snap.Lists, err = ss.store.snapshot(); err != nil {
+			return err
+		}
+	}
+	path := filepath.Join(w.dir, snapshotFileName)
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(tmp)
+	if err := gob.NewEncoder(bw).Encode(&snap); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	// Make sure the rename is durable before discarding the log.
+	if err := syncDir(w.dir); err != nil {
+		return err
+	}
+	return w.truncate()
+}
+
+// syncDir makes the creation, removal and renaming of files in dir durable.
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	file.Close()
+	return err
+}
+
+// coverLeaseLocked makes sure that the logged lease horizon is no earlier
+// than expires, so that a server restarted before then holds its writes
+// until a lease expiring then has expired. It reports whether a lease
+// expiring then may be granted.
+func (ss *storageServer) coverLeaseLocked(expires time.Time) bool {
+	if ss.wal == nil || expires.UnixNano() <= ss.leaseHorizon {
+		return true
+	}
+	rec := &logRecord{Op: opLeaseHorizon, Expires: expires.Add(leaseHorizonSlack).UnixNano()}
+	if err := ss.wal.append(rec); err != nil {
+		log.Println("Failed to log lease horizon:", err)
+		return false
+	}
+	return ss.applyLocked(rec) == nil
+}
+
+func (ss *storageServer) compactPeriodically() {
+	for range time.Tick(snapshotInterval) {
+		ss.dataLock.Lock()
+		if ss.wal.records > 0 {
+			if err := ss.compactLocked(); err != nil {
+				log.Println("Failed to compact write-ahead log:", err)
+			}
+		}
+		ss.dataLock.Unlock()
+	}
+}
@@ -0,0 +1,165 @@
+package storageserver
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/rpc"
+	"strings"
+	"time"
+
+	"github.com/cmu440/tribbler/rpc/storagerpc"
+)
+
+// Libstores may watch keys, or prefixes of keys, to be notified of their
+// writes. After each write, the key's primary queues an event for every
+// Libstore watching the key, and a goroutine per Libstore sends its queued
+// events in batches. Writes thus do not wait for the notifications, and each
+// Libstore receives its events in order. A Libstore that does not
+// acknowledge a batch, or whose queue overflows, loses its watches on this
+// server.
+
+const (
+	maxQueuedEvents  = 1000            // Events queued for a Libstore before it loses its watches.
+	maxEventBatch    = 100             // Events sent to a Libstore at a time.
+	watchCallTimeout = 5 * time.Second // How long a Libstore may take to acknowledge a batch.
+)
+
+// watcher holds the watches of one Libstore.
+type watcher struct {
+	hostPort string
+	keys     map[string]bool
+	prefixes map[string]bool
+	events   chan storagerpc.WatchEvent // Events not yet sent; closed once the watches are dropped.
+}
+
+func (w *watcher) matches(key string) bool {
+	if w.keys[key] {
+		return true
+	}
+	for prefix := range w.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ss *storageServer) Watch(args *storagerpc.WatchArgs, reply *storagerpc.WatchReply) error {
+	if args.HostPort == "" {
+		return errors.New("no callback host:port given")
+	}
+	ss.watchLock.Lock()
+	defer ss.watchLock.Unlock()
+	w, ok := ss.watchers[args.HostPort]
+	if !ok {
+		w = &watcher{
+			hostPort: args.HostPort,
+			keys:     make(map[string]bool),
+			prefixes: make(map[string]bool),
+			events:   make(chan storagerpc.WatchEvent, maxQueuedEvents),
+		}
+		ss.watchers[args.HostPort] = w
+		go ss.deliverEvents(w)
+	}
+	if args.Prefix {
+		w.prefixes[args.Key] = true
+	} else {
+		w.keys[args.Key] = true
+	}
+	reply.Status = storagerpc.OK
+	return nil
+}
+
+func (ss *storageServer) Unwatch(args *storagerpc.WatchArgs, reply *storagerpc.WatchReply) error {
+	ss.watchLock.Lock()
+	defer ss.watchLock.Unlock()
+	reply.Status = storagerpc.OK
+	w, ok := ss.watchers[args.HostPort]
+	if !ok {
+		return nil
+	}
+	if args.Prefix {
+		delete(w.prefixes, args.Key)
+	} else {
+		delete(w.keys, args.Key)
+	}
+	if len(w.keys) == 0 && len(w.prefixes) == 0 {
+		ss.dropWatcherLocked(w)
+	}
+	return nil
+}
+
+// dropWatcherLocked forgets w's watches, unless they already were.
+func (ss *storageServer) dropWatcherLocked(w *watcher) {
+	if ss.watchers[w.hostPort] == w {
+		delete(ss.watchers, w.hostPort)
+		close(w.events)
+	}
+}
+
+// notifyWatchers queues an event describing rec, which this server has just
+// made as the primary of rec's key, for the Libstores watching the key.
+func (ss *storageServer) notifyWatchers(rec *logRecord) {
+	ss.watchLock.Lock()
+	defer ss.watchLock.Unlock()
+	event := storagerpc.WatchEvent{Key: rec.Key, Op: rec.Op, Value: rec.Value, Version: rec.Version}
+	for _, w := range ss.watchers {
+		if !w.matches(rec.Key) {
+			continue
+		}
+		select {
+		case w.events <- event:
+		default:
+			log.Printf("Dropping the watches of %s, which fell %d events behind", w.hostPort, maxQueuedEvents)
+			ss.dropWatcherLocked(w)
+		}
+	}
+}
+
+// deliverEvents sends w's events to its Libstore until its watches are
+// dropped.
+func (ss *storageServer) deliverEvents(w *watcher) {
+	for event := range w.events {
+		batch := []storagerpc.WatchEvent{event}
+	more:
+		for len(batch) < maxEventBatch {
+			select {
+			case event, ok := <-w.events:
+				if !ok {
+					break more
+				}
+				batch = append(batch, event)
+			default:
+				break more
+			}
+		}
+		if err := ss.sendEvents(w.hostPort, batch); err != nil {
+			log.Printf("Dropping the watches of %s: %s", w.hostPort, err)
+			ss.watchLock.Lock()
+			ss.dropWatcherLocked(w)
+			ss.watchLock.Unlock()
+			return
+		}
+	}
+}
+
+// sendEvents sends a batch of events to the Libstore at hostPort.
+func (ss *storageServer) sendEvents(hostPort string, events []storagerpc.WatchEvent) error {
+	cli, err := ss.client(hostPort)
+	if err != nil {
+		return err
+	}
+	var reply storagerpc.KeyChangedReply
+	call := cli.Go("LeaseCallbacks.KeyChanged", &storagerpc.KeyChangedArgs{Events: events}, &reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			ss.dropClient(hostPort, cli)
+			return call.Error
+		}
+	case <-time.After(watchCallTimeout):
+		return fmt.Errorf("no reply within %s", watchCallTimeout)
+	}
+	return nil
+}
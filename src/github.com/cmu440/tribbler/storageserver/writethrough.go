@@ -0,0 +1,105 @@
+package storageserver
+
+import (
+	"net/rpc"
+	"time"
+
+	"github.com/cmu440/tribbler/rpc/storagerpc"
+)
+
+// Libstores may ask for write-through leases, whose holders are sent each
+// write to the key (through their UpdateLease callback) instead of having the
+// lease revoked. A holder that applies the write keeps its lease, and thus
+// need not fetch the key again. A holder that cannot apply it, because it
+// missed an earlier write, drops the key from its cache and replies so; the
+// lease then ends, as if it had been revoked. The write does not return until
+// every holder has replied or its lease has expired, so holders never serve a
+// value older than the latest completed write.
+
+// writeThrough makes the write rec, as write does, after revoking the leases
+// on rec's key, except the write-through leases, whose holders are sent the
+// write once it is made.
+func (ss *storageServer) writeThrough(rec *logRecord, version *uint64) error {
+	kept := ss.revokeLeasesKeeping(rec.Key, true)
+	if err := ss.write(rec, version); err != nil {
+		ss.revokeHolders(rec.Key, kept)
+		return err
+	}
+	ss.pushWrite(rec, kept)
+	return nil
+}
+
+// pushWrite sends rec to the holders of write-through leases on its key,
+// returning once each has replied or its lease has expired. The holders that
+// applied rec keep their leases.
+func (ss *storageServer) pushWrite(rec *logRecord, holders map[string]leaseGrant) {
+	args := &storagerpc.UpdateLeaseArgs{Key: rec.Key, Op: rec.Op, Value: rec.Value, Version: rec.Version}
+	if rec.Expires != 0 {
+		args.TTL = time.Until(time.Unix(0, rec.Expires))
+	}
+	done := make(chan struct{}, len(holders))
+	for hostPort, grant := range holders {
+		go func(hostPort string, grant leaseGrant) {
+			if ss.updateLease(hostPort, args, grant.expires) {
+				ss.keepLease(rec.Key, hostPort, grant)
+			}
+			done <- struct{}{}
+		}(hostPort, grant)
+	}
+	for range holders {
+		<-done
+	}
+}
+
+// updateLease sends a write to the Libstore at hostPort, whose lease expires
+// at expiry, reporting whether the Libstore applied it.
+func (ss *storageServer) updateLease(hostPort string, args *storagerpc.UpdateLeaseArgs, expiry time.Time) bool {
+	timeout := time.After(time.Until(expiry))
+	cli, err := ss.client(hostPort)
+	if err != nil {
+		<-timeout
+		ss.recordRevocation(hostPort, false)
+		return false
+	}
+	var reply storagerpc.UpdateLeaseReply
+	call := cli.Go("LeaseCallbacks.UpdateLease", args, &reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			ss.dropClient(hostPort, cli)
+			<-timeout
+			ss.recordRevocation(hostPort, false)
+			return false
+		}
+	case <-timeout:
+		ss.recordRevocation(hostPort, false)
+		return false
+	}
+	if reply.Status != storagerpc.OK {
+		// The Libstore dropped the key instead.
+		ss.recordRevocation(hostPort, true)
+		return false
+	}
+	ss.dataLock.Lock()
+	ss.leaseStats.Updates++
+	ss.dataLock.Unlock()
+	return true
+}
+
+// keepLease restores the lease on key of the Libstore at hostPort, which
+// applied the latest write, unless it has since been granted a newer one.
+func (ss *storageServer) keepLease(key, hostPort string, grant leaseGrant) {
+	ss.dataLock.Lock()
+	defer ss.dataLock.Unlock()
+	if !time.Now().Before(grant.expires) {
+		return
+	}
+	ls, ok := ss.leases[key]
+	if !ok {
+		ls = &leaseState{holders: make(map[string]leaseGrant)}
+		ss.leases[key] = ls
+	}
+	if newer, ok := ls.holders[hostPort]; !ok || newer.expires.Before(grant.expires) {
+		ls.holders[hostPort] = grant
+	}
+}
@@ -0,0 +1,83 @@
+// A tool that reports each storage server's share of the keys, given the
+// ring reported by a running storage server. If -max is set, it also tests
+// that no server's share exceeds its fair share by more than that factor.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/rpc"
+	"os"
+	"sort"
+
+	"github.com/cmu440/tribbler/libstore"
+	"github.com/cmu440/tribbler/rpc/storagerpc"
+)
+
+var (
+	numKeys  = flag.Int("keys", 100000, "number of user keys to sample")
+	maxRatio = flag.Float64("max", 0, "fail if any server's share exceeds its fair share by this factor (0 to only report)")
+)
+
+var LOGE = log.New(os.Stderr, "", log.Lshortfile|log.Lmicroseconds)
+
+func main() {
+	flag.Parse()
+	if flag.NArg() < 1 {
+		LOGE.Fatalln("Usage: balancetest <storage server>")
+	}
+
+	cli, err := rpc.DialHTTP("tcp", flag.Arg(0))
+	if err != nil {
+		LOGE.Fatalln("Failed to connect to storage server:", err)
+	}
+	var reply storagerpc.GetServersReply
+	if err := cli.Call("StorageServer.GetServers", &storagerpc.GetServersArgs{}, &reply); err != nil {
+		LOGE.Fatalln("Failed to get servers:", err)
+	}
+	if reply.Status != storagerpc.OK {
+		LOGE.Fatalln("Storage servers are not ready:", reply.Status)
+	}
+
+	// Count the keys each node owns, and those it stores (as either the
+	// owner or a replica).
+	ring := storagerpc.NewRing(reply.Servers, reply.ReplicationFactor)
+	counts := make(map[string]int)
+	stored := make(map[string]int)
+	copies := 0
+	for i := 0; i < *numKeys; i++ {
+		set := ring.ReplicaSet(libstore.StoreHash(fmt.Sprintf("user%d", i)))
+		counts[set[0]]++
+		for _, hostPort := range set {
+			stored[hostPort]++
+		}
+		copies += len(set)
+	}
+
+	servers := reply.Servers
+	sort.Slice(servers, func(i, j int) bool { return servers[i].NodeID < servers[j].NodeID })
+	fair := 1 / float64(len(servers))
+	worst := 0.0
+	for _, n := range servers {
+		share := float64(counts[n.HostPort]) / float64(*numKeys)
+		storedShare := float64(stored[n.HostPort]) / float64(copies)
+		fmt.Printf("%-21s id=%-10d points=%-4d share=%5.1f%% stored=%5.1f%%\n", n.HostPort, n.NodeID, 1+len(n.VirtualIDs), 100*share, 100*storedShare)
+		if share/fair > worst {
+			worst = share / fair
+		}
+		if storedShare/fair > worst {
+			worst = storedShare / fair
+		}
+	}
+	fmt.Printf("Largest share is %.2f times the fair share\n", worst)
+
+	if *maxRatio > 0 {
+		if worst <= *maxRatio {
+			fmt.Println("PASS")
+		} else {
+			fmt.Println("FAIL")
+		}
+	}
+}
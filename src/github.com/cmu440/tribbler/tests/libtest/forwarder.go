@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// forwarder relays TCP connections to a server, and can break them to
+// simulate network failures between a Libstore and a storage server.
+type forwarder struct {
+	l      net.Listener
+	target string
+
+	lock      sync.Mutex
+	conns     []net.Conn    // Both ends of every relayed connection.
+	dropReply bool          // Whether to break the connection carrying the next reply.
+	refuse    bool          // Whether to close new connections at once.
+	delay     time.Duration // How long to hold each reply before relaying it.
+}
+
+func newForwarder(target string) (*forwarder, error) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return nil, err
+	}
+	f := &forwarder{l: l, target: target}
+	go f.serve()
+	return f, nil
+}
+
+// addr returns the host:port that the forwarder listens on.
+func (f *forwarder) addr() string {
+	return f.l.Addr().String()
+}
+
+func (f *forwarder) serve() {
+	for {
+		conn, err := f.l.Accept()
+		if err != nil {
+			return
+		}
+		go f.relay(conn)
+	}
+}
+
+func (f *forwarder) relay(conn net.Conn) {
+	f.lock.Lock()
+	refuse := f.refuse
+	f.lock.Unlock()
+	if refuse {
+		conn.Close()
+		return
+	}
+	server, err := net.Dial("tcp", f.target)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	f.lock.Lock()
+	f.conns = append(f.conns, conn, server)
+	f.lock.Unlock()
+	defer conn.Close()
+	defer server.Close()
+
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				if _, err := server.Write(buf[:n]); err != nil {
+					break
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		conn.Close()
+		server.Close()
+	}()
+	buf := make([]byte, 4096)
+	for {
+		n, err := server.Read(buf)
+		if n > 0 {
+			if f.takeDropReply() {
+				return
+			}
+			f.lock.Lock()
+			delay := f.delay
+			f.lock.Unlock()
+			time.Sleep(delay)
+			if _, err := conn.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (f *forwarder) takeDropReply() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	drop := f.dropReply
+	f.dropReply = false
+	return drop
+}
+
+// dropNextReply makes the forwarder break the connection carrying the next
+// reply from the server instead of relaying the reply, as if the connection
+// failed after the server received the request.
+func (f *forwarder) dropNextReply() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.dropReply = true
+}
+
+// refuseNew makes the forwarder close the connections it accepts from now
+// on, so that dialing through it fails, or stop doing so.
+func (f *forwarder) refuseNew(refuse bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.refuse = refuse
+}
+
+// delayReplies makes the forwarder hold each reply from the server for
+// delay before relaying it.
+func (f *forwarder) delayReplies(delay time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.delay = delay
+}
+
+// sever breaks every connection relayed so far.
+func (f *forwarder) sever() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+	f.conns = nil
+}
+
+// close stops accepting connections and breaks those relayed so far.
+func (f *forwarder) close() {
+	f.l.Close()
+	f.sever()
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -40,6 +41,17 @@ var LOGE = log.New(os.Stderr, "", log.Lshortfile|log.Lmicroseconds)
 
 // Initialize proxy and libstore
 func initLibstore(storage, server, myhostport string, alwaysLease bool) (net.Listener, error) {
+	return initLibstoreWithOptions(storage, server, myhostport, alwaysLease, libstore.Options{})
+}
+
+// Initialize proxy and libstore with optional libstore settings
+func initLibstoreWithOptions(storage, server, myhostport string, alwaysLease bool, opts libstore.Options) (net.Listener, error) {
+	return initLibstoreVia(storage, server, server, myhostport, alwaysLease, opts)
+}
+
+// Initialize proxy and libstore, with the proxy reporting that the storage
+// node is at node (rather than at server, where the proxy listens)
+func initLibstoreVia(storage, server, node, myhostport string, alwaysLease bool, opts libstore.Options) (net.Listener, error) {
 	l, err := net.Listen("tcp", server)
 	if err != nil {
 		LOGE.Println("Failed to listen:", err)
@@ -49,7 +61,7 @@ func initLibstore(storage, server, myhostport string, alwaysLease bool) (net.Lis
 	// The ProxyServer acts like a "StorageServer" in the system, but also has some
 	// additional functionalities that allow us to enforce the number of RPCs made
 	// to the storage server, etc.
-	proxyCounter, err := proxycounter.NewProxyCounter(storage, server)
+	proxyCounter, err := proxycounter.NewProxyCounter(storage, node)
 	if err != nil {
 		LOGE.Println("Failed to setup test:", err)
 		return nil, err
@@ -76,7 +88,7 @@ func initLibstore(storage, server, myhostport string, alwaysLease bool) (net.Lis
 	}
 
 	// Create and start the Libstore.
-	libstore, err := libstore.NewLibstore(server, myhostport, leaseMode)
+	libstore, err := libstore.NewLibstoreWithOptions([]string{server}, myhostport, leaseMode, opts)
 	if err != nil {
 		LOGE.Println("Failed to create Libstore:", err)
 		return nil, err
@@ -156,6 +168,391 @@ func checkError(err error, expectError bool) bool {
 	return false
 }
 
+// Request leases as decided by a configured lease policy
+func testLeasePolicy() {
+	policy := libstore.AlwaysLeasePrefixes(libstore.NeverLeasePrefixes(libstore.DefaultLeasePolicy(), "list:"), "user:")
+	l, err := initLibstoreWithOptions(flag.Arg(0), fmt.Sprintf("localhost:%d", *portnum), fmt.Sprintf("localhost:%d", *portnum), false, libstore.Options{LeasePolicy: policy})
+	if err != nil {
+		LOGE.Println("FAIL:", err)
+		failCount++
+		return
+	}
+	defer cleanupLibstore(l)
+	pc.Reset()
+	forceCacheGet("list:policy", "value")
+	if pc.GetLeaseRequestCount() > 0 {
+		LOGE.Println("FAIL: should not request leases for keys the policy never leases")
+		failCount++
+		return
+	}
+	ls.Put("user:policy", "value")
+	ls.Get("user:policy")
+	if pc.GetLeaseRequestCount() != 1 {
+		LOGE.Println("FAIL: should request a lease on the first read of keys the policy always leases")
+		failCount++
+		return
+	}
+	pc.Reset()
+	forceCacheGet("other:policy", "value")
+	if pc.GetLeaseRequestCount() == 0 {
+		LOGE.Println("FAIL: should request leases for other keys as usual")
+		failCount++
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+// Evict the least recently used keys once the cache is full
+func testCacheLimit() {
+	l, err := initLibstoreWithOptions(flag.Arg(0), fmt.Sprintf("localhost:%d", *portnum), fmt.Sprintf("localhost:%d", *portnum), true, libstore.Options{MaxCacheEntries: 2})
+	if err != nil {
+		LOGE.Println("FAIL:", err)
+		failCount++
+		return
+	}
+	defer cleanupLibstore(l)
+	for i := 1; i <= 3; i++ {
+		key := fmt.Sprintf("keycachelimit:%d", i)
+		ls.Put(key, "value")
+		if _, err := ls.Get(key); checkError(err, false) {
+			return
+		}
+		if i == 2 {
+			// use the first key again, so that the second is evicted
+			ls.Get("keycachelimit:1")
+		}
+	}
+	stats := ls.CacheStats()
+	if stats.Entries != 2 || stats.Evictions != 1 || stats.Hits != 1 || stats.Misses != 3 {
+		LOGE.Printf("FAIL: incorrect cache stats %+v\n", stats)
+		failCount++
+		return
+	}
+
+	// the evicted key's lease is no longer tracked
+	var reply storagerpc.RevokeLeaseReply
+	err = ls.(libstore.LeaseCallbacks).RevokeLease(&storagerpc.RevokeLeaseArgs{Key: "keycachelimit:2"}, &reply)
+	if checkError(err, false) {
+		return
+	}
+	if reply.Status != storagerpc.KeyNotFound {
+		LOGE.Println("FAIL: evicted key should not be found when its lease is revoked")
+		failCount++
+		return
+	}
+	pc.Reset()
+	if _, err := ls.Get("keycachelimit:1"); checkError(err, false) {
+		return
+	}
+	if pc.GetRpcCount() > 0 {
+		LOGE.Println("FAIL: recently used key should still be cached")
+		failCount++
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+// Spread concurrent calls over a bounded pool of connections
+func testConnPool() {
+	server := fmt.Sprintf("localhost:%d", *portnum)
+	l, err := initLibstoreWithOptions(flag.Arg(0), server, "", false, libstore.Options{PoolSize: 2})
+	if err != nil {
+		LOGE.Println("FAIL:", err)
+		failCount++
+		return
+	}
+	defer cleanupLibstore(l)
+	if err := ls.Put("keypool:1", "value"); checkError(err, false) {
+		return
+	}
+	errs := make(chan error, 20)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			_, err := ls.Get("keypool:1")
+			errs <- err
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if checkError(<-errs, false) {
+			return
+		}
+	}
+	stats := ls.ConnStats()
+	if len(stats) != 1 || stats[0].HostPort != server {
+		LOGE.Printf("FAIL: incorrect connection stats %+v\n", stats)
+		failCount++
+		return
+	}
+	if s := stats[0]; s.Conns < 1 || s.Conns > 2 || s.Dials > 2 || s.InFlight != 0 || s.Calls < 21 || s.Failures != 0 {
+		LOGE.Printf("FAIL: incorrect connection stats %+v\n", s)
+		failCount++
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+// Requests that fail to reach the storage server are resent on a fresh
+// connection, and resent writes are made only once
+func testRetryRedial() {
+	server := fmt.Sprintf("localhost:%d", *portnum)
+	f, err := newForwarder(server)
+	if err != nil {
+		LOGE.Println("FAIL:", err)
+		failCount++
+		return
+	}
+	defer f.close()
+	l, err := initLibstoreVia(flag.Arg(0), server, f.addr(), "", false, libstore.Options{})
+	if err != nil {
+		LOGE.Println("FAIL:", err)
+		failCount++
+		return
+	}
+	defer cleanupLibstore(l)
+	if err := ls.Put("keyretry:1", "value"); checkError(err, false) {
+		return
+	}
+
+	f.sever()
+	if v, err := ls.Get("keyretry:1"); checkError(err, false) {
+		return
+	} else if v != "value" {
+		LOGE.Println("FAIL: got wrong value")
+		failCount++
+		return
+	}
+
+	f.dropNextReply()
+	if err := ls.AppendToList("keyretry:2", "item"); checkError(err, false) {
+		return
+	}
+	if v, err := ls.GetList("keyretry:2"); checkError(err, false) {
+		return
+	} else if len(v) != 1 || v[0] != "item" {
+		LOGE.Println("FAIL: resent append was made more than once:", v)
+		failCount++
+		return
+	}
+
+	var stats libstore.ConnStats
+	for _, s := range ls.ConnStats() {
+		if s.HostPort == f.addr() {
+			stats = s
+		}
+	}
+	if stats.Dials < 3 || stats.Failures < 2 {
+		LOGE.Printf("FAIL: expected broken connections to be redialed, got stats %+v\n", stats)
+		failCount++
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+// Calls share a busy connection when a new one cannot be dialed
+func testPoolDialFallback() {
+	server := fmt.Sprintf("localhost:%d", *portnum)
+	f, err := newForwarder(server)
+	if err != nil {
+		LOGE.Println("FAIL:", err)
+		failCount++
+		return
+	}
+	defer f.close()
+	l, err := initLibstoreVia(flag.Arg(0), server, f.addr(), "", false, libstore.Options{PoolSize: 2})
+	if err != nil {
+		LOGE.Println("FAIL:", err)
+		failCount++
+		return
+	}
+	defer cleanupLibstore(l)
+	errs := make(chan error, 5)
+	for i := 0; i < cap(errs); i++ {
+		if err := ls.Put(fmt.Sprintf("keyfallback:%d", i), "value"); checkError(err, false) {
+			return
+		}
+	}
+
+	// Keep the open connection busy while dials to a second one fail.
+	// CompareAndSwap is not resent, so a failed dial would fail the call.
+	f.refuseNew(true)
+	f.delayReplies(200 * time.Millisecond)
+	for i := 0; i < cap(errs); i++ {
+		go func(key string) {
+			errs <- ls.CompareAndSwap(key, "value", "value2")
+		}(fmt.Sprintf("keyfallback:%d", i))
+	}
+	for i := 0; i < cap(errs); i++ {
+		if checkError(<-errs, false) {
+			return
+		}
+	}
+
+	var stats libstore.ConnStats
+	for _, s := range ls.ConnStats() {
+		if s.HostPort == f.addr() {
+			stats = s
+		}
+	}
+	if stats.Conns != 1 || stats.Dials != 1 || stats.Failures != 0 {
+		LOGE.Printf("FAIL: expected calls to share the open connection, got stats %+v\n", stats)
+		failCount++
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+// Requests to a storage server reported dead fail without being sent
+func testFailFast() {
+	server := fmt.Sprintf("localhost:%d", *portnum)
+	l, err := initLibstore(flag.Arg(0), server, "", false)
+	if err != nil {
+		LOGE.Println("FAIL:", err)
+		failCount++
+		return
+	}
+	defer cleanupLibstore(l)
+	defer pc.OverrideLiveness(storagerpc.Alive)
+	if err := ls.Put("keyfailfast:1", "value"); checkError(err, false) {
+		return
+	}
+
+	// Wait for the Libstore to refresh the ring, learning that the
+	// storage server is dead.
+	pc.OverrideLiveness(storagerpc.Dead)
+	time.Sleep(3 * time.Second)
+	pc.Reset()
+	start := time.Now()
+	if _, err := ls.Get("keyfailfast:1"); checkError(err, true) {
+		return
+	}
+	if err := ls.Put("keyfailfast:1", "value2"); checkError(err, true) {
+		return
+	}
+	if pc.GetRpcCount() > 0 {
+		LOGE.Println("FAIL: sent requests to a dead storage server")
+		failCount++
+		return
+	}
+	if time.Since(start) > time.Second {
+		LOGE.Println("FAIL: requests to a dead storage server did not fail fast")
+		failCount++
+		return
+	}
+
+	pc.OverrideLiveness(storagerpc.Alive)
+	time.Sleep(3 * time.Second)
+	if v, err := ls.Get("keyfailfast:1"); checkError(err, false) {
+		return
+	} else if v != "value" {
+		LOGE.Println("FAIL: got wrong value")
+		failCount++
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+// Writes to keys cached under write-through leases update the cache in place
+func testWriteThrough() {
+	// The storage server keeps its connection to this Libstore's callback
+	// address, which would reach this Libstore in later tests, so the
+	// callbacks are given a different name for the same address.
+	server := fmt.Sprintf("localhost:%d", *portnum)
+	callbacks := fmt.Sprintf("127.0.0.1:%d", *portnum)
+	l, err := initLibstoreWithOptions(flag.Arg(0), server, callbacks, true, libstore.Options{WriteThrough: true})
+	if err != nil {
+		LOGE.Println("FAIL:", err)
+		failCount++
+		return
+	}
+	defer cleanupLibstore(l)
+	if err := ls.Put("keywritethrough:1", "value1"); checkError(err, false) {
+		return
+	}
+	if err := ls.AppendToList("keywritethrough:2", "item1"); checkError(err, false) {
+		return
+	}
+	if _, err := ls.Get("keywritethrough:1"); checkError(err, false) {
+		return
+	}
+	if _, err := ls.GetList("keywritethrough:2"); checkError(err, false) {
+		return
+	}
+	if err := ls.Put("keywritethrough:1", "value2"); checkError(err, false) {
+		return
+	}
+	if err := ls.AppendToList("keywritethrough:2", "item2"); checkError(err, false) {
+		return
+	}
+
+	// the new values are read from the cache
+	pc.Reset()
+	if v, err := ls.Get("keywritethrough:1"); checkError(err, false) {
+		return
+	} else if v != "value2" {
+		LOGE.Println("FAIL: got wrong value")
+		failCount++
+		return
+	}
+	if v, err := ls.GetList("keywritethrough:2"); checkError(err, false) {
+		return
+	} else if len(v) != 2 || v[0] != "item1" || v[1] != "item2" {
+		LOGE.Println("FAIL: got wrong value")
+		failCount++
+		return
+	}
+	if pc.GetRpcCount() > 0 {
+		LOGE.Println("FAIL: should read written values from the cache")
+		failCount++
+		return
+	}
+	if stats := ls.CacheStats(); stats.Updates != 2 {
+		LOGE.Printf("FAIL: incorrect cache stats %+v\n", stats)
+		failCount++
+		return
+	}
+
+	// a key recreated after it expires keeps counting versions up, so that
+	// updates to the new key are not mistaken for ones already applied
+	if err := ls.PutWithTTL("keywritethrough:3", "value1", time.Second); checkError(err, false) {
+		return
+	}
+	_, expired, err := ls.GetVersion("keywritethrough:3")
+	if checkError(err, false) {
+		return
+	}
+	time.Sleep(3 * time.Second)
+	if err := ls.Put("keywritethrough:3", "value2"); checkError(err, false) {
+		return
+	}
+	if _, _, err := ls.GetVersion("keywritethrough:3"); checkError(err, false) {
+		return
+	}
+	if err := ls.Put("keywritethrough:3", "value3"); checkError(err, false) {
+		return
+	}
+	pc.Reset()
+	if v, version, err := ls.GetVersion("keywritethrough:3"); checkError(err, false) {
+		return
+	} else if v != "value3" || version <= expired {
+		LOGE.Printf("FAIL: got value %q at version %d after version %d expired\n", v, version, expired)
+		failCount++
+		return
+	}
+	if pc.GetRpcCount() > 0 {
+		LOGE.Println("FAIL: should apply updates to a recreated key in the cache")
+		failCount++
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
 // Test libstore returns nil when it cannot connect to the server
 func testNonexistentServer() {
 	if l, err := libstore.NewLibstore(fmt.Sprintf("localhost:%d", *portnum), fmt.Sprintf("localhost:%d", *portnum), libstore.Normal); l == nil || err != nil {
@@ -316,6 +713,245 @@ func testPutValid() {
 	passCount++
 }
 
+// Handle compare-and-swap with a failed precondition
+func testCompareAndSwapPrecondition() {
+	pc.Reset()
+	err := ls.Put("key:7", "value")
+	if checkError(err, false) {
+		return
+	}
+	err = ls.CompareAndSwap("key:7", "wrong-value", "value1")
+	if err != libstore.ErrPreconditionFailed {
+		LOGE.Println("FAIL: expected ErrPreconditionFailed, got:", err)
+		failCount++
+		return
+	}
+	if checkLimits(5, 50) {
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+// Handle valid compare-and-swap
+func testCompareAndSwapValid() {
+	pc.Reset()
+	err := ls.Put("key:8", "value")
+	if checkError(err, false) {
+		return
+	}
+	err = ls.CompareAndSwap("key:8", "value", "value1")
+	if checkError(err, false) {
+		return
+	}
+	if checkLimits(5, 50) {
+		return
+	}
+	v, err := ls.Get("key:8")
+	if checkError(err, false) {
+		return
+	}
+	if v != "value1" {
+		LOGE.Println("FAIL: got wrong value")
+		failCount++
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+// Handle versioned put
+func testPutIfVersion() {
+	err := ls.Put("key:9", "value")
+	if checkError(err, false) {
+		return
+	}
+	_, version, err := ls.GetVersion("key:9")
+	if checkError(err, false) {
+		return
+	}
+	pc.Reset()
+	err = ls.PutIfVersion("key:9", "value1", version+1)
+	if err != libstore.ErrPreconditionFailed {
+		LOGE.Println("FAIL: expected ErrPreconditionFailed, got:", err)
+		failCount++
+		return
+	}
+	err = ls.PutIfVersion("key:9", "value1", version)
+	if checkError(err, false) {
+		return
+	}
+	if checkLimits(5, 50) {
+		return
+	}
+	v, newVersion, err := ls.GetVersion("key:9")
+	if checkError(err, false) {
+		return
+	}
+	if v != "value1" {
+		LOGE.Println("FAIL: got wrong value")
+		failCount++
+		return
+	}
+	if newVersion <= version {
+		LOGE.Println("FAIL: version did not increase")
+		failCount++
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+// Handle multi-get error
+func testMultiGetError() {
+	pc.Reset()
+	pc.OverrideErr()
+	defer pc.OverrideOff()
+	_, err := ls.MultiGet([]string{"key:1", "key:2"})
+	if checkError(err, true) {
+		return
+	}
+	if checkLimits(5, 50) {
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+// Handle valid multi-get with a single RPC
+func testMultiGetValid() {
+	ls.Put("keymulti:1", "value1")
+	ls.Put("keymulti:2", "value2")
+	pc.Reset()
+	v, err := ls.MultiGet([]string{"keymulti:1", "keymulti:2", "keymulti:3", "keymulti:1"})
+	if checkError(err, false) {
+		return
+	}
+	if len(v) != 2 || v["keymulti:1"] != "value1" || v["keymulti:2"] != "value2" {
+		LOGE.Println("FAIL: got wrong values")
+		failCount++
+		return
+	}
+	if pc.GetRpcCount() != 1 {
+		LOGE.Println("FAIL: should batch keys stored on the same server")
+		failCount++
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+// Handle valid multi-get list with a single RPC
+func testMultiGetListValid() {
+	ls.AppendToList("keymultilist:1", "value1")
+	ls.AppendToList("keymultilist:2", "value2")
+	pc.Reset()
+	v, err := ls.MultiGetList([]string{"keymultilist:1", "keymultilist:2", "keymultilist:3"})
+	if checkError(err, false) {
+		return
+	}
+	if len(v) != 2 || len(v["keymultilist:1"]) != 1 || v["keymultilist:1"][0] != "value1" ||
+		len(v["keymultilist:2"]) != 1 || v["keymultilist:2"][0] != "value2" {
+		LOGE.Println("FAIL: got wrong values")
+		failCount++
+		return
+	}
+	if pc.GetRpcCount() != 1 {
+		LOGE.Println("FAIL: should batch keys stored on the same server")
+		failCount++
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+// Handle valid prefix scan
+func testScanPrefixValid() {
+	ls.Put("keyscan:2", "value")
+	ls.Put("keyscan:1", "value")
+	ls.AppendToList("keyscan:3", "value")
+	ls.Put("keyscanner:1", "value")
+	pc.Reset()
+	keys, err := ls.ScanPrefix("keyscan:")
+	if checkError(err, false) {
+		return
+	}
+	if len(keys) != 3 || keys[0] != "keyscan:1" || keys[1] != "keyscan:2" || keys[2] != "keyscan:3" {
+		LOGE.Println("FAIL: got wrong keys", keys)
+		failCount++
+		return
+	}
+	if checkLimits(5, 100) {
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+// Handle valid transaction with a single RPC
+func testTransactionValid() {
+	pc.Reset()
+	tx := ls.Begin()
+	tx.Put("keytx:1", "value")
+	tx.AppendToList("keytx:2", "value1")
+	tx.AppendToList("keytx:2", "value2")
+	err := tx.Commit()
+	if checkError(err, false) {
+		return
+	}
+	if pc.GetRpcCount() != 1 {
+		LOGE.Println("FAIL: should send the transaction in a single RPC")
+		failCount++
+		return
+	}
+	v, err := ls.Get("keytx:1")
+	if checkError(err, false) {
+		return
+	}
+	l, err := ls.GetList("keytx:2")
+	if checkError(err, false) {
+		return
+	}
+	if v != "value" || len(l) != 2 || l[0] != "value1" || l[1] != "value2" {
+		LOGE.Println("FAIL: got wrong values")
+		failCount++
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+// Handle transaction that cannot be committed, and one that is aborted
+func testTransactionAborted() {
+	ls.AppendToList("keytx:4", "value")
+	tx := ls.Begin()
+	tx.Put("keytx:3", "value")
+	tx.AppendToList("keytx:4", "value")
+	err := tx.Commit()
+	if checkError(err, true) {
+		return
+	}
+	tx = ls.Begin()
+	tx.Put("keytx:3", "value")
+	tx.Abort()
+	pc.Reset()
+	err = tx.Commit()
+	if checkError(err, false) {
+		return
+	}
+	if pc.GetRpcCount() != 0 {
+		LOGE.Println("FAIL: should not send an aborted transaction")
+		failCount++
+		return
+	}
+	_, err = ls.Get("keytx:3")
+	if checkError(err, true) {
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
 // Handle get list error
 func testGetListError() {
 	pc.Reset()
@@ -486,6 +1122,287 @@ func testRemoveFromListValid() {
 	passCount++
 }
 
+// Handle calls whose context is canceled or past its deadline
+func testContext() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	pc.Reset()
+	if _, err := ls.GetContext(ctx, "keycontext:1"); err != context.Canceled {
+		LOGE.Println("FAIL: expected context.Canceled, got:", err)
+		failCount++
+		return
+	}
+	if _, err := ls.MultiGetContext(ctx, []string{"keycontext:1", "keycontext:2"}); err != context.Canceled {
+		LOGE.Println("FAIL: expected context.Canceled, got:", err)
+		failCount++
+		return
+	}
+	if _, err := ls.MultiGetListContext(ctx, []string{"keycontext:3"}); err != context.Canceled {
+		LOGE.Println("FAIL: expected context.Canceled, got:", err)
+		failCount++
+		return
+	}
+	if pc.GetRpcCount() > 0 {
+		LOGE.Println("FAIL: should not send requests once the context is canceled")
+		failCount++
+		return
+	}
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	if err := ls.AppendToListContext(ctx, "keycontext:2", "value"); err != context.DeadlineExceeded {
+		LOGE.Println("FAIL: expected context.DeadlineExceeded, got:", err)
+		failCount++
+		return
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ls.PutContext(ctx, "keycontext:1", "value"); checkError(err, false) {
+		return
+	}
+	if v, err := ls.GetContext(ctx, "keycontext:1"); checkError(err, false) {
+		return
+	} else if v != "value" {
+		LOGE.Println("FAIL: got wrong value")
+		failCount++
+		return
+	}
+	if err := ls.AppendToListContext(ctx, "keycontext:3", "value1"); checkError(err, false) {
+		return
+	}
+	if err := ls.RemoveFromListContext(ctx, "keycontext:3", "value1"); checkError(err, false) {
+		return
+	}
+	if v, err := ls.GetListContext(ctx, "keycontext:3"); checkError(err, false) {
+		return
+	} else if len(v) != 0 {
+		LOGE.Println("FAIL: got wrong value")
+		failCount++
+		return
+	}
+	if v, err := ls.MultiGetContext(ctx, []string{"keycontext:1"}); checkError(err, false) {
+		return
+	} else if len(v) != 1 || v["keycontext:1"] != "value" {
+		LOGE.Println("FAIL: got wrong values")
+		failCount++
+		return
+	}
+	if v, err := ls.MultiGetListContext(ctx, []string{"keycontext:3"}); checkError(err, false) {
+		return
+	} else if len(v["keycontext:3"]) != 0 {
+		LOGE.Println("FAIL: got wrong lists")
+		failCount++
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+// Read your own writes through a session passed as a token
+func testSession() {
+	if _, err := libstore.ParseSession("not a token!"); err == nil {
+		LOGE.Println("FAIL: parsed an invalid session token")
+		failCount++
+		return
+	}
+	session := libstore.NewSession()
+	if session.Token() != "" {
+		LOGE.Println("FAIL: empty session should have an empty token")
+		failCount++
+		return
+	}
+	ctx := libstore.WithSession(context.Background(), session)
+	if err := ls.PutContext(ctx, "keysession:1", "value1"); checkError(err, false) {
+		return
+	}
+	if err := ls.AppendToListContext(ctx, "keysession:2", "value1"); checkError(err, false) {
+		return
+	}
+	token := session.Token()
+	if token == "" {
+		LOGE.Println("FAIL: session should record writes")
+		failCount++
+		return
+	}
+	parsed, err := libstore.ParseSession(token)
+	if checkError(err, false) {
+		return
+	}
+	if parsed.Token() != token {
+		LOGE.Println("FAIL: session token changed when parsed")
+		failCount++
+		return
+	}
+	ctx = libstore.WithSession(context.Background(), parsed)
+	for i := 0; i < 2*storagerpc.QueryCacheThresh; i++ {
+		if v, err := ls.GetContext(ctx, "keysession:1"); checkError(err, false) {
+			return
+		} else if v != "value1" {
+			LOGE.Println("FAIL: got wrong value")
+			failCount++
+			return
+		}
+		if v, err := ls.GetListContext(ctx, "keysession:2"); checkError(err, false) {
+			return
+		} else if len(v) != 1 || v[0] != "value1" {
+			LOGE.Println("FAIL: got wrong value")
+			failCount++
+			return
+		}
+	}
+
+	// values cached at the session's versions are served from the cache
+	pc.Reset()
+	if _, err := ls.GetContext(ctx, "keysession:1"); checkError(err, false) {
+		return
+	}
+	if pc.GetRpcCount() > 0 {
+		LOGE.Println("FAIL: should read values as recent as the session's from the cache")
+		failCount++
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+// Cached values older than the session's writes are never read, whichever
+// method reads them
+func testSessionStale() {
+	// Leases that the Libstore believes to outlast the storage server's,
+	// as if its clock ran slow.
+	pc.OverrideLeaseSeconds(120)
+	defer pc.OverrideLeaseSeconds(0)
+	forceCacheGet("keysession:3", "value1")
+	forceCacheGetList("keysession:4", "value1")
+	for i := 0; i < 2*storagerpc.QueryCacheThresh; i++ {
+		ls.MultiGet([]string{"keysession:3"})
+		ls.MultiGetList([]string{"keysession:4"})
+		ls.GetListRange("keysession:4", 0, 1, false)
+		ls.ListLength("keysession:4")
+	}
+	reads := []struct {
+		name string
+		read func(ctx context.Context) error
+	}{
+		{"MultiGetContext", func(ctx context.Context) error {
+			_, err := ls.MultiGetContext(ctx, []string{"keysession:3"})
+			return err
+		}},
+		{"MultiGetListContext", func(ctx context.Context) error {
+			_, err := ls.MultiGetListContext(ctx, []string{"keysession:4"})
+			return err
+		}},
+		{"GetListRangeContext", func(ctx context.Context) error {
+			_, err := ls.GetListRangeContext(ctx, "keysession:4", 0, 1, false)
+			return err
+		}},
+		{"ListLengthContext", func(ctx context.Context) error {
+			_, err := ls.ListLengthContext(ctx, "keysession:4")
+			return err
+		}},
+	}
+
+	// A session that writes the keys through another Libstore once the
+	// storage server's leases expire, so that this Libstore's cache misses
+	// the writes.
+	time.Sleep(time.Duration(storagerpc.MaxLeaseSeconds+storagerpc.LeaseGuardSeconds+1) * time.Second)
+	other, err := libstore.NewLibstore(flag.Arg(0), "", libstore.Never)
+	if checkError(err, false) {
+		return
+	}
+	session := libstore.NewSession()
+	ctx := libstore.WithSession(context.Background(), session)
+	if err := other.PutContext(ctx, "keysession:3", "value2"); checkError(err, false) {
+		return
+	}
+	if err := other.AppendToListContext(ctx, "keysession:4", "value2"); checkError(err, false) {
+		return
+	}
+	session, err = libstore.ParseSession(session.Token())
+	if checkError(err, false) {
+		return
+	}
+	for _, r := range reads {
+		pc.Reset()
+		if checkError(r.read(context.Background()), false) {
+			return
+		}
+		if pc.GetRpcCount() > 0 {
+			LOGE.Printf("FAIL: %s should read from the cache without a session\n", r.name)
+			failCount++
+			return
+		}
+		if checkError(r.read(libstore.WithSession(context.Background(), session)), false) {
+			return
+		}
+		if pc.GetRpcCount() == 0 {
+			LOGE.Printf("FAIL: %s read a cached value older than the session's writes\n", r.name)
+			failCount++
+			return
+		}
+	}
+
+	// Sessions forget the oldest writes beyond a bound, so that tokens
+	// stay small: once the bound is reached, further writes to keys of the
+	// same length leave the token's length unchanged.
+	session = libstore.NewSession()
+	ctx = libstore.WithSession(context.Background(), session)
+	var length int
+	for i := 0; i < 150; i++ {
+		if err := ls.PutContext(ctx, fmt.Sprintf("keysession:cap:%03d", i), "value"); checkError(err, false) {
+			return
+		}
+		if i == 99 {
+			length = len(session.Token())
+		}
+	}
+	if len(session.Token()) > length {
+		LOGE.Printf("FAIL: session token grew from %d to %d bytes past the bound\n", length, len(session.Token()))
+		failCount++
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+// Receive the writes to watched keys
+func testWatch() {
+	events := make(chan storagerpc.WatchEvent, 10)
+	unwatch, err := ls.WatchPrefix("keywatch:", func(event storagerpc.WatchEvent) {
+		events <- event
+	})
+	if checkError(err, false) {
+		return
+	}
+	if err := ls.AppendToList("keywatch:1", "value1"); checkError(err, false) {
+		return
+	}
+	select {
+	case event := <-events:
+		if event.Key != "keywatch:1" || event.Op != storagerpc.OpAppendToList || event.Value != "value1" {
+			LOGE.Printf("FAIL: got wrong event %+v\n", event)
+			failCount++
+			return
+		}
+	case <-time.After(2 * time.Second):
+		LOGE.Println("FAIL: did not receive the write to a watched key")
+		failCount++
+		return
+	}
+	unwatch()
+	if err := ls.AppendToList("keywatch:1", "value2"); checkError(err, false) {
+		return
+	}
+	select {
+	case event := <-events:
+		LOGE.Printf("FAIL: got event %+v after the watch was canceled\n", event)
+		failCount++
+		return
+	case <-time.After(500 * time.Millisecond):
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
 // Cache < limit test for get
 func testCacheGetLimit() {
 	pc.Reset()
@@ -539,6 +1456,108 @@ func testCacheGetCorrect() {
 	passCount++
 }
 
+// Cached values keep their versions
+func testCacheGetVersion() {
+	forceCacheGet("keycacheget:7", "value")
+	_, version, err := ls.GetVersion("keycacheget:7")
+	if checkError(err, false) {
+		return
+	}
+	pc.Reset()
+	v, cachedVersion, err := ls.GetVersion("keycacheget:7")
+	if checkError(err, false) {
+		return
+	}
+	if v != "value" {
+		LOGE.Println("FAIL: got wrong value from cache")
+		failCount++
+		return
+	}
+	if cachedVersion != version || version == 0 {
+		LOGE.Println("FAIL: got wrong version from cache")
+		failCount++
+		return
+	}
+	if pc.GetRpcCount() > 0 {
+		LOGE.Println("FAIL: should not contact server when using cache")
+		failCount++
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+// Cache does not serve values past their time-to-live
+func testCacheGetTTL() {
+	ls.PutWithTTL("keycacheget:8", "value", 2*time.Second)
+	for i := 0; i < 2*storagerpc.QueryCacheThresh; i++ {
+		ls.Get("keycacheget:8")
+	}
+	pc.Reset()
+	v, err := ls.Get("keycacheget:8")
+	if checkError(err, false) {
+		return
+	}
+	if v != "value" {
+		LOGE.Println("FAIL: got wrong value from cache")
+		failCount++
+		return
+	}
+	if pc.GetRpcCount() > 0 {
+		LOGE.Println("FAIL: should not contact server when using cache")
+		failCount++
+		return
+	}
+	time.Sleep(3 * time.Second)
+	if _, err = ls.Get("keycacheget:8"); checkError(err, true) {
+		return
+	}
+	if pc.GetRpcCount() == 0 {
+		LOGE.Println("FAIL: should contact server once the key expires")
+		failCount++
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+// Multi-get serves cached keys from the cache
+func testCacheMultiGet() {
+	forceCacheGet("keycacheget:9", "value1")
+	ls.Put("keycacheget:10", "value2")
+	pc.Reset()
+	v, err := ls.MultiGet([]string{"keycacheget:9"})
+	if checkError(err, false) {
+		return
+	}
+	if v["keycacheget:9"] != "value1" {
+		LOGE.Println("FAIL: got wrong value from cache")
+		failCount++
+		return
+	}
+	if pc.GetRpcCount() > 0 {
+		LOGE.Println("FAIL: should not contact server when using cache")
+		failCount++
+		return
+	}
+	v, err = ls.MultiGet([]string{"keycacheget:9", "keycacheget:10"})
+	if checkError(err, false) {
+		return
+	}
+	if v["keycacheget:9"] != "value1" || v["keycacheget:10"] != "value2" {
+		LOGE.Println("FAIL: got wrong values")
+		failCount++
+		return
+	}
+	if pc.GetRpcCount() != 1 {
+		LOGE.Println("FAIL: should fetch only uncached keys")
+		failCount++
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
 // Cache respects granted flag for get
 func testCacheGetLeaseNotGranted() {
 	pc.DisableLease()
@@ -806,6 +1825,65 @@ func testCacheGetListCorrect() {
 	passCount++
 }
 
+// Cached list ranges and lengths are served from the cache until the list changes
+func testCacheGetListRange() {
+	key := "keycachegetlistrange:1"
+	for _, item := range []string{"value1", "value2", "value3"} {
+		if err := ls.AppendToList(key, item); checkError(err, false) {
+			return
+		}
+	}
+	for i := 0; i < 2*storagerpc.QueryCacheThresh; i++ {
+		ls.GetListRange(key, 0, 2, true)
+		ls.ListLength(key)
+	}
+	pc.Reset()
+	v, err := ls.GetListRange(key, 0, 2, true)
+	if checkError(err, false) {
+		return
+	}
+	if len(v) != 2 || v[0] != "value2" || v[1] != "value3" {
+		LOGE.Println("FAIL: got wrong range")
+		failCount++
+		return
+	}
+	if n, err := ls.ListLength(key); checkError(err, false) {
+		return
+	} else if n != 3 {
+		LOGE.Println("FAIL: got wrong length")
+		failCount++
+		return
+	}
+	if pc.GetRpcCount() > 0 {
+		LOGE.Println("FAIL: should not contact server when using cache")
+		failCount++
+		return
+	}
+
+	// trimming the list revokes the cached range and length
+	if err := ls.TrimList(key, 1); checkError(err, false) {
+		return
+	}
+	v, err = ls.GetListRange(key, 0, 2, true)
+	if checkError(err, false) {
+		return
+	}
+	if len(v) != 1 || v[0] != "value3" {
+		LOGE.Println("FAIL: got wrong range after trimming")
+		failCount++
+		return
+	}
+	if n, err := ls.ListLength(key); checkError(err, false) {
+		return
+	} else if n != 1 {
+		LOGE.Println("FAIL: got wrong length after trimming")
+		failCount++
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
 // Cache respects granted flag for get list
 func testCacheGetListLeaseNotGranted() {
 	pc.DisableLease()
@@ -1027,6 +2105,13 @@ func main() {
 		{"testNonexistentServer", testNonexistentServer},
 		{"testNoLeases", testNoLeases},
 		{"testAlwaysLeases", testAlwaysLeases},
+		{"testLeasePolicy", testLeasePolicy},
+		{"testCacheLimit", testCacheLimit},
+		{"testConnPool", testConnPool},
+		{"testRetryRedial", testRetryRedial},
+		{"testPoolDialFallback", testPoolDialFallback},
+		{"testFailFast", testFailFast},
+		{"testWriteThrough", testWriteThrough},
 	}
 	tests := []testFunc{
 		{"testGetError", testGetError},
@@ -1035,6 +2120,15 @@ func main() {
 		{"testPutError", testPutError},
 		{"testPutErrorStatus", testPutErrorStatus},
 		{"testPutValid", testPutValid},
+		{"testCompareAndSwapPrecondition", testCompareAndSwapPrecondition},
+		{"testCompareAndSwapValid", testCompareAndSwapValid},
+		{"testPutIfVersion", testPutIfVersion},
+		{"testMultiGetError", testMultiGetError},
+		{"testMultiGetValid", testMultiGetValid},
+		{"testMultiGetListValid", testMultiGetListValid},
+		{"testScanPrefixValid", testScanPrefixValid},
+		{"testTransactionValid", testTransactionValid},
+		{"testTransactionAborted", testTransactionAborted},
 		{"testGetListError", testGetListError},
 		{"testGetListErrorStatus", testGetListErrorStatus},
 		{"testGetListValid", testGetListValid},
@@ -1044,9 +2138,16 @@ func main() {
 		{"testRemoveFromListError", testRemoveFromListError},
 		{"testRemoveFromListErrorStatus", testRemoveFromListErrorStatus},
 		{"testRemoveFromListValid", testRemoveFromListValid},
+		{"testContext", testContext},
+		{"testSession", testSession},
+		{"testSessionStale", testSessionStale},
+		{"testWatch", testWatch},
 		{"testCacheGetLimit", testCacheGetLimit},
 		{"testCacheGetLimit2", testCacheGetLimit2},
 		{"testCacheGetCorrect", testCacheGetCorrect},
+		{"testCacheGetVersion", testCacheGetVersion},
+		{"testCacheGetTTL", testCacheGetTTL},
+		{"testCacheMultiGet", testCacheMultiGet},
 		{"testCacheGetLeaseNotGranted", testCacheGetLeaseNotGranted},
 		{"testCacheGetLeaseNotGranted2", testCacheGetLeaseNotGranted2},
 		{"testCacheGetLeaseTimeout", testCacheGetLeaseTimeout},
@@ -1057,6 +2158,7 @@ func main() {
 		{"testCacheGetListLimit", testCacheGetListLimit},
 		{"testCacheGetListLimit2", testCacheGetListLimit2},
 		{"testCacheGetListCorrect", testCacheGetListCorrect},
+		{"testCacheGetListRange", testCacheGetListRange},
 		{"testCacheGetListLeaseNotGranted", testCacheGetListLeaseNotGranted},
 		{"testCacheGetListLeaseNotGranted2", testCacheGetListLeaseNotGranted2},
 		{"testCacheGetListLeaseTimeout", testCacheGetListLeaseTimeout},
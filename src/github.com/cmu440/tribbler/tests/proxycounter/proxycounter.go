@@ -21,6 +21,7 @@ type ProxyCounter interface {
 	OverrideErr()
 	OverrideStatus(status storagerpc.Status)
 	OverrideOff()
+	OverrideLiveness(liveness storagerpc.Liveness)
 	GetRpcCount() uint32
 	GetByteCount() uint32
 	GetLeaseRequestCount() uint32
@@ -39,6 +40,7 @@ type proxyCounter struct {
 	overrideStatus       storagerpc.Status
 	disableLease         bool
 	overrideLeaseSeconds int
+	liveness             storagerpc.Liveness
 }
 
 func init() {
@@ -92,6 +94,10 @@ func (pc *proxyCounter) OverrideOff() {
 	pc.overrideStatus = storagerpc.OK
 }
 
+func (pc *proxyCounter) OverrideLiveness(liveness storagerpc.Liveness) {
+	pc.liveness = liveness
+}
+
 func (pc *proxyCounter) GetRpcCount() uint32 {
 	return pc.rpcCount
 }
@@ -114,6 +120,10 @@ func (pc *proxyCounter) RegisterServer(args *storagerpc.RegisterArgs, reply *sto
 	return nil
 }
 
+func (pc *proxyCounter) UnregisterServer(args *storagerpc.UnregisterArgs, reply *storagerpc.UnregisterReply) error {
+	return nil
+}
+
 func (pc *proxyCounter) GetServers(args *storagerpc.GetServersArgs, reply *storagerpc.GetServersReply) error {
 	err := pc.srv.Call("StorageServer.GetServers", args, reply)
 	// Modify reply so node point to myself
@@ -121,6 +131,7 @@ func (pc *proxyCounter) GetServers(args *storagerpc.GetServersArgs, reply *stora
 		panic("ProxyCounter only works with 1 storage node")
 	} else if len(reply.Servers) == 1 {
 		reply.Servers[0].HostPort = pc.myhostport
+		reply.Liveness = map[string]storagerpc.Liveness{pc.myhostport: pc.liveness}
 	}
 	return err
 }
@@ -177,6 +188,134 @@ func (pc *proxyCounter) GetList(args *storagerpc.GetArgs, reply *storagerpc.GetL
 	return err
 }
 
+func (pc *proxyCounter) GetListRange(args *storagerpc.GetListRangeArgs, reply *storagerpc.GetListRangeReply) error {
+	if pc.override {
+		reply.Status = pc.overrideStatus
+		return pc.overrideErr
+	}
+	byteCount := len(args.Key)
+	if args.WantLease {
+		atomic.AddUint32(&pc.leaseRequestCount, 1)
+	}
+	if pc.disableLease {
+		args.WantLease = false
+	}
+	err := pc.srv.Call("StorageServer.GetListRange", args, reply)
+	for _, s := range reply.Value {
+		byteCount += len(s)
+	}
+	if reply.Lease.Granted {
+		if pc.overrideLeaseSeconds > 0 {
+			reply.Lease.ValidSeconds = pc.overrideLeaseSeconds
+		}
+		atomic.AddUint32(&pc.leaseGrantedCount, 1)
+	}
+	atomic.AddUint32(&pc.rpcCount, 1)
+	atomic.AddUint32(&pc.byteCount, uint32(byteCount))
+	return err
+}
+
+func (pc *proxyCounter) ListLength(args *storagerpc.GetArgs, reply *storagerpc.ListLengthReply) error {
+	if pc.override {
+		reply.Status = pc.overrideStatus
+		return pc.overrideErr
+	}
+	byteCount := len(args.Key)
+	if args.WantLease {
+		atomic.AddUint32(&pc.leaseRequestCount, 1)
+	}
+	if pc.disableLease {
+		args.WantLease = false
+	}
+	err := pc.srv.Call("StorageServer.ListLength", args, reply)
+	if reply.Lease.Granted {
+		if pc.overrideLeaseSeconds > 0 {
+			reply.Lease.ValidSeconds = pc.overrideLeaseSeconds
+		}
+		atomic.AddUint32(&pc.leaseGrantedCount, 1)
+	}
+	atomic.AddUint32(&pc.rpcCount, 1)
+	atomic.AddUint32(&pc.byteCount, uint32(byteCount))
+	return err
+}
+
+func (pc *proxyCounter) MultiGet(args *storagerpc.MultiGetArgs, reply *storagerpc.MultiGetReply) error {
+	if pc.override {
+		reply.Status = pc.overrideStatus
+		return pc.overrideErr
+	}
+	byteCount := 0
+	for i := range args.Args {
+		byteCount += len(args.Args[i].Key)
+		if args.Args[i].WantLease {
+			atomic.AddUint32(&pc.leaseRequestCount, 1)
+		}
+		if pc.disableLease {
+			args.Args[i].WantLease = false
+		}
+	}
+	err := pc.srv.Call("StorageServer.MultiGet", args, reply)
+	for i := range reply.Replies {
+		byteCount += len(reply.Replies[i].Value)
+		if reply.Replies[i].Lease.Granted {
+			if pc.overrideLeaseSeconds > 0 {
+				reply.Replies[i].Lease.ValidSeconds = pc.overrideLeaseSeconds
+			}
+			atomic.AddUint32(&pc.leaseGrantedCount, 1)
+		}
+	}
+	atomic.AddUint32(&pc.rpcCount, 1)
+	atomic.AddUint32(&pc.byteCount, uint32(byteCount))
+	return err
+}
+
+func (pc *proxyCounter) MultiGetList(args *storagerpc.MultiGetArgs, reply *storagerpc.MultiGetListReply) error {
+	if pc.override {
+		reply.Status = pc.overrideStatus
+		return pc.overrideErr
+	}
+	byteCount := 0
+	for i := range args.Args {
+		byteCount += len(args.Args[i].Key)
+		if args.Args[i].WantLease {
+			atomic.AddUint32(&pc.leaseRequestCount, 1)
+		}
+		if pc.disableLease {
+			args.Args[i].WantLease = false
+		}
+	}
+	err := pc.srv.Call("StorageServer.MultiGetList", args, reply)
+	for i := range reply.Replies {
+		for _, s := range reply.Replies[i].Value {
+			byteCount += len(s)
+		}
+		if reply.Replies[i].Lease.Granted {
+			if pc.overrideLeaseSeconds > 0 {
+				reply.Replies[i].Lease.ValidSeconds = pc.overrideLeaseSeconds
+			}
+			atomic.AddUint32(&pc.leaseGrantedCount, 1)
+		}
+	}
+	atomic.AddUint32(&pc.rpcCount, 1)
+	atomic.AddUint32(&pc.byteCount, uint32(byteCount))
+	return err
+}
+
+func (pc *proxyCounter) ScanPrefix(args *storagerpc.ScanArgs, reply *storagerpc.ScanReply) error {
+	if pc.override {
+		reply.Status = pc.overrideStatus
+		return pc.overrideErr
+	}
+	byteCount := len(args.Prefix) + len(args.Cursor)
+	err := pc.srv.Call("StorageServer.ScanPrefix", args, reply)
+	for _, key := range reply.Keys {
+		byteCount += len(key)
+	}
+	atomic.AddUint32(&pc.rpcCount, 1)
+	atomic.AddUint32(&pc.byteCount, uint32(byteCount))
+	return err
+}
+
 func (pc *proxyCounter) Put(args *storagerpc.PutArgs, reply *storagerpc.PutReply) error {
 	if pc.override {
 		reply.Status = pc.overrideStatus
@@ -212,3 +351,99 @@ func (pc *proxyCounter) RemoveFromList(args *storagerpc.PutArgs, reply *storager
 	atomic.AddUint32(&pc.byteCount, uint32(byteCount))
 	return err
 }
+
+func (pc *proxyCounter) TrimList(args *storagerpc.TrimListArgs, reply *storagerpc.PutReply) error {
+	if pc.override {
+		reply.Status = pc.overrideStatus
+		return pc.overrideErr
+	}
+	byteCount := len(args.Key)
+	err := pc.srv.Call("StorageServer.TrimList", args, reply)
+	atomic.AddUint32(&pc.rpcCount, 1)
+	atomic.AddUint32(&pc.byteCount, uint32(byteCount))
+	return err
+}
+
+func (pc *proxyCounter) CompareAndSwap(args *storagerpc.CompareAndSwapArgs, reply *storagerpc.CompareAndSwapReply) error {
+	if pc.override {
+		reply.Status = pc.overrideStatus
+		return pc.overrideErr
+	}
+	byteCount := len(args.Key) + len(args.OldValue) + len(args.NewValue)
+	err := pc.srv.Call("StorageServer.CompareAndSwap", args, reply)
+	byteCount += len(reply.Value)
+	atomic.AddUint32(&pc.rpcCount, 1)
+	atomic.AddUint32(&pc.byteCount, uint32(byteCount))
+	return err
+}
+
+func (pc *proxyCounter) Replicate(args *storagerpc.ReplicateArgs, reply *storagerpc.ReplicateReply) error {
+	return pc.srv.Call("StorageServer.Replicate", args, reply)
+}
+
+func (pc *proxyCounter) PrepareRing(args *storagerpc.RingArgs, reply *storagerpc.RingReply) error {
+	return pc.srv.Call("StorageServer.PrepareRing", args, reply)
+}
+
+func (pc *proxyCounter) CommitRing(args *storagerpc.RingArgs, reply *storagerpc.RingReply) error {
+	return pc.srv.Call("StorageServer.CommitRing", args, reply)
+}
+
+func (pc *proxyCounter) TransferKeys(args *storagerpc.TransferArgs, reply *storagerpc.TransferReply) error {
+	return pc.srv.Call("StorageServer.TransferKeys", args, reply)
+}
+
+func (pc *proxyCounter) Heartbeat(args *storagerpc.HeartbeatArgs, reply *storagerpc.HeartbeatReply) error {
+	return pc.srv.Call("StorageServer.Heartbeat", args, reply)
+}
+
+func (pc *proxyCounter) Elect(args *storagerpc.ElectArgs, reply *storagerpc.ElectReply) error {
+	return pc.srv.Call("StorageServer.Elect", args, reply)
+}
+
+func (pc *proxyCounter) Transact(args *storagerpc.TransactArgs, reply *storagerpc.TransactReply) error {
+	if pc.override {
+		reply.Status = pc.overrideStatus
+		return pc.overrideErr
+	}
+	byteCount := 0
+	for _, op := range args.Ops {
+		byteCount += len(op.Key) + len(op.Value)
+	}
+	err := pc.srv.Call("StorageServer.Transact", args, reply)
+	atomic.AddUint32(&pc.rpcCount, 1)
+	atomic.AddUint32(&pc.byteCount, uint32(byteCount))
+	return err
+}
+
+func (pc *proxyCounter) PrepareTx(args *storagerpc.TxArgs, reply *storagerpc.TxReply) error {
+	return pc.srv.Call("StorageServer.PrepareTx", args, reply)
+}
+
+func (pc *proxyCounter) CommitTx(args *storagerpc.TxArgs, reply *storagerpc.TxReply) error {
+	return pc.srv.Call("StorageServer.CommitTx", args, reply)
+}
+
+func (pc *proxyCounter) AbortTx(args *storagerpc.TxArgs, reply *storagerpc.TxReply) error {
+	return pc.srv.Call("StorageServer.AbortTx", args, reply)
+}
+
+func (pc *proxyCounter) TxStatus(args *storagerpc.TxArgs, reply *storagerpc.TxReply) error {
+	return pc.srv.Call("StorageServer.TxStatus", args, reply)
+}
+
+func (pc *proxyCounter) GetLeases(args *storagerpc.GetLeasesArgs, reply *storagerpc.GetLeasesReply) error {
+	return pc.srv.Call("StorageServer.GetLeases", args, reply)
+}
+
+func (pc *proxyCounter) Watch(args *storagerpc.WatchArgs, reply *storagerpc.WatchReply) error {
+	return pc.srv.Call("StorageServer.Watch", args, reply)
+}
+
+func (pc *proxyCounter) Unwatch(args *storagerpc.WatchArgs, reply *storagerpc.WatchReply) error {
+	return pc.srv.Call("StorageServer.Unwatch", args, reply)
+}
+
+func (pc *proxyCounter) Leave() error {
+	return errors.New("ProxyCounter cannot leave the ring")
+}
@@ -18,9 +18,11 @@ import (
 type storageTester struct {
 	srv        *rpc.Client
 	myhostport string
-	recvRevoke map[string]bool // whether we have received a RevokeLease for key x
-	compRevoke map[string]bool // whether we have replied the RevokeLease for key x
-	delay      float32         // how long to delay the reply of RevokeLease
+	recvRevoke map[string]bool                 // whether we have received a RevokeLease for key x
+	compRevoke map[string]bool                 // whether we have replied the RevokeLease for key x
+	delay      float32                         // how long to delay the reply of RevokeLease
+	events     chan storagerpc.WatchEvent      // events received through KeyChanged
+	updates    chan storagerpc.UpdateLeaseArgs // writes received through UpdateLease
 }
 
 type testFunc struct {
@@ -30,7 +32,7 @@ type testFunc struct {
 
 var (
 	portnum   = flag.Int("port", 9019, "port # to listen on")
-	testType  = flag.Int("type", 1, "type of test, 1: jtest, 2: btest")
+	testType  = flag.Int("type", 1, "type of test, 1: jtest, 2: btest, 3: ptest (before restart), 4: rtest (after restart), 5: ftest (before failover), 6: otest (after failover)")
 	numServer = flag.Int("N", 1, "(jtest only) total # of storage servers")
 	myID      = flag.Int("id", 1, "(jtest only) my id")
 	testRegex = flag.String("t", "", "test to run")
@@ -49,6 +51,8 @@ var statusMap = map[storagerpc.Status]string{
 	storagerpc.ItemExists:   "ItemExists",
 	storagerpc.NotReady:     "NotReady",
 	0:                       "Unknown",
+
+	storagerpc.PreconditionFailed: "PreconditionFailed",
 }
 
 func initStorageTester(server, myhostport string) (*storageTester, error) {
@@ -56,6 +60,8 @@ func initStorageTester(server, myhostport string) (*storageTester, error) {
 	tester.myhostport = myhostport
 	tester.recvRevoke = make(map[string]bool)
 	tester.compRevoke = make(map[string]bool)
+	tester.events = make(chan storagerpc.WatchEvent, 100)
+	tester.updates = make(chan storagerpc.UpdateLeaseArgs, 100)
 
 	// Create RPC connection to storage server.
 	srv, err := rpc.DialHTTP("tcp", server)
@@ -92,6 +98,27 @@ func (st *storageTester) RevokeLease(args *storagerpc.RevokeLeaseArgs, reply *st
 	return nil
 }
 
+func (st *storageTester) KeyChanged(args *storagerpc.KeyChangedArgs, reply *storagerpc.KeyChangedReply) error {
+	for _, event := range args.Events {
+		st.events <- event
+	}
+	reply.Status = storagerpc.OK
+	return nil
+}
+
+func (st *storageTester) UpdateLease(args *storagerpc.UpdateLeaseArgs, reply *storagerpc.UpdateLeaseReply) error {
+	st.updates <- *args
+	reply.Status = storagerpc.OK
+	return nil
+}
+
+func (st *storageTester) Watch(method, key string, prefix bool) (*storagerpc.WatchReply, error) {
+	args := &storagerpc.WatchArgs{Key: key, Prefix: prefix, HostPort: st.myhostport}
+	var reply storagerpc.WatchReply
+	err := st.srv.Call(method, args, &reply)
+	return &reply, err
+}
+
 func (st *storageTester) RegisterServer() (*storagerpc.RegisterReply, error) {
 	node := storagerpc.Node{HostPort: st.myhostport, NodeID: uint32(*myID)}
 	args := &storagerpc.RegisterArgs{ServerInfo: node}
@@ -121,6 +148,20 @@ func (st *storageTester) Get(key string, wantlease bool) (*storagerpc.GetReply,
 	return &reply, err
 }
 
+func (st *storageTester) GetWriteThrough(key string) (*storagerpc.GetReply, error) {
+	args := &storagerpc.GetArgs{Key: key, WantLease: true, HostPort: st.myhostport, WriteThrough: true}
+	var reply storagerpc.GetReply
+	err := st.srv.Call("StorageServer.Get", args, &reply)
+	return &reply, err
+}
+
+func (st *storageTester) GetListWriteThrough(key string) (*storagerpc.GetListReply, error) {
+	args := &storagerpc.GetArgs{Key: key, WantLease: true, HostPort: st.myhostport, WriteThrough: true}
+	var reply storagerpc.GetListReply
+	err := st.srv.Call("StorageServer.GetList", args, &reply)
+	return &reply, err
+}
+
 func (st *storageTester) GetList(key string, wantlease bool) (*storagerpc.GetListReply, error) {
 	args := &storagerpc.GetArgs{Key: key, WantLease: wantlease, HostPort: st.myhostport}
 	var reply storagerpc.GetListReply
@@ -128,6 +169,54 @@ func (st *storageTester) GetList(key string, wantlease bool) (*storagerpc.GetLis
 	return &reply, err
 }
 
+func (st *storageTester) GetListRange(key string, offset, limit int, fromTail, wantlease bool) (*storagerpc.GetListRangeReply, error) {
+	args := &storagerpc.GetListRangeArgs{Key: key, Offset: offset, Limit: limit, FromTail: fromTail, WantLease: wantlease, HostPort: st.myhostport}
+	var reply storagerpc.GetListRangeReply
+	err := st.srv.Call("StorageServer.GetListRange", args, &reply)
+	return &reply, err
+}
+
+func (st *storageTester) ListLength(key string) (*storagerpc.ListLengthReply, error) {
+	args := &storagerpc.GetArgs{Key: key, HostPort: st.myhostport}
+	var reply storagerpc.ListLengthReply
+	err := st.srv.Call("StorageServer.ListLength", args, &reply)
+	return &reply, err
+}
+
+func (st *storageTester) TrimList(key string, length int) (*storagerpc.PutReply, error) {
+	args := &storagerpc.TrimListArgs{Key: key, Length: length}
+	var reply storagerpc.PutReply
+	err := st.srv.Call("StorageServer.TrimList", args, &reply)
+	return &reply, err
+}
+
+func (st *storageTester) MultiGet(keys []string, wantlease bool) (*storagerpc.MultiGetReply, error) {
+	args := &storagerpc.MultiGetArgs{}
+	for _, key := range keys {
+		args.Args = append(args.Args, storagerpc.GetArgs{Key: key, WantLease: wantlease, HostPort: st.myhostport})
+	}
+	var reply storagerpc.MultiGetReply
+	err := st.srv.Call("StorageServer.MultiGet", args, &reply)
+	return &reply, err
+}
+
+func (st *storageTester) MultiGetList(keys []string, wantlease bool) (*storagerpc.MultiGetListReply, error) {
+	args := &storagerpc.MultiGetArgs{}
+	for _, key := range keys {
+		args.Args = append(args.Args, storagerpc.GetArgs{Key: key, WantLease: wantlease, HostPort: st.myhostport})
+	}
+	var reply storagerpc.MultiGetListReply
+	err := st.srv.Call("StorageServer.MultiGetList", args, &reply)
+	return &reply, err
+}
+
+func (st *storageTester) ScanPrefix(prefix string, nodeID uint32, cursor string, limit int) (*storagerpc.ScanReply, error) {
+	args := &storagerpc.ScanArgs{Prefix: prefix, NodeID: nodeID, Cursor: cursor, Limit: limit}
+	var reply storagerpc.ScanReply
+	err := st.srv.Call("StorageServer.ScanPrefix", args, &reply)
+	return &reply, err
+}
+
 func (st *storageTester) RemoveFromList(key, removeitem string) (*storagerpc.PutReply, error) {
 	args := &storagerpc.PutArgs{Key: key, Value: removeitem}
 	var reply storagerpc.PutReply
@@ -142,6 +231,61 @@ func (st *storageTester) AppendToList(key, newitem string) (*storagerpc.PutReply
 	return &reply, err
 }
 
+func (st *storageTester) CompareAndSwap(key, oldValue, newValue string) (*storagerpc.CompareAndSwapReply, error) {
+	args := &storagerpc.CompareAndSwapArgs{Key: key, OldValue: oldValue, NewValue: newValue}
+	var reply storagerpc.CompareAndSwapReply
+	err := st.srv.Call("StorageServer.CompareAndSwap", args, &reply)
+	return &reply, err
+}
+
+func (st *storageTester) PutIfVersion(method, key, value string, version uint64) (*storagerpc.PutReply, error) {
+	args := &storagerpc.PutArgs{Key: key, Value: value, Version: version}
+	var reply storagerpc.PutReply
+	err := st.srv.Call(method, args, &reply)
+	return &reply, err
+}
+
+func (st *storageTester) PutWithTTL(method, key, value string, ttl time.Duration) (*storagerpc.PutReply, error) {
+	args := &storagerpc.PutArgs{Key: key, Value: value, TTL: ttl}
+	var reply storagerpc.PutReply
+	err := st.srv.Call(method, args, &reply)
+	return &reply, err
+}
+
+func (st *storageTester) PutWithRequestID(method, key, value, requestID string) (*storagerpc.PutReply, error) {
+	args := &storagerpc.PutArgs{Key: key, Value: value, RequestID: requestID}
+	var reply storagerpc.PutReply
+	err := st.srv.Call(method, args, &reply)
+	return &reply, err
+}
+
+func (st *storageTester) Transact(ops []storagerpc.TxOp) (*storagerpc.TransactReply, error) {
+	args := &storagerpc.TransactArgs{Ops: ops}
+	var reply storagerpc.TransactReply
+	err := st.srv.Call("StorageServer.Transact", args, &reply)
+	return &reply, err
+}
+
+func (st *storageTester) CallTx(method string, args *storagerpc.TxArgs) (*storagerpc.TxReply, error) {
+	var reply storagerpc.TxReply
+	err := st.srv.Call(method, args, &reply)
+	return &reply, err
+}
+
+func (st *storageTester) GetLeases(key string) (*storagerpc.GetLeasesReply, error) {
+	args := &storagerpc.GetLeasesArgs{Key: key}
+	var reply storagerpc.GetLeasesReply
+	err := st.srv.Call("StorageServer.GetLeases", args, &reply)
+	return &reply, err
+}
+
+func (st *storageTester) Heartbeat(leader string, version uint64) (*storagerpc.HeartbeatReply, error) {
+	args := &storagerpc.HeartbeatArgs{Leader: leader, Version: version}
+	var reply storagerpc.HeartbeatReply
+	err := st.srv.Call("StorageServer.Heartbeat", args, &reply)
+	return &reply, err
+}
+
 // Check error and status
 func checkErrorStatus(err error, status, expectedStatus storagerpc.Status) bool {
 	if err != nil {
@@ -196,6 +340,16 @@ func checkList(list []string, expectedList []string) bool {
 	return false
 }
 
+// Check list contents in order
+func checkOrderedList(list []string, expectedList []string) bool {
+	if fmt.Sprint(list) != fmt.Sprint(expectedList) {
+		LOGE.Printf("FAIL: incorrect list %v, expected list %v\n", list, expectedList)
+		failCount++
+		return true
+	}
+	return false
+}
+
 // We treat a RPC call finihsed in 0.5 seconds as OK
 func isTimeOK(d time.Duration) bool {
 	return d < 500*time.Millisecond
@@ -1284,53 +1438,1513 @@ func testDelayedRevokeListWithUpdate3() {
 	passCount++
 }
 
-func main() {
-	jtests := []testFunc{{"testInitStorageServers", testInitStorageServers}}
-	btests := []testFunc{
-		{"testPutGet", testPutGet},
-		{"testAppendGetRemoveList", testAppendGetRemoveList},
-		{"testUpdateWithoutLease", testUpdateWithoutLease},
-		{"testUpdateBeforeLeaseExpire", testUpdateBeforeLeaseExpire},
-		{"testUpdateAfterLeaseExpire", testUpdateAfterLeaseExpire},
-		{"testDelayedRevokeWithoutBlocking", testDelayedRevokeWithoutBlocking},
-		{"testDelayedRevokeWithLeaseRequest1", testDelayedRevokeWithLeaseRequest1},
-		{"testDelayedRevokeWithLeaseRequest2", testDelayedRevokeWithLeaseRequest2},
-		{"testDelayedRevokeWithUpdate1", testDelayedRevokeWithUpdate1},
-		{"testDelayedRevokeWithUpdate2", testDelayedRevokeWithUpdate2},
-		{"testDelayedRevokeWithUpdate3", testDelayedRevokeWithUpdate3},
-		{"testUpdateListWithoutLease", testUpdateListWithoutLease},
-		{"testUpdateListBeforeLeaseExpire", testUpdateListBeforeLeaseExpire},
-		{"testUpdateListAfterLeaseExpire", testUpdateListAfterLeaseExpire},
-		{"testDelayedRevokeListWithoutBlocking", testDelayedRevokeListWithoutBlocking},
-		{"testDelayedRevokeListWithLeaseRequest1", testDelayedRevokeListWithLeaseRequest1},
-		{"testDelayedRevokeListWithLeaseRequest2", testDelayedRevokeListWithLeaseRequest2},
-		{"testDelayedRevokeListWithUpdate1", testDelayedRevokeListWithUpdate1},
-		{"testDelayedRevokeListWithUpdate2", testDelayedRevokeListWithUpdate2},
-		{"testDelayedRevokeListWithUpdate3", testDelayedRevokeListWithUpdate3},
+/////////////////////////////////////////////
+//  test compare-and-swap
+/////////////////////////////////////////////
+
+// swap a value only when the expected value matches
+func testCompareAndSwap() {
+	// swap a nonexistent key
+	replyC, err := st.CompareAndSwap("caskey:1", "value", "value1")
+	if checkErrorStatus(err, replyC.Status, storagerpc.KeyNotFound) {
+		return
 	}
 
-	flag.Parse()
-	if flag.NArg() < 1 {
-		LOGE.Fatalln("Usage: storagetest <storage master>")
+	replyP, err := st.Put("caskey:1", "value")
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
 	}
 
-	// Run the tests with a single tester
-	storageTester, err := initStorageTester(flag.Arg(0), fmt.Sprintf("localhost:%d", *portnum))
-	if err != nil {
-		LOGE.Fatalln("Failed to initialize test:", err)
+	// expect the wrong value
+	replyC, err = st.CompareAndSwap("caskey:1", "wrong-value", "value1")
+	if checkErrorStatus(err, replyC.Status, storagerpc.PreconditionFailed) {
+		return
+	}
+	if replyC.Value != "value" {
+		LOGE.Println("FAIL: got wrong current value")
+		failCount++
+		return
 	}
-	st = storageTester
 
-	switch *testType {
-	case 1:
-		for _, t := range jtests {
-			if b, err := regexp.MatchString(*testRegex, t.name); b && err == nil {
-				fmt.Printf("Running %s:\n", t.name)
-				t.f()
-			}
-		}
-	case 2:
-		for _, t := range btests {
+	// expect the right value
+	replyC, err = st.CompareAndSwap("caskey:1", "value", "value1")
+	if checkErrorStatus(err, replyC.Status, storagerpc.OK) {
+		return
+	}
+	replyG, err := st.Get("caskey:1", false)
+	if checkErrorStatus(err, replyG.Status, storagerpc.OK) {
+		return
+	}
+	if replyG.Value != "value1" {
+		LOGE.Println("FAIL: got wrong value")
+		failCount++
+		return
+	}
+
+	fmt.Println("PASS")
+	passCount++
+}
+
+// a successful swap revokes leases before storing the new value,
+// while a failed swap revokes nothing
+func testCompareAndSwapBeforeLeaseExpire() {
+	key := "caskey:2"
+
+	if cacheKey(key) {
+		return
+	}
+
+	// a failed swap should not revoke the lease
+	replyC, err := st.CompareAndSwap(key, "wrong-value", "value1")
+	if checkErrorStatus(err, replyC.Status, storagerpc.PreconditionFailed) {
+		return
+	}
+	if st.recvRevoke[key] {
+		LOGE.Println("FAIL: failed swap should not revoke")
+		failCount++
+		return
+	}
+
+	// a successful swap should revoke the lease
+	replyC, err = st.CompareAndSwap(key, "old-value", "value1")
+	if checkErrorStatus(err, replyC.Status, storagerpc.OK) {
+		return
+	}
+	if !st.recvRevoke[key] {
+		LOGE.Println("FAIL: did not receive revoke")
+		failCount++
+		return
+	}
+
+	replyG, err := st.Get(key, false)
+	if checkErrorStatus(err, replyG.Status, storagerpc.OK) {
+		return
+	}
+	if replyG.Value != "value1" {
+		LOGE.Println("FAIL: got wrong value")
+		failCount++
+		return
+	}
+
+	fmt.Println("PASS")
+	passCount++
+}
+
+/////////////////////////////////////////////
+//  test versioned values
+/////////////////////////////////////////////
+
+// check that a reply carries the expected version
+func checkVersion(version, expectedVersion uint64) bool {
+	if version != expectedVersion {
+		LOGE.Printf("FAIL: got version %d, expected %d\n", version, expectedVersion)
+		failCount++
+		return true
+	}
+	return false
+}
+
+// every write increases a key's version, and a write conditioned
+// on a stale version is rejected
+func testVersions() {
+	key := "versionkey:1"
+
+	replyP, err := st.Put(key, "value1")
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+	if checkVersion(replyP.Version, 1) {
+		return
+	}
+	replyP, err = st.Put(key, "value2")
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+	if checkVersion(replyP.Version, 2) {
+		return
+	}
+
+	replyG, err := st.Get(key, false)
+	if checkErrorStatus(err, replyG.Status, storagerpc.OK) {
+		return
+	}
+	if checkVersion(replyG.Version, 2) {
+		return
+	}
+
+	// write at a stale version
+	replyP, err = st.PutIfVersion("StorageServer.Put", key, "value3", 1)
+	if checkErrorStatus(err, replyP.Status, storagerpc.PreconditionFailed) {
+		return
+	}
+	if checkVersion(replyP.Version, 2) {
+		return
+	}
+
+	// write at the current version
+	replyP, err = st.PutIfVersion("StorageServer.Put", key, "value3", 2)
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+	if checkVersion(replyP.Version, 3) {
+		return
+	}
+
+	replyG, err = st.Get(key, false)
+	if checkErrorStatus(err, replyG.Status, storagerpc.OK) {
+		return
+	}
+	if replyG.Value != "value3" {
+		LOGE.Println("FAIL: got wrong value")
+		failCount++
+		return
+	}
+	if checkVersion(replyG.Version, 3) {
+		return
+	}
+
+	fmt.Println("PASS")
+	passCount++
+}
+
+// list modifications increase a key's version, and may be
+// conditioned on it as well
+func testListVersions() {
+	key := "versionlist:1"
+
+	replyP, err := st.AppendToList(key, "value1")
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+	if checkVersion(replyP.Version, 1) {
+		return
+	}
+
+	// append at a stale version
+	replyP, err = st.PutIfVersion("StorageServer.AppendToList", key, "value2", 5)
+	if checkErrorStatus(err, replyP.Status, storagerpc.PreconditionFailed) {
+		return
+	}
+	if checkVersion(replyP.Version, 1) {
+		return
+	}
+
+	// append at the current version
+	replyP, err = st.PutIfVersion("StorageServer.AppendToList", key, "value2", 1)
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+	if checkVersion(replyP.Version, 2) {
+		return
+	}
+
+	// remove at a stale version
+	replyP, err = st.PutIfVersion("StorageServer.RemoveFromList", key, "value1", 1)
+	if checkErrorStatus(err, replyP.Status, storagerpc.PreconditionFailed) {
+		return
+	}
+
+	// remove at the current version
+	replyP, err = st.PutIfVersion("StorageServer.RemoveFromList", key, "value1", 2)
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+
+	replyL, err := st.GetList(key, false)
+	if checkErrorStatus(err, replyL.Status, storagerpc.OK) {
+		return
+	}
+	if checkList(replyL.Value, []string{"value2"}) {
+		return
+	}
+	if checkVersion(replyL.Version, 3) {
+		return
+	}
+
+	fmt.Println("PASS")
+	passCount++
+}
+
+// a failed swap reports the key's current version, and a successful
+// one the key's new version
+func testCompareAndSwapVersions() {
+	key := "versionkey:2"
+
+	replyP, err := st.Put(key, "value1")
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+
+	replyC, err := st.CompareAndSwap(key, "wrong-value", "value2")
+	if checkErrorStatus(err, replyC.Status, storagerpc.PreconditionFailed) {
+		return
+	}
+	if checkVersion(replyC.Version, 1) {
+		return
+	}
+
+	replyC, err = st.CompareAndSwap(key, "value1", "value2")
+	if checkErrorStatus(err, replyC.Status, storagerpc.OK) {
+		return
+	}
+	if checkVersion(replyC.Version, 2) {
+		return
+	}
+
+	fmt.Println("PASS")
+	passCount++
+}
+
+/////////////////////////////////////////////
+//  test batched reads
+/////////////////////////////////////////////
+
+// a batch of gets is answered key by key
+func testMultiGet() {
+	replyP, err := st.Put("multikey:1", "value1")
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+	replyP, err = st.Put("multikey:2", "value2")
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+
+	replyM, err := st.MultiGet([]string{"multikey:1", "nullkey:1", "multikey:2"}, false)
+	if checkErrorStatus(err, replyM.Status, storagerpc.OK) {
+		return
+	}
+	if len(replyM.Replies) != 3 {
+		LOGE.Println("FAIL: got wrong number of replies")
+		failCount++
+		return
+	}
+	expected := []struct {
+		status storagerpc.Status
+		value  string
+	}{{storagerpc.OK, "value1"}, {storagerpc.KeyNotFound, ""}, {storagerpc.OK, "value2"}}
+	for i, r := range replyM.Replies {
+		if checkErrorStatus(nil, r.Status, expected[i].status) {
+			return
+		}
+		if r.Value != expected[i].value {
+			LOGE.Println("FAIL: got wrong value")
+			failCount++
+			return
+		}
+		if r.Lease.Granted {
+			LOGE.Println("FAIL: did not request lease")
+			failCount++
+			return
+		}
+	}
+
+	fmt.Println("PASS")
+	passCount++
+}
+
+// a batch of get lists is answered key by key
+func testMultiGetList() {
+	replyP, err := st.AppendToList("multilist:1", "value1")
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+
+	replyM, err := st.MultiGetList([]string{"nulllist:1", "multilist:1"}, false)
+	if checkErrorStatus(err, replyM.Status, storagerpc.OK) {
+		return
+	}
+	if len(replyM.Replies) != 2 {
+		LOGE.Println("FAIL: got wrong number of replies")
+		failCount++
+		return
+	}
+	if checkErrorStatus(nil, replyM.Replies[0].Status, storagerpc.KeyNotFound) {
+		return
+	}
+	if checkErrorStatus(nil, replyM.Replies[1].Status, storagerpc.OK) {
+		return
+	}
+	if checkList(replyM.Replies[1].Value, []string{"value1"}) {
+		return
+	}
+
+	fmt.Println("PASS")
+	passCount++
+}
+
+// leases granted in a batch are revoked like any other
+func testMultiGetLease() {
+	key := "multikey:3"
+
+	replyP, err := st.Put(key, "old-value")
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+	replyM, err := st.MultiGet([]string{key}, true)
+	if checkErrorStatus(err, replyM.Status, storagerpc.OK) {
+		return
+	}
+	if len(replyM.Replies) != 1 || !replyM.Replies[0].Lease.Granted {
+		LOGE.Println("FAIL: Failed to get lease")
+		failCount++
+		return
+	}
+
+	replyP, err = st.Put(key, "value1")
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+	if !st.recvRevoke[key] {
+		LOGE.Println("FAIL: did not receive revoke")
+		failCount++
+		return
+	}
+
+	fmt.Println("PASS")
+	passCount++
+}
+
+/////////////////////////////////////////////
+//  test prefix scans
+/////////////////////////////////////////////
+
+// page through the keys with a prefix
+func testScanPrefix() {
+	replyS, err := st.GetServers()
+	if checkErrorStatus(err, replyS.Status, storagerpc.OK) {
+		return
+	}
+	nodeID := replyS.Servers[0].NodeID
+
+	expected := []string{"scankey:1", "scankey:2", "scankey:3", "scankey:4", "scankey:5"}
+	for _, key := range []string{"scankey:3", "scankey:1", "scankey:5", "scankey:2"} {
+		replyP, err := st.Put(key, "value")
+		if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+			return
+		}
+	}
+	replyP, err := st.AppendToList("scankey:4", "value")
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+	replyP, err = st.Put("otherkey:1", "value")
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+
+	var keys []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages == len(expected) {
+			LOGE.Println("FAIL: scan did not finish")
+			failCount++
+			return
+		}
+		replySc, err := st.ScanPrefix("scankey:", nodeID, cursor, 2)
+		if checkErrorStatus(err, replySc.Status, storagerpc.OK) {
+			return
+		}
+		if len(replySc.Keys) > 2 {
+			LOGE.Println("FAIL: got too many keys")
+			failCount++
+			return
+		}
+		keys = append(keys, replySc.Keys...)
+		if cursor = replySc.Cursor; cursor == "" {
+			break
+		}
+	}
+	if len(keys) != len(expected) {
+		LOGE.Println("FAIL: got wrong keys", keys)
+		failCount++
+		return
+	}
+	for i := range keys {
+		if keys[i] != expected[i] {
+			LOGE.Println("FAIL: got wrong keys", keys)
+			failCount++
+			return
+		}
+	}
+
+	fmt.Println("PASS")
+	passCount++
+}
+
+/////////////////////////////////////////////
+//  test key expiry
+/////////////////////////////////////////////
+
+// time-to-live of the keys written by the expiry tests
+const testTTL = 2 * time.Second
+
+// a key written with a time-to-live is not found once it expires,
+// while a key rewritten without one is kept
+func testPutTTL() {
+	replyP, err := st.PutWithTTL("StorageServer.Put", "ttlkey:1", "value", testTTL)
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+	replyP, err = st.PutWithTTL("StorageServer.Put", "ttlkey:2", "value", testTTL)
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+	replyP, err = st.Put("ttlkey:2", "value2")
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+
+	replyG, err := st.Get("ttlkey:1", false)
+	if checkErrorStatus(err, replyG.Status, storagerpc.OK) {
+		return
+	}
+	if replyG.TTL <= 0 || replyG.TTL > testTTL {
+		LOGE.Println("FAIL: got wrong time-to-live", replyG.TTL)
+		failCount++
+		return
+	}
+
+	time.Sleep(testTTL + time.Second)
+
+	replyG, err = st.Get("ttlkey:1", false)
+	if checkErrorStatus(err, replyG.Status, storagerpc.KeyNotFound) {
+		return
+	}
+	replyG, err = st.Get("ttlkey:2", false)
+	if checkErrorStatus(err, replyG.Status, storagerpc.OK) {
+		return
+	}
+	if replyG.Value != "value2" || replyG.TTL != 0 {
+		LOGE.Println("FAIL: key without time-to-live should not expire")
+		failCount++
+		return
+	}
+
+	// an expired key's versions carry on when it is written again
+	replyP, err = st.Put("ttlkey:1", "value3")
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+	if checkVersion(replyP.Version, 2) {
+		return
+	}
+
+	fmt.Println("PASS")
+	passCount++
+}
+
+// appending to a list keeps its expiry, and an expired list
+// starts over when appended to
+func testListTTL() {
+	key := "ttllist:1"
+
+	replyP, err := st.PutWithTTL("StorageServer.AppendToList", key, "value1", testTTL)
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+	replyP, err = st.AppendToList(key, "value2")
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+
+	time.Sleep(testTTL + time.Second)
+
+	replyL, err := st.GetList(key, false)
+	if checkErrorStatus(err, replyL.Status, storagerpc.KeyNotFound) {
+		return
+	}
+	replyP, err = st.AppendToList(key, "value2")
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+	replyL, err = st.GetList(key, false)
+	if checkErrorStatus(err, replyL.Status, storagerpc.OK) {
+		return
+	}
+	if checkList(replyL.Value, []string{"value2"}) {
+		return
+	}
+
+	fmt.Println("PASS")
+	passCount++
+}
+
+/////////////////////////////////////////////
+//  test transactions
+/////////////////////////////////////////////
+
+// the writes of a committed transaction are all made, in order
+func testTransaction() {
+	replyT, err := st.Transact([]storagerpc.TxOp{
+		{Op: storagerpc.OpPut, Key: "txkey:1", Value: "value"},
+		{Op: storagerpc.OpAppendToList, Key: "txlist:1", Value: "value1"},
+		{Op: storagerpc.OpAppendToList, Key: "txlist:1", Value: "value2"},
+		{Op: storagerpc.OpRemoveFromList, Key: "txlist:1", Value: "value1"},
+	})
+	if checkErrorStatus(err, replyT.Status, storagerpc.OK) {
+		return
+	}
+
+	replyG, err := st.Get("txkey:1", false)
+	if checkErrorStatus(err, replyG.Status, storagerpc.OK) {
+		return
+	}
+	if replyG.Value != "value" {
+		LOGE.Println("FAIL: got wrong value")
+		failCount++
+		return
+	}
+	replyL, err := st.GetList("txlist:1", false)
+	if checkErrorStatus(err, replyL.Status, storagerpc.OK) {
+		return
+	}
+	if checkList(replyL.Value, []string{"value2"}) {
+		return
+	}
+
+	fmt.Println("PASS")
+	passCount++
+}
+
+// a transaction with a write that cannot be made makes none of its writes
+func testTransactionAbort() {
+	replyP, err := st.Put("txkey:2", "old-value")
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+	replyP, err = st.AppendToList("txlist:2", "value")
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+
+	replyT, err := st.Transact([]storagerpc.TxOp{
+		{Op: storagerpc.OpPut, Key: "txkey:2", Value: "new-value"},
+		{Op: storagerpc.OpAppendToList, Key: "txlist:2", Value: "value"},
+	})
+	if checkErrorStatus(err, replyT.Status, storagerpc.ItemExists) {
+		return
+	}
+	replyT, err = st.Transact([]storagerpc.TxOp{
+		{Op: storagerpc.OpPut, Key: "txkey:2", Value: "new-value"},
+		{Op: storagerpc.OpRemoveFromList, Key: "txlist:2", Value: "value"},
+		{Op: storagerpc.OpRemoveFromList, Key: "txlist:2", Value: "value"},
+	})
+	if checkErrorStatus(err, replyT.Status, storagerpc.ItemNotFound) {
+		return
+	}
+
+	replyG, err := st.Get("txkey:2", false)
+	if checkErrorStatus(err, replyG.Status, storagerpc.OK) {
+		return
+	}
+	if replyG.Value != "old-value" {
+		LOGE.Println("FAIL: aborted transaction wrote value")
+		failCount++
+		return
+	}
+	replyL, err := st.GetList("txlist:2", false)
+	if checkErrorStatus(err, replyL.Status, storagerpc.OK) {
+		return
+	}
+	if checkList(replyL.Value, []string{"value"}) {
+		return
+	}
+
+	fmt.Println("PASS")
+	passCount++
+}
+
+// a participant asked by another tells whether it is waiting for the
+// outcome, and aborts a transaction it never prepared
+func testTransactionAskedByPeer() {
+	coordinator := "localhost:1"
+	ops := []storagerpc.TxOp{{Op: storagerpc.OpPut, Key: "txkey:4", Value: "value"}}
+
+	replyX, err := st.CallTx("StorageServer.PrepareTx", &storagerpc.TxArgs{TxID: "peertx:1", Coordinator: coordinator, Ops: ops})
+	if checkErrorStatus(err, replyX.Status, storagerpc.OK) {
+		return
+	}
+	replyX, err = st.CallTx("StorageServer.TxStatus", &storagerpc.TxArgs{TxID: "peertx:1", Coordinator: coordinator})
+	if checkErrorStatus(err, replyX.Status, storagerpc.NotReady) {
+		return
+	}
+	replyX, err = st.CallTx("StorageServer.AbortTx", &storagerpc.TxArgs{TxID: "peertx:1"})
+	if checkErrorStatus(err, replyX.Status, storagerpc.OK) {
+		return
+	}
+	replyX, err = st.CallTx("StorageServer.TxStatus", &storagerpc.TxArgs{TxID: "peertx:1", Coordinator: coordinator})
+	if checkErrorStatus(err, replyX.Status, storagerpc.OK) {
+		return
+	}
+	if replyX.Committed {
+		LOGE.Println("FAIL: aborted transaction reported as committed")
+		failCount++
+		return
+	}
+
+	// Once asked about a transaction it never prepared, the server refuses
+	// to prepare it.
+	replyX, err = st.CallTx("StorageServer.TxStatus", &storagerpc.TxArgs{TxID: "peertx:2", Coordinator: coordinator})
+	if checkErrorStatus(err, replyX.Status, storagerpc.OK) {
+		return
+	}
+	if replyX.Committed {
+		LOGE.Println("FAIL: unknown transaction reported as committed")
+		failCount++
+		return
+	}
+	replyX, err = st.CallTx("StorageServer.PrepareTx", &storagerpc.TxArgs{TxID: "peertx:2", Coordinator: coordinator, Ops: ops})
+	if checkErrorStatus(err, replyX.Status, storagerpc.Locked) {
+		return
+	}
+	replyP, err := st.Put("txkey:4", "value")
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+
+	fmt.Println("PASS")
+	passCount++
+}
+
+// a transaction revokes the leases on the keys it writes before committing
+func testTransactionRevoke() {
+	key := "txkey:3"
+
+	if cacheKey(key) {
+		return
+	}
+
+	replyT, err := st.Transact([]storagerpc.TxOp{{Op: storagerpc.OpPut, Key: key, Value: "value"}})
+	if checkErrorStatus(err, replyT.Status, storagerpc.OK) {
+		return
+	}
+	if !st.recvRevoke[key] {
+		LOGE.Println("FAIL: did not receive revoke")
+		failCount++
+		return
+	}
+
+	replyG, err := st.Get(key, false)
+	if checkErrorStatus(err, replyG.Status, storagerpc.OK) {
+		return
+	}
+	if replyG.Value != "value" {
+		LOGE.Println("FAIL: got wrong value")
+		failCount++
+		return
+	}
+
+	fmt.Println("PASS")
+	passCount++
+}
+
+// listing a key's leases, then revoking them
+func testGetLeases() {
+	key := "leasekey:1"
+
+	replyL, err := st.GetLeases("")
+	if checkErrorStatus(err, replyL.Status, storagerpc.OK) {
+		return
+	}
+	before := replyL.Stats
+
+	if cacheKey(key) {
+		return
+	}
+
+	replyL, err = st.GetLeases(key)
+	if checkErrorStatus(err, replyL.Status, storagerpc.OK) {
+		return
+	}
+	if len(replyL.Leases) != 1 || replyL.Leases[0].Key != key || len(replyL.Leases[0].Holders) != 1 {
+		LOGE.Printf("FAIL: incorrect leases %v, expected a single lease on %s\n", replyL.Leases, key)
+		failCount++
+		return
+	}
+	holder := replyL.Leases[0].Holders[0]
+	if holder.HostPort != st.myhostport || !holder.Expires.After(holder.Granted) {
+		LOGE.Printf("FAIL: incorrect lease holder %v\n", holder)
+		failCount++
+		return
+	}
+	if replyL.Stats.Grants <= before.Grants {
+		LOGE.Println("FAIL: lease grant was not counted")
+		failCount++
+		return
+	}
+
+	// update the key, which revokes its lease
+	replyP, err := st.Put(key, "value")
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+
+	replyL, err = st.GetLeases(key)
+	if checkErrorStatus(err, replyL.Status, storagerpc.OK) {
+		return
+	}
+	if len(replyL.Leases) != 0 {
+		LOGE.Printf("FAIL: incorrect leases %v, expected none\n", replyL.Leases)
+		failCount++
+		return
+	}
+	if replyL.Stats.Revocations <= before.Revocations || replyL.Stats.BlockedWrites <= before.BlockedWrites {
+		LOGE.Println("FAIL: lease revocation was not counted")
+		failCount++
+		return
+	}
+
+	fmt.Println("PASS")
+	passCount++
+}
+
+// revoking the leases of a slow holder and of an unreachable one,
+// which must be revoked concurrently
+func testRevokeUnreachableHolder() {
+	key := "leasekey:2"
+	deadHostPort := "localhost:1"
+
+	if cacheKey(key) {
+		return
+	}
+	args := &storagerpc.GetArgs{Key: key, WantLease: true, HostPort: deadHostPort}
+	var replyG storagerpc.GetReply
+	err := st.srv.Call("StorageServer.Get", args, &replyG)
+	if checkErrorStatus(err, replyG.Status, storagerpc.OK) {
+		return
+	}
+	if !replyG.Lease.Granted {
+		LOGE.Println("FAIL: Failed to get lease")
+		failCount++
+		return
+	}
+
+	// the unreachable holder's lease must expire before the put completes,
+	// while the slow holder's revocation must not add to the wait
+	st.SetDelay(0.5)
+	defer st.ResetDelay()
+	start := time.Now()
+	replyP, err := st.Put(key, "value")
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+	if d := time.Since(start); d > (storagerpc.LeaseSeconds+storagerpc.LeaseGuardSeconds+2)*time.Second {
+		LOGE.Printf("FAIL: put took %v, leases were not revoked concurrently\n", d)
+		failCount++
+		return
+	}
+	if !st.recvRevoke[key] {
+		LOGE.Println("FAIL: did not receive revoke")
+		failCount++
+		return
+	}
+
+	replyL, err := st.GetLeases(key)
+	if checkErrorStatus(err, replyL.Status, storagerpc.OK) {
+		return
+	}
+	if len(replyL.SlowHolders) != 1 || replyL.SlowHolders[0].HostPort != deadHostPort || replyL.SlowHolders[0].Timeouts < 1 {
+		LOGE.Printf("FAIL: incorrect slow holders %v, expected %s\n", replyL.SlowHolders, deadHostPort)
+		failCount++
+		return
+	}
+
+	fmt.Println("PASS")
+	passCount++
+}
+
+// leases on a key written often are denied, while leases on a key read
+// often but rarely written last longer than usual
+func testAdaptiveLease() {
+	hotWriteKey := "ratekey:1"
+	hotReadKey := "ratekey:2"
+
+	for i := 0; i < 20; i++ {
+		replyP, err := st.Put(hotWriteKey, fmt.Sprintf("value%d", i))
+		if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+			return
+		}
+	}
+	replyG, err := st.Get(hotWriteKey, true)
+	if checkErrorStatus(err, replyG.Status, storagerpc.OK) {
+		return
+	}
+	if replyG.Lease.Granted {
+		LOGE.Printf("FAIL: granted a %d second lease on a key written often\n", replyG.Lease.ValidSeconds)
+		failCount++
+		return
+	}
+
+	replyP, err := st.Put(hotReadKey, "value")
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+	for i := 0; i < 40; i++ {
+		replyG, err = st.Get(hotReadKey, false)
+		if checkErrorStatus(err, replyG.Status, storagerpc.OK) {
+			return
+		}
+	}
+	replyG, err = st.Get(hotReadKey, true)
+	if checkErrorStatus(err, replyG.Status, storagerpc.OK) {
+		return
+	}
+	if !replyG.Lease.Granted || replyG.Lease.ValidSeconds <= storagerpc.LeaseSeconds || replyG.Lease.ValidSeconds > storagerpc.MaxLeaseSeconds {
+		LOGE.Printf("FAIL: incorrect lease %+v on a key read often, expected a long lease\n", replyG.Lease)
+		failCount++
+		return
+	}
+
+	fmt.Println("PASS")
+	passCount++
+}
+
+// resent writes carrying the same request ID must be made only once
+func testResendWrite() {
+	key := "resendkey:1"
+
+	for i := 0; i < 2; i++ {
+		replyP, err := st.PutWithRequestID("StorageServer.AppendToList", key, "value1", "resend/1")
+		if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+			return
+		}
+	}
+	for i := 0; i < 2; i++ {
+		replyP, err := st.PutWithRequestID("StorageServer.RemoveFromList", key, "value1", "resend/2")
+		if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+			return
+		}
+	}
+
+	// a write with a new request ID is made again
+	replyP, err := st.PutWithRequestID("StorageServer.RemoveFromList", key, "value1", "resend/3")
+	if checkErrorStatus(err, replyP.Status, storagerpc.ItemNotFound) {
+		return
+	}
+
+	replyL, err := st.GetList(key, false)
+	if checkErrorStatus(err, replyL.Status, storagerpc.OK) {
+		return
+	}
+	if len(replyL.Value) != 0 {
+		LOGE.Println("FAIL: resent write was made twice")
+		failCount++
+		return
+	}
+
+	fmt.Println("PASS")
+	passCount++
+}
+
+// watchers are notified of writes to watched keys and prefixes, in order
+func testWatch() {
+	replyW, err := st.Watch("StorageServer.Watch", "watchkey:1", false)
+	if checkErrorStatus(err, replyW.Status, storagerpc.OK) {
+		return
+	}
+	replyW, err = st.Watch("StorageServer.Watch", "watchprefix:", true)
+	if checkErrorStatus(err, replyW.Status, storagerpc.OK) {
+		return
+	}
+
+	replyP, err := st.Put("watchkey:1", "value1")
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+	replyP, err = st.Put("watchkey:2", "value1")
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+	replyP, err = st.AppendToList("watchprefix:1", "item1")
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+	replyP, err = st.RemoveFromList("watchprefix:1", "item1")
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+
+	expected := []storagerpc.WatchEvent{
+		{Key: "watchkey:1", Op: storagerpc.OpPut, Value: "value1", Version: 1},
+		{Key: "watchprefix:1", Op: storagerpc.OpAppendToList, Value: "item1", Version: 1},
+		{Key: "watchprefix:1", Op: storagerpc.OpRemoveFromList, Value: "item1", Version: 2},
+	}
+	for _, e := range expected {
+		select {
+		case event := <-st.events:
+			if event != e {
+				LOGE.Printf("FAIL: got event %+v, expected %+v\n", event, e)
+				failCount++
+				return
+			}
+		case <-time.After(2 * time.Second):
+			LOGE.Printf("FAIL: did not receive event %+v\n", e)
+			failCount++
+			return
+		}
+	}
+
+	// no events are sent once the watches are canceled
+	replyW, err = st.Watch("StorageServer.Unwatch", "watchkey:1", false)
+	if checkErrorStatus(err, replyW.Status, storagerpc.OK) {
+		return
+	}
+	replyW, err = st.Watch("StorageServer.Unwatch", "watchprefix:", true)
+	if checkErrorStatus(err, replyW.Status, storagerpc.OK) {
+		return
+	}
+	replyP, err = st.Put("watchkey:1", "value2")
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+	select {
+	case event := <-st.events:
+		LOGE.Printf("FAIL: got event %+v after the watch was canceled\n", event)
+		failCount++
+		return
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	fmt.Println("PASS")
+	passCount++
+}
+
+// holders of write-through leases are sent writes instead of revocations,
+// and keep their leases
+func testWriteThroughLease() {
+	replyP, err := st.Put("wtkey:1", "value1")
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+	replyG, err := st.GetWriteThrough("wtkey:1")
+	if checkErrorStatus(err, replyG.Status, storagerpc.OK) {
+		return
+	}
+	if !replyG.Lease.Granted {
+		LOGE.Println("FAIL: failed to get lease")
+		failCount++
+		return
+	}
+	replyP, err = st.AppendToList("wtlist:1", "item1")
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+	replyL, err := st.GetListWriteThrough("wtlist:1")
+	if checkErrorStatus(err, replyL.Status, storagerpc.OK) {
+		return
+	}
+
+	replyP, err = st.Put("wtkey:1", "value2")
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+	replyP, err = st.AppendToList("wtlist:1", "item2")
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+	if st.recvRevoke["wtkey:1"] || st.recvRevoke["wtlist:1"] {
+		LOGE.Println("FAIL: write-through lease was revoked")
+		failCount++
+		return
+	}
+
+	expected := []storagerpc.UpdateLeaseArgs{
+		{Key: "wtkey:1", Op: storagerpc.OpPut, Value: "value2", Version: 2},
+		{Key: "wtlist:1", Op: storagerpc.OpAppendToList, Value: "item2", Version: 2},
+	}
+	for _, e := range expected {
+		select {
+		case update := <-st.updates:
+			if update != e {
+				LOGE.Printf("FAIL: got update %+v, expected %+v\n", update, e)
+				failCount++
+				return
+			}
+		default:
+			LOGE.Printf("FAIL: write returned before update %+v was sent\n", e)
+			failCount++
+			return
+		}
+	}
+
+	// the leases survive the writes
+	for _, key := range []string{"wtkey:1", "wtlist:1"} {
+		replyLs, err := st.GetLeases(key)
+		if err != nil {
+			LOGE.Println("FAIL: unexpected error returned:", err)
+			failCount++
+			return
+		}
+		if len(replyLs.Leases) != 1 || len(replyLs.Leases[0].Holders) != 1 || !replyLs.Leases[0].Holders[0].WriteThrough {
+			LOGE.Printf("FAIL: write-through lease on %s was not kept: %+v\n", key, replyLs.Leases)
+			failCount++
+			return
+		}
+	}
+
+	fmt.Println("PASS")
+	passCount++
+}
+
+// ranges of a list are selected from its head or tail
+func testListRange() {
+	key := "rangelist:1"
+	for _, item := range []string{"item1", "item2", "item3", "item4", "item5"} {
+		replyP, err := st.AppendToList(key, item)
+		if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+			return
+		}
+	}
+
+	tests := []struct {
+		offset, limit int
+		fromTail      bool
+		expected      []string
+	}{
+		{1, 2, false, []string{"item2", "item3"}},
+		{1, 2, true, []string{"item3", "item4"}},
+		{0, 0, true, []string{"item1", "item2", "item3", "item4", "item5"}},
+		{3, 0, false, []string{"item4", "item5"}},
+		{3, 10, true, []string{"item1", "item2"}},
+		{10, 1, false, []string{}},
+	}
+	for _, t := range tests {
+		replyR, err := st.GetListRange(key, t.offset, t.limit, t.fromTail, false)
+		if checkErrorStatus(err, replyR.Status, storagerpc.OK) {
+			return
+		}
+		if checkOrderedList(replyR.Value, t.expected) {
+			return
+		}
+		if replyR.Length != 5 || replyR.Version != 5 {
+			LOGE.Printf("FAIL: got length %d and version %d, expected 5 and 5\n", replyR.Length, replyR.Version)
+			failCount++
+			return
+		}
+	}
+
+	replyN, err := st.ListLength(key)
+	if checkErrorStatus(err, replyN.Status, storagerpc.OK) {
+		return
+	}
+	if replyN.Length != 5 {
+		LOGE.Printf("FAIL: got length %d, expected 5\n", replyN.Length)
+		failCount++
+		return
+	}
+
+	replyR, err := st.GetListRange("rangelist:nonexistent", 0, 1, false, false)
+	if checkErrorStatus(err, replyR.Status, storagerpc.KeyNotFound) {
+		return
+	}
+	replyN, err = st.ListLength("rangelist:nonexistent")
+	if checkErrorStatus(err, replyN.Status, storagerpc.KeyNotFound) {
+		return
+	}
+	if _, err := st.GetListRange(key, -1, 1, false, false); err == nil {
+		LOGE.Println("FAIL: negative offset should be rejected")
+		failCount++
+		return
+	}
+
+	fmt.Println("PASS")
+	passCount++
+}
+
+// trimming a list keeps its last items and revokes even write-through leases
+func testTrimList() {
+	key := "trimlist:1"
+	for _, item := range []string{"item1", "item2", "item3", "item4", "item5"} {
+		replyP, err := st.AppendToList(key, item)
+		if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+			return
+		}
+	}
+	replyL, err := st.GetListWriteThrough(key)
+	if checkErrorStatus(err, replyL.Status, storagerpc.OK) {
+		return
+	}
+	if !replyL.Lease.Granted {
+		LOGE.Println("FAIL: failed to get lease")
+		failCount++
+		return
+	}
+
+	replyP, err := st.TrimList(key, 2)
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+	if checkVersion(replyP.Version, 6) {
+		return
+	}
+	if !st.recvRevoke[key] {
+		LOGE.Println("FAIL: did not receive revoke")
+		failCount++
+		return
+	}
+	select {
+	case update := <-st.updates:
+		LOGE.Printf("FAIL: got update %+v for a trimmed list\n", update)
+		failCount++
+		return
+	default:
+	}
+	replyL, err = st.GetList(key, false)
+	if checkErrorStatus(err, replyL.Status, storagerpc.OK) {
+		return
+	}
+	if checkOrderedList(replyL.Value, []string{"item4", "item5"}) {
+		return
+	}
+
+	// a list that is short enough is left as it is
+	replyP, err = st.TrimList(key, 2)
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+	if checkVersion(replyP.Version, 6) {
+		return
+	}
+	replyP, err = st.TrimList("trimlist:nonexistent", 2)
+	if checkErrorStatus(err, replyP.Status, storagerpc.KeyNotFound) {
+		return
+	}
+
+	fmt.Println("PASS")
+	passCount++
+}
+
+// heartbeats from a node that is not the leader should be rejected
+func testRejectHeartbeat() {
+	replyS, err := st.GetServers()
+	if checkErrorStatus(err, replyS.Status, storagerpc.OK) {
+		return
+	}
+	replyH, err := st.Heartbeat(st.myhostport, replyS.Version)
+	if checkErrorStatus(err, replyH.Status, storagerpc.WrongServer) {
+		return
+	}
+	if replyH.Leader == st.myhostport || replyH.Version != replyS.Version {
+		LOGE.Printf("FAIL: incorrect leader %s and version %d\n", replyH.Leader, replyH.Version)
+		failCount++
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+/////////////////////////////////////////////
+//  test persistence across restarts
+/////////////////////////////////////////////
+
+// number of keys written by testPersistCompaction, chosen so that
+// the write-ahead log is compacted into a snapshot at least once
+const numPersistKeys = 1500
+
+// write keys that must survive a restart
+func testPersistPutGet() {
+	replyP, err := st.Put("persistkey:1", "value1")
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+	replyP, err = st.Put("persistkey:2", "old-value")
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+	replyP, err = st.Put("persistkey:2", "new-value")
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+// write a list that must survive a restart
+func testPersistList() {
+	for _, item := range []string{"value1", "value2", "value3"} {
+		replyP, err := st.AppendToList("persistlist:1", item)
+		if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+			return
+		}
+	}
+	replyP, err := st.RemoveFromList("persistlist:1", "value2")
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+	for _, item := range []string{"value1", "value2", "value3"} {
+		replyP, err := st.AppendToList("persistlist:2", item)
+		if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+			return
+		}
+	}
+	replyP, err = st.TrimList("persistlist:2", 1)
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+// write enough keys to force the log to be compacted
+func testPersistCompaction() {
+	for i := 0; i < numPersistKeys; i++ {
+		replyP, err := st.Put(fmt.Sprintf("persistmany:%d", i), fmt.Sprintf("value%d", i))
+		if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+			return
+		}
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+// keys written before the restart should be recovered
+func testRecoverPutGet() {
+	replyG, err := st.Get("persistkey:1", false)
+	if checkErrorStatus(err, replyG.Status, storagerpc.OK) {
+		return
+	}
+	if replyG.Value != "value1" {
+		LOGE.Println("FAIL: got wrong value")
+		failCount++
+		return
+	}
+	replyG, err = st.Get("persistkey:2", false)
+	if checkErrorStatus(err, replyG.Status, storagerpc.OK) {
+		return
+	}
+	if replyG.Value != "new-value" {
+		LOGE.Println("FAIL: got wrong value")
+		failCount++
+		return
+	}
+	if checkVersion(replyG.Version, 2) {
+		return
+	}
+	replyG, err = st.Get("nullkey:1", false)
+	if checkErrorStatus(err, replyG.Status, storagerpc.KeyNotFound) {
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+// lists written before the restart should be recovered
+func testRecoverList() {
+	replyL, err := st.GetList("persistlist:1", false)
+	if checkErrorStatus(err, replyL.Status, storagerpc.OK) {
+		return
+	}
+	if checkList(replyL.Value, []string{"value1", "value3"}) {
+		return
+	}
+	replyL, err = st.GetList("persistlist:2", false)
+	if checkErrorStatus(err, replyL.Status, storagerpc.OK) {
+		return
+	}
+	if checkList(replyL.Value, []string{"value3"}) {
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+// keys written before a compaction should be recovered from the snapshot
+func testRecoverCompaction() {
+	for i := 0; i < numPersistKeys; i++ {
+		replyG, err := st.Get(fmt.Sprintf("persistmany:%d", i), false)
+		if checkErrorStatus(err, replyG.Status, storagerpc.OK) {
+			return
+		}
+		if replyG.Value != fmt.Sprintf("value%d", i) {
+			LOGE.Println("FAIL: got wrong value")
+			failCount++
+			return
+		}
+		if checkVersion(replyG.Version, 1) {
+			return
+		}
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+// key in the range of the primary that is killed after the write, which the
+// other server replicates
+const failoverKey = "comb:"
+
+// write carrying a request ID, to be resent once its primary has failed
+func testFailoverWrite() {
+	replyP, err := st.PutWithRequestID("StorageServer.AppendToList", failoverKey, "value1", "failover/1")
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+// the write resent to the key's new primary must not be made again
+func testFailoverResend() {
+	replyP, err := st.PutWithRequestID("StorageServer.AppendToList", failoverKey, "value1", "failover/1")
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+	replyL, err := st.GetList(failoverKey, false)
+	if checkErrorStatus(err, replyL.Status, storagerpc.OK) {
+		return
+	}
+	if checkList(replyL.Value, []string{"value1"}) {
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+// the recovered server should accept new writes, without holding them
+// for leases, since none were granted before the restart
+func testRecoverUpdate() {
+	replyP, err := st.AppendToList("persistlist:1", "value3")
+	if checkErrorStatus(err, replyP.Status, storagerpc.ItemExists) {
+		return
+	}
+	start := time.Now()
+	replyP, err = st.AppendToList("persistlist:1", "value4")
+	if checkErrorStatus(err, replyP.Status, storagerpc.OK) {
+		return
+	}
+	if time.Since(start) > storagerpc.LeaseGuardSeconds*time.Second {
+		LOGE.Println("FAIL: write was held although no leases had been granted")
+		failCount++
+		return
+	}
+	replyL, err := st.GetList("persistlist:1", false)
+	if checkErrorStatus(err, replyL.Status, storagerpc.OK) {
+		return
+	}
+	if checkList(replyL.Value, []string{"value1", "value3", "value4"}) {
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+func main() {
+	jtests := []testFunc{{"testInitStorageServers", testInitStorageServers}}
+	btests := []testFunc{
+		{"testPutGet", testPutGet},
+		{"testAppendGetRemoveList", testAppendGetRemoveList},
+		{"testUpdateWithoutLease", testUpdateWithoutLease},
+		{"testUpdateBeforeLeaseExpire", testUpdateBeforeLeaseExpire},
+		{"testUpdateAfterLeaseExpire", testUpdateAfterLeaseExpire},
+		{"testDelayedRevokeWithoutBlocking", testDelayedRevokeWithoutBlocking},
+		{"testDelayedRevokeWithLeaseRequest1", testDelayedRevokeWithLeaseRequest1},
+		{"testDelayedRevokeWithLeaseRequest2", testDelayedRevokeWithLeaseRequest2},
+		{"testDelayedRevokeWithUpdate1", testDelayedRevokeWithUpdate1},
+		{"testDelayedRevokeWithUpdate2", testDelayedRevokeWithUpdate2},
+		{"testDelayedRevokeWithUpdate3", testDelayedRevokeWithUpdate3},
+		{"testUpdateListWithoutLease", testUpdateListWithoutLease},
+		{"testUpdateListBeforeLeaseExpire", testUpdateListBeforeLeaseExpire},
+		{"testUpdateListAfterLeaseExpire", testUpdateListAfterLeaseExpire},
+		{"testDelayedRevokeListWithoutBlocking", testDelayedRevokeListWithoutBlocking},
+		{"testDelayedRevokeListWithLeaseRequest1", testDelayedRevokeListWithLeaseRequest1},
+		{"testDelayedRevokeListWithLeaseRequest2", testDelayedRevokeListWithLeaseRequest2},
+		{"testDelayedRevokeListWithUpdate1", testDelayedRevokeListWithUpdate1},
+		{"testDelayedRevokeListWithUpdate2", testDelayedRevokeListWithUpdate2},
+		{"testDelayedRevokeListWithUpdate3", testDelayedRevokeListWithUpdate3},
+		{"testCompareAndSwap", testCompareAndSwap},
+		{"testCompareAndSwapBeforeLeaseExpire", testCompareAndSwapBeforeLeaseExpire},
+		{"testVersions", testVersions},
+		{"testListVersions", testListVersions},
+		{"testCompareAndSwapVersions", testCompareAndSwapVersions},
+		{"testMultiGet", testMultiGet},
+		{"testMultiGetList", testMultiGetList},
+		{"testMultiGetLease", testMultiGetLease},
+		{"testScanPrefix", testScanPrefix},
+		{"testPutTTL", testPutTTL},
+		{"testListTTL", testListTTL},
+		{"testTransaction", testTransaction},
+		{"testTransactionAbort", testTransactionAbort},
+		{"testTransactionAskedByPeer", testTransactionAskedByPeer},
+		{"testTransactionRevoke", testTransactionRevoke},
+		{"testGetLeases", testGetLeases},
+		{"testRevokeUnreachableHolder", testRevokeUnreachableHolder},
+		{"testAdaptiveLease", testAdaptiveLease},
+		{"testResendWrite", testResendWrite},
+		{"testWatch", testWatch},
+		{"testWriteThroughLease", testWriteThroughLease},
+		{"testListRange", testListRange},
+		{"testTrimList", testTrimList},
+		{"testRejectHeartbeat", testRejectHeartbeat},
+	}
+	ptests := []testFunc{
+		{"testPersistPutGet", testPersistPutGet},
+		{"testPersistList", testPersistList},
+		{"testPersistCompaction", testPersistCompaction},
+	}
+	rtests := []testFunc{
+		{"testRecoverPutGet", testRecoverPutGet},
+		{"testRecoverList", testRecoverList},
+		{"testRecoverCompaction", testRecoverCompaction},
+		{"testRecoverUpdate", testRecoverUpdate},
+	}
+
+	ftests := []testFunc{
+		{"testFailoverWrite", testFailoverWrite},
+	}
+	otests := []testFunc{
+		{"testFailoverResend", testFailoverResend},
+	}
+
+	flag.Parse()
+	if flag.NArg() < 1 {
+		LOGE.Fatalln("Usage: storagetest <storage master>")
+	}
+
+	// Run the tests with a single tester
+	storageTester, err := initStorageTester(flag.Arg(0), fmt.Sprintf("localhost:%d", *portnum))
+	if err != nil {
+		LOGE.Fatalln("Failed to initialize test:", err)
+	}
+	st = storageTester
+
+	switch *testType {
+	case 1:
+		for _, t := range jtests {
+			if b, err := regexp.MatchString(*testRegex, t.name); b && err == nil {
+				fmt.Printf("Running %s:\n", t.name)
+				t.f()
+			}
+		}
+	case 2:
+		for _, t := range btests {
+			if b, err := regexp.MatchString(*testRegex, t.name); b && err == nil {
+				fmt.Printf("Running %s:\n", t.name)
+				t.f()
+			}
+		}
+	case 3:
+		for _, t := range ptests {
+			if b, err := regexp.MatchString(*testRegex, t.name); b && err == nil {
+				fmt.Printf("Running %s:\n", t.name)
+				t.f()
+			}
+		}
+	case 4:
+		for _, t := range rtests {
+			if b, err := regexp.MatchString(*testRegex, t.name); b && err == nil {
+				fmt.Printf("Running %s:\n", t.name)
+				t.f()
+			}
+		}
+	case 5:
+		for _, t := range ftests {
+			if b, err := regexp.MatchString(*testRegex, t.name); b && err == nil {
+				fmt.Printf("Running %s:\n", t.name)
+				t.f()
+			}
+		}
+	case 6:
+		for _, t := range otests {
 			if b, err := regexp.MatchString(*testRegex, t.name); b && err == nil {
 				fmt.Printf("Running %s:\n", t.name)
 				t.f()
@@ -8,6 +8,7 @@ import (
 	"net"
 	"net/rpc"
 	"strconv"
+	"sync"
 
 	"github.com/cmu440/tribbler/rpc/tribrpc"
 )
@@ -16,8 +17,14 @@ import (
 // TribServer. The TribServer must register to receive RPCs and setup
 // an HTTP handler to serve the requests. The client may then perform RPCs
 // to the TribServer using the rpc.Client's Call method (see the code below).
+//
+// The TribClient passes the latest session token it was given on each call,
+// so that it reads its own writes whichever TribServer serves it.
 type tribClient struct {
 	client *rpc.Client
+
+	sessionLock sync.Mutex
+	session     string
 }
 
 func NewTribClient(serverHost string, serverPort int) (TribClient, error) {
@@ -29,16 +36,17 @@ func NewTribClient(serverHost string, serverPort int) (TribClient, error) {
 }
 
 func (tc *tribClient) CreateUser(userID string) (tribrpc.Status, error) {
-	args := &tribrpc.CreateUserArgs{UserID: userID}
+	args := &tribrpc.CreateUserArgs{UserID: userID, Session: tc.getSession()}
 	var reply tribrpc.CreateUserReply
 	if err := tc.client.Call("TribServer.CreateUser", args, &reply); err != nil {
 		return 0, err
 	}
+	tc.setSession(reply.Session)
 	return reply.Status, nil
 }
 
 func (tc *tribClient) GetSubscriptions(userID string) ([]string, tribrpc.Status, error) {
-	args := &tribrpc.GetSubscriptionsArgs{UserID: userID}
+	args := &tribrpc.GetSubscriptionsArgs{UserID: userID, Session: tc.getSession()}
 	var reply tribrpc.GetSubscriptionsReply
 	if err := tc.client.Call("TribServer.GetSubscriptions", args, &reply); err != nil {
 		return nil, 0, err
@@ -55,11 +63,12 @@ func (tc *tribClient) RemoveSubscription(userID, targetUserID string) (tribrpc.S
 }
 
 func (tc *tribClient) doSub(funcName, userID, targetUserID string) (tribrpc.Status, error) {
-	args := &tribrpc.SubscriptionArgs{UserID: userID, TargetUserID: targetUserID}
+	args := &tribrpc.SubscriptionArgs{UserID: userID, TargetUserID: targetUserID, Session: tc.getSession()}
 	var reply tribrpc.SubscriptionReply
 	if err := tc.client.Call(funcName, args, &reply); err != nil {
 		return 0, err
 	}
+	tc.setSession(reply.Session)
 	return reply.Status, nil
 }
 
@@ -72,7 +81,7 @@ func (tc *tribClient) GetTribblesBySubscription(userID string) ([]tribrpc.Tribbl
 }
 
 func (tc *tribClient) doTrib(funcName, userID string) ([]tribrpc.Tribble, tribrpc.Status, error) {
-	args := &tribrpc.GetTribblesArgs{UserID: userID}
+	args := &tribrpc.GetTribblesArgs{UserID: userID, Session: tc.getSession()}
 	var reply tribrpc.GetTribblesReply
 	if err := tc.client.Call(funcName, args, &reply); err != nil {
 		return nil, 0, err
@@ -81,14 +90,32 @@ func (tc *tribClient) doTrib(funcName, userID string) ([]tribrpc.Tribble, tribrp
 }
 
 func (tc *tribClient) PostTribble(userID, contents string) (tribrpc.Status, error) {
-	args := &tribrpc.PostTribbleArgs{UserID: userID, Contents: contents}
+	args := &tribrpc.PostTribbleArgs{UserID: userID, Contents: contents, Session: tc.getSession()}
 	var reply tribrpc.PostTribbleReply
 	if err := tc.client.Call("TribServer.PostTribble", args, &reply); err != nil {
 		return 0, err
 	}
+	tc.setSession(reply.Session)
 	return reply.Status, nil
 }
 
+func (tc *tribClient) getSession() string {
+	tc.sessionLock.Lock()
+	defer tc.sessionLock.Unlock()
+	return tc.session
+}
+
+// setSession keeps the session token returned by a write, unless the
+// TribServer returned none.
+func (tc *tribClient) setSession(token string) {
+	if token == "" {
+		return
+	}
+	tc.sessionLock.Lock()
+	defer tc.sessionLock.Unlock()
+	tc.session = token
+}
+
 func (tc *tribClient) Close() error {
 	return tc.client.Close()
 }
@@ -1,13 +1,43 @@
 package tribserver
 
 import (
-	"errors"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/rpc"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/cmu440/tribbler/libstore"
 	"github.com/cmu440/tribbler/rpc/tribrpc"
 )
 
+// A user's keys all start with the user's ID, so that they are stored on
+// the same storage servers:
+//
+//	<user>:user             marks that the user exists
+//	<user>:subs             list of the users the user subscribes to
+//	<user>:tribs            list of the keys of the user's tribbles, oldest first
+//	<user>:trib:<posted>    a tribble, posted at the given time (hex nanoseconds)
+//
+// A tribble's key thus orders it among its user's tribbles, so that the
+// newest tribbles can be picked before their contents are fetched.
+//
+// Each call runs under the session that the client's token encodes, and the
+// reply to each write carries the token updated with the write (see the
+// tribrpc package).
+
+const (
+	maxTribbles    = 100              // Most tribbles returned by GetTribbles and GetTribblesBySubscription.
+	requestTimeout = 10 * time.Second // How long a call may wait for the storage servers.
+)
+
 type tribServer struct {
-	// TODO: implement this!
+	ls libstore.Libstore
 }
 
 // NewTribServer creates, starts and returns a new TribServer. masterServerHostPort
@@ -17,33 +47,244 @@ type tribServer struct {
 //
 // For hints on how to properly setup RPC, see the rpc/tribrpc package.
 func NewTribServer(masterServerHostPort, myHostPort string) (TribServer, error) {
-	return nil, errors.New("not implemented")
+	listener, err := net.Listen("tcp", myHostPort)
+	if err != nil {
+		return nil, err
+	}
+	ls, err := libstore.NewLibstore(masterServerHostPort, myHostPort, libstore.Normal)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	ts := &tribServer{ls: ls}
+	if err := rpc.RegisterName("TribServer", tribrpc.Wrap(ts)); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	rpc.HandleHTTP()
+	go http.Serve(listener, nil)
+	return ts, nil
+}
+
+func userKey(userID string) string  { return userID + ":user" }
+func subsKey(userID string) string  { return userID + ":subs" }
+func tribsKey(userID string) string { return userID + ":tribs" }
+
+func tribKey(userID string, posted time.Time) string {
+	return fmt.Sprintf("%s:trib:%016x", userID, posted.UnixNano())
+}
+
+// postedAt returns the time encoded in a tribble's key.
+func postedAt(key string) int64 {
+	n, _ := strconv.ParseUint(key[strings.LastIndex(key, ":")+1:], 16, 64)
+	return int64(n)
+}
+
+// begin returns the context for the storage calls made on behalf of a call
+// carrying the given session token, and the session, which records the
+// call's writes.
+func begin(token string) (context.Context, context.CancelFunc, *libstore.Session, error) {
+	session, err := libstore.ParseSession(token)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid session token: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(libstore.WithSession(context.Background(), session), requestTimeout)
+	return ctx, cancel, session, nil
+}
+
+// exists reports whether userID has been created.
+func (ts *tribServer) exists(ctx context.Context, userID string) bool {
+	_, err := ts.ls.GetContext(ctx, userKey(userID))
+	return err == nil
 }
 
 func (ts *tribServer) CreateUser(args *tribrpc.CreateUserArgs, reply *tribrpc.CreateUserReply) error {
-	return errors.New("not implemented")
+	ctx, cancel, session, err := begin(args.Session)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	if ts.exists(ctx, args.UserID) {
+		reply.Status = tribrpc.Exists
+		reply.Session = session.Token()
+		return nil
+	}
+	if err := ts.ls.PutContext(ctx, userKey(args.UserID), args.UserID); err != nil {
+		return err
+	}
+	reply.Status = tribrpc.OK
+	reply.Session = session.Token()
+	return nil
 }
 
 func (ts *tribServer) AddSubscription(args *tribrpc.SubscriptionArgs, reply *tribrpc.SubscriptionReply) error {
-	return errors.New("not implemented")
+	ctx, cancel, session, err := begin(args.Session)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	switch {
+	case !ts.exists(ctx, args.UserID):
+		reply.Status = tribrpc.NoSuchUser
+	case !ts.exists(ctx, args.TargetUserID):
+		reply.Status = tribrpc.NoSuchTargetUser
+	case ts.ls.AppendToListContext(ctx, subsKey(args.UserID), args.TargetUserID) != nil:
+		reply.Status = tribrpc.Exists
+	default:
+		reply.Status = tribrpc.OK
+	}
+	reply.Session = session.Token()
+	return nil
 }
 
 func (ts *tribServer) RemoveSubscription(args *tribrpc.SubscriptionArgs, reply *tribrpc.SubscriptionReply) error {
-	return errors.New("not implemented")
+	ctx, cancel, session, err := begin(args.Session)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	switch {
+	case !ts.exists(ctx, args.UserID):
+		reply.Status = tribrpc.NoSuchUser
+	case ts.ls.RemoveFromListContext(ctx, subsKey(args.UserID), args.TargetUserID) != nil:
+		reply.Status = tribrpc.NoSuchTargetUser
+	default:
+		reply.Status = tribrpc.OK
+	}
+	reply.Session = session.Token()
+	return nil
 }
 
 func (ts *tribServer) GetSubscriptions(args *tribrpc.GetSubscriptionsArgs, reply *tribrpc.GetSubscriptionsReply) error {
-	return errors.New("not implemented")
+	ctx, cancel, _, err := begin(args.Session)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	if !ts.exists(ctx, args.UserID) {
+		reply.Status = tribrpc.NoSuchUser
+		return nil
+	}
+	// A user who never subscribed has no list.
+	subs, _ := ts.ls.GetListContext(ctx, subsKey(args.UserID))
+	reply.Status = tribrpc.OK
+	reply.UserIDs = subs
+	return nil
 }
 
 func (ts *tribServer) PostTribble(args *tribrpc.PostTribbleArgs, reply *tribrpc.PostTribbleReply) error {
-	return errors.New("not implemented")
+	ctx, cancel, session, err := begin(args.Session)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	if !ts.exists(ctx, args.UserID) {
+		reply.Status = tribrpc.NoSuchUser
+		reply.Session = session.Token()
+		return nil
+	}
+	trib := tribrpc.Tribble{UserID: args.UserID, Posted: time.Now(), Contents: args.Contents}
+	value, err := json.Marshal(trib)
+	if err != nil {
+		return err
+	}
+	// The tribble is stored before it is listed, so that a listed tribble
+	// is always found.
+	key := tribKey(args.UserID, trib.Posted)
+	if err := ts.ls.PutContext(ctx, key, string(value)); err != nil {
+		return err
+	}
+	if err := ts.ls.AppendToListContext(ctx, tribsKey(args.UserID), key); err != nil {
+		return err
+	}
+	reply.Status = tribrpc.OK
+	reply.Session = session.Token()
+	return nil
 }
 
 func (ts *tribServer) GetTribbles(args *tribrpc.GetTribblesArgs, reply *tribrpc.GetTribblesReply) error {
-	return errors.New("not implemented")
+	ctx, cancel, _, err := begin(args.Session)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	if !ts.exists(ctx, args.UserID) {
+		reply.Status = tribrpc.NoSuchUser
+		return nil
+	}
+	// A user who never posted has no list.
+	keys, _ := ts.ls.GetListRangeContext(ctx, tribsKey(args.UserID), 0, maxTribbles, true)
+	tribbles, err := ts.tribbles(ctx, keys)
+	if err != nil {
+		return err
+	}
+	reply.Status = tribrpc.OK
+	reply.Tribbles = tribbles
+	return nil
 }
 
 func (ts *tribServer) GetTribblesBySubscription(args *tribrpc.GetTribblesArgs, reply *tribrpc.GetTribblesReply) error {
-	return errors.New("not implemented")
+	ctx, cancel, _, err := begin(args.Session)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	if !ts.exists(ctx, args.UserID) {
+		reply.Status = tribrpc.NoSuchUser
+		return nil
+	}
+	subs, _ := ts.ls.GetListContext(ctx, subsKey(args.UserID))
+	lists := make([]string, len(subs))
+	for i, userID := range subs {
+		lists[i] = tribsKey(userID)
+	}
+	var keys []string
+	if len(lists) > 0 {
+		tribsKeys, err := ts.ls.MultiGetListContext(ctx, lists)
+		if err != nil {
+			return err
+		}
+		for _, list := range tribsKeys {
+			if len(list) > maxTribbles {
+				list = list[len(list)-maxTribbles:]
+			}
+			keys = append(keys, list...)
+		}
+	}
+	tribbles, err := ts.tribbles(ctx, keys)
+	if err != nil {
+		return err
+	}
+	reply.Status = tribrpc.OK
+	reply.Tribbles = tribbles
+	return nil
+}
+
+// tribbles returns the newest maxTribbles of the tribbles with the given
+// keys, most recent first.
+func (ts *tribServer) tribbles(ctx context.Context, keys []string) ([]tribrpc.Tribble, error) {
+	sort.Slice(keys, func(i, j int) bool { return postedAt(keys[i]) > postedAt(keys[j]) })
+	if len(keys) > maxTribbles {
+		keys = keys[:maxTribbles]
+	}
+	tribbles := make([]tribrpc.Tribble, 0, len(keys))
+	if len(keys) == 0 {
+		return tribbles, nil
+	}
+	values, err := ts.ls.MultiGetContext(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		value, ok := values[key]
+		if !ok {
+			continue
+		}
+		var trib tribrpc.Tribble
+		if err := json.Unmarshal([]byte(value), &trib); err != nil {
+			return nil, err
+		}
+		tribbles = append(tribbles, trib)
+	}
+	return tribbles, nil
 }
@@ -0,0 +1,86 @@
+#!/bin/bash
+
+if [ -z $GOPATH ]; then
+    echo "FAIL: GOPATH environment variable is not set"
+    exit 1
+fi
+
+if [ -n "$(go version | grep 'darwin/amd64')" ]; then    
+    GOOS="darwin_amd64"
+elif [ -n "$(go version | grep 'linux/amd64')" ]; then
+    GOOS="linux_amd64"
+else
+    echo "FAIL: only 64-bit Mac OS X and Linux operating systems are supported"
+    exit 1
+fi
+
+# Build the srunner and balancetest binaries to use to test the student's
+# storage server implementation. Exit immediately if there was a
+# compile-time error.
+go install github.com/cmu440/tribbler/runners/srunner
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+go install github.com/cmu440/tribbler/tests/balancetest
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+
+# Pick random port between [10000, 20000).
+STORAGE_PORT=$(((RANDOM % 10000) + 10000))
+STORAGE_SERVER=$GOPATH/bin/srunner
+BALANCE_TEST=$GOPATH/bin/balancetest
+
+# Start N storage servers with random IDs, each owning ${VNODES} points of the
+# ring, and storing each key on ${REPLICAS} of them.
+function startStorageServers {
+    # Start master storage server.
+    ${STORAGE_SERVER} -N=${N} -replicas=${REPLICAS} -vnodes=${VNODES} -port=${STORAGE_PORT} 2> /dev/null &
+    STORAGE_SERVER_PID[0]=$!
+    # Start slave storage servers.
+    for i in `seq 1 $((N-1))`
+    do
+        STORAGE_SLAVE_PORT=$(((RANDOM % 10000) + 10000))
+        ${STORAGE_SERVER} -port=${STORAGE_SLAVE_PORT} -vnodes=${VNODES} -master="localhost:${STORAGE_PORT}" 2> /dev/null &
+        STORAGE_SERVER_PID[$i]=$!
+    done
+    sleep 5
+}
+
+function stopStorageServers {
+    for PID in "${STORAGE_SERVER_PID[@]}"
+    do
+        kill -9 ${PID} 2> /dev/null
+        wait ${PID} 2> /dev/null
+    done
+    STORAGE_SERVER_PID=()
+}
+
+# Testing that virtual nodes spread the keys, and their replicas, evenly
+# across servers.
+function testVirtualNodeBalance {
+    echo "Running testVirtualNodeBalance:"
+    N=5
+    VNODES=128
+    REPLICAS=3
+    startStorageServers
+    ${BALANCE_TEST} -max=1.5 "localhost:${STORAGE_PORT}" | tee /tmp/balancetest.out
+    PASS=`grep PASS /tmp/balancetest.out | wc -l`
+    if [ "$PASS" -eq 1 ]
+    then
+        PASS_COUNT=$((PASS_COUNT + 1))
+    else
+        FAIL_COUNT=$((FAIL_COUNT + 1))
+    fi
+    rm -f /tmp/balancetest.out
+    stopStorageServers
+}
+
+# Run tests.
+PASS_COUNT=0
+FAIL_COUNT=0
+testVirtualNodeBalance
+
+echo "Passed (${PASS_COUNT}/$((PASS_COUNT + FAIL_COUNT))) tests"
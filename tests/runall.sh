@@ -19,4 +19,14 @@ $GOPATH/tests/libtest.sh
 $GOPATH/tests/libtest2.sh
 $GOPATH/tests/storagetest.sh
 $GOPATH/tests/storagetest2.sh
+$GOPATH/tests/storagetest3.sh
+$GOPATH/tests/storagetest4.sh
+$GOPATH/tests/storagetest5.sh
+$GOPATH/tests/storagetest6.sh
+$GOPATH/tests/storagetest7.sh
+$GOPATH/tests/storagetest8.sh
+$GOPATH/tests/storagetest9.sh
+$GOPATH/tests/storagetest10.sh
+$GOPATH/tests/storagetest11.sh
+$GOPATH/tests/balancetest.sh
 $GOPATH/tests/stresstest.sh
\ No newline at end of file
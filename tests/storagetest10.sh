@@ -0,0 +1,102 @@
+#!/bin/bash
+
+if [ -z $GOPATH ]; then
+    echo "FAIL: GOPATH environment variable is not set"
+    exit 1
+fi
+
+if [ -n "$(go version | grep 'darwin/amd64')" ]; then    
+    GOOS="darwin_amd64"
+elif [ -n "$(go version | grep 'linux/amd64')" ]; then
+    GOOS="linux_amd64"
+else
+    echo "FAIL: only 64-bit Mac OS X and Linux operating systems are supported"
+    exit 1
+fi
+
+# Build the student's storage server implementation.
+# Exit immediately if there was a compile-time error.
+go install github.com/cmu440/tribbler/runners/srunner
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+
+# Build the test binary to use to test the student's storage server implementation.
+# Exit immediately if there was a compile-time error.
+go install github.com/cmu440/tribbler/tests/storagetest
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+
+# Pick random ports between [10000, 20000).
+STORAGE_PORT=$(((RANDOM % 10000) + 10000))
+TESTER_PORT=$(((RANDOM % 10000) + 10000))
+STORAGE_TEST=$GOPATH/bin/storagetest
+STORAGE_SERVER=$GOPATH/bin/srunner
+DATA_DIR=$(mktemp -d)
+
+##################################################
+
+# Start a storage server that keeps its data in an append-only file.
+${STORAGE_SERVER} -port=${STORAGE_PORT} -engine=log 2> /dev/null &
+STORAGE_SERVER_PID=$!
+sleep 5
+
+# Start storagetest.
+${STORAGE_TEST} -port=${TESTER_PORT} -type=2 "localhost:${STORAGE_PORT}"
+
+# Kill storage server.
+kill -9 ${STORAGE_SERVER_PID}
+wait ${STORAGE_SERVER_PID} 2> /dev/null
+
+##################################################
+
+# Start a durable storage server that keeps its data in an append-only file.
+${STORAGE_SERVER} -port=${STORAGE_PORT} -data=${DATA_DIR} -engine=log 2> /dev/null &
+STORAGE_SERVER_PID=$!
+sleep 5
+
+# Write data that should survive a restart.
+${STORAGE_TEST} -port=${TESTER_PORT} -type=3 "localhost:${STORAGE_PORT}"
+
+# Kill storage server.
+kill -9 ${STORAGE_SERVER_PID}
+wait ${STORAGE_SERVER_PID} 2> /dev/null
+
+##################################################
+
+# Restart the storage server from the same data directory.
+${STORAGE_SERVER} -port=${STORAGE_PORT} -data=${DATA_DIR} -engine=log 2> /dev/null &
+STORAGE_SERVER_PID=$!
+sleep 5
+
+# Verify that the data was recovered.
+${STORAGE_TEST} -port=${TESTER_PORT} -type=4 "localhost:${STORAGE_PORT}"
+
+# Kill storage server.
+kill -9 ${STORAGE_SERVER_PID}
+wait ${STORAGE_SERVER_PID} 2> /dev/null
+
+##################################################
+
+# The storage engine keeps the values itself, so the snapshot should not.
+if grep -q "value500" ${DATA_DIR}/snapshot; then
+    echo "FAIL: snapshot holds values kept by the storage engine"
+fi
+
+# Restart the storage server again, so that it recovers from the file that
+# the storage engine reopened.
+${STORAGE_SERVER} -port=${STORAGE_PORT} -data=${DATA_DIR} -engine=log 2> /dev/null &
+STORAGE_SERVER_PID=$!
+sleep 5
+
+# Verify that the data was recovered again.
+${STORAGE_TEST} -port=${TESTER_PORT} -type=4 -t="testRecoverPutGet|testRecoverCompaction" "localhost:${STORAGE_PORT}"
+
+# Kill storage server.
+kill -9 ${STORAGE_SERVER_PID}
+wait ${STORAGE_SERVER_PID} 2> /dev/null
+
+rm -rf ${DATA_DIR}
@@ -0,0 +1,64 @@
+#!/bin/bash
+
+if [ -z $GOPATH ]; then
+    echo "FAIL: GOPATH environment variable is not set"
+    exit 1
+fi
+
+if [ -n "$(go version | grep 'darwin/amd64')" ]; then    
+    GOOS="darwin_amd64"
+elif [ -n "$(go version | grep 'linux/amd64')" ]; then
+    GOOS="linux_amd64"
+else
+    echo "FAIL: only 64-bit Mac OS X and Linux operating systems are supported"
+    exit 1
+fi
+
+# Build the student's storage server implementation.
+# Exit immediately if there was a compile-time error.
+go install github.com/cmu440/tribbler/runners/srunner
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+
+# Build the test binary to use to test the student's storage server implementation.
+# Exit immediately if there was a compile-time error.
+go install github.com/cmu440/tribbler/tests/storagetest
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+
+# Pick random ports between [10000, 20000).
+STORAGE_PORT=$(((RANDOM % 10000) + 10000))
+TESTER_PORT=$(((RANDOM % 10000) + 10000))
+STORAGE_TEST=$GOPATH/bin/storagetest
+STORAGE_SERVER=$GOPATH/bin/srunner
+SLAVE_PORT=$(((RANDOM % 10000) + 10000))
+
+##################################################
+
+# Start a master and a slave that replicate each other's range.
+${STORAGE_SERVER} -N=2 -replicas=2 -id=3000000000 -port=${STORAGE_PORT} 2> /dev/null &
+STORAGE_SERVER_PID=$!
+${STORAGE_SERVER} -id=4000000000 -port=${SLAVE_PORT} -master="localhost:${STORAGE_PORT}" 2> /dev/null &
+SLAVE_PID=$!
+sleep 5
+
+# Write to a key in the slave's range.
+${STORAGE_TEST} -port=${TESTER_PORT} -type=5 "localhost:${SLAVE_PORT}"
+
+# Kill the slave, and wait for the master to remove it from the ring.
+kill -9 ${SLAVE_PID}
+wait ${SLAVE_PID} 2> /dev/null
+sleep 10
+
+##################################################
+
+# Resend the write to the master, now the key's primary.
+${STORAGE_TEST} -port=${TESTER_PORT} -type=6 "localhost:${STORAGE_PORT}"
+
+# Kill storage server.
+kill -9 ${STORAGE_SERVER_PID}
+wait ${STORAGE_SERVER_PID} 2> /dev/null
@@ -0,0 +1,245 @@
+#!/bin/bash
+
+if [ -z $GOPATH ]; then
+    echo "FAIL: GOPATH environment variable is not set"
+    exit 1
+fi
+
+if [ -n "$(go version | grep 'darwin/amd64')" ]; then    
+    GOOS="darwin_amd64"
+elif [ -n "$(go version | grep 'linux/amd64')" ]; then
+    GOOS="linux_amd64"
+else
+    echo "FAIL: only 64-bit Mac OS X and Linux operating systems are supported"
+    exit 1
+fi
+
+# Build the srunner and lrunner binaries to use to test the student's
+# storage server implementation. Exit immediately if there was a
+# compile-time error.
+go install github.com/cmu440/tribbler/runners/srunner
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+go install github.com/cmu440/tribbler/runners/lrunner
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+
+# Pick random port between [10000, 20000).
+STORAGE_PORT=$(((RANDOM % 10000) + 10000))
+STORAGE_SERVER=$GOPATH/bin/srunner
+LRUNNER=$GOPATH/bin/lrunner
+
+function startStorageServers {
+    N=${#STORAGE_ID[@]}
+    # Start master storage server.
+    ${STORAGE_SERVER} -N=${N} -replicas=${REPLICAS} -vnodes=${VNODES:-1} -id=${STORAGE_ID[0]} -port=${STORAGE_PORT} 2> /dev/null &
+    STORAGE_SERVER_PID[0]=$!
+    # Start slave storage servers.
+    if [ "$N" -gt 1 ]
+    then
+        for i in `seq 1 $((N-1))`
+        do
+	    STORAGE_SLAVE_PORT=$(((RANDOM % 10000) + 10000))
+            ${STORAGE_SERVER} -port=${STORAGE_SLAVE_PORT} -vnodes=${VNODES:-1} -id=${STORAGE_ID[$i]} -master="localhost:${STORAGE_PORT}" 2> /dev/null &
+            STORAGE_SERVER_PID[$i]=$!
+        done
+    fi
+    sleep 5
+}
+
+function stopStorageServers {
+    N=${#STORAGE_ID[@]}
+    for i in `seq 0 $((N-1))`
+    do
+        kill -9 ${STORAGE_SERVER_PID[$i]} 2> /dev/null
+        wait ${STORAGE_SERVER_PID[$i]} 2> /dev/null
+    done
+}
+
+# Kill the first slave, leaving its replicas to serve its range.
+function killSlave {
+    kill -9 ${STORAGE_SERVER_PID[1]}
+    wait ${STORAGE_SERVER_PID[1]} 2> /dev/null
+}
+
+# Testing reads of values after a node fails.
+function testReplicaFailover {
+    echo "Running testReplicaFailover:"
+    STORAGE_ID=('3000000000' '4000000000' '2000000000')
+    KEYS=('bubble:' 'insertion:' 'merge:' 'heap:' 'quick:' 'radix:')
+    REPLICAS=2
+    startStorageServers
+    for KEY in "${KEYS[@]}"
+    do
+        ${LRUNNER} -port=${STORAGE_PORT} p ${KEY} value > /dev/null
+    done
+    killSlave
+    for KEY in "${KEYS[@]}"
+    do
+        PASS=`${LRUNNER} -port=${STORAGE_PORT} g ${KEY} | grep value | wc -l`
+        if [ "$PASS" -ne 1 ]
+        then
+            break
+        fi
+    done
+    if [ "$PASS" -eq 1 ]
+    then
+        echo "PASS"
+        PASS_COUNT=$((PASS_COUNT + 1))
+    else
+        echo "FAIL"
+        FAIL_COUNT=$((FAIL_COUNT + 1))
+    fi
+    stopStorageServers
+}
+
+# Testing reads of lists after a node fails.
+function testReplicaListFailover {
+    echo "Running testReplicaListFailover:"
+    STORAGE_ID=('3000000000' '4000000000' '2000000000')
+    KEYS=('bubble:' 'insertion:' 'merge:' 'heap:' 'quick:' 'radix:')
+    REPLICAS=3
+    startStorageServers
+    for KEY in "${KEYS[@]}"
+    do
+        ${LRUNNER} -port=${STORAGE_PORT} la ${KEY} value1 > /dev/null
+        ${LRUNNER} -port=${STORAGE_PORT} la ${KEY} value2 > /dev/null
+        ${LRUNNER} -port=${STORAGE_PORT} lr ${KEY} value1 > /dev/null
+    done
+    killSlave
+    for KEY in "${KEYS[@]}"
+    do
+        PASS=`${LRUNNER} -port=${STORAGE_PORT} lg ${KEY} | grep value | wc -l`
+        if [ "$PASS" -ne 1 ]
+        then
+            break
+        fi
+    done
+    if [ "$PASS" -eq 1 ]
+    then
+        echo "PASS"
+        PASS_COUNT=$((PASS_COUNT + 1))
+    else
+        echo "FAIL"
+        FAIL_COUNT=$((FAIL_COUNT + 1))
+    fi
+    stopStorageServers
+}
+
+# Testing writes to a range whose replica has failed. The keys fall within
+# the master's range, which the killed slave replicates.
+function testWriteAfterReplicaFailure {
+    echo "Running testWriteAfterReplicaFailure:"
+    STORAGE_ID=('3000000000' '4000000000' '2000000000')
+    KEYS=('merge:' 'radix:' 'counting:' 'cocktail:')
+    REPLICAS=2
+    startStorageServers
+    killSlave
+    for KEY in "${KEYS[@]}"
+    do
+        PASS=`${LRUNNER} -port=${STORAGE_PORT} p ${KEY} value | grep OK | wc -l`
+        if [ "$PASS" -ne 1 ]
+        then
+            break
+        fi
+        PASS=`${LRUNNER} -port=${STORAGE_PORT} g ${KEY} | grep value | wc -l`
+        if [ "$PASS" -ne 1 ]
+        then
+            break
+        fi
+    done
+    if [ "$PASS" -eq 1 ]
+    then
+        echo "PASS"
+        PASS_COUNT=$((PASS_COUNT + 1))
+    else
+        echo "FAIL"
+        FAIL_COUNT=$((FAIL_COUNT + 1))
+    fi
+    stopStorageServers
+}
+
+# Testing writes to the range of a failed node once the leader has removed
+# it from the ring. The keys fall within the killed slave's range.
+function testRemoveDeadNode {
+    echo "Running testRemoveDeadNode:"
+    STORAGE_ID=('3000000000' '4000000000' '2000000000')
+    KEYS=('bubble:' 'heap:' 'comb:' 'strand:')
+    REPLICAS=2
+    startStorageServers
+    for KEY in "${KEYS[@]}"
+    do
+        ${LRUNNER} -port=${STORAGE_PORT} p ${KEY} value1 > /dev/null
+    done
+    killSlave
+    # Wait for the slave to be declared dead and removed.
+    sleep 10
+    for KEY in "${KEYS[@]}"
+    do
+        PASS=`${LRUNNER} -port=${STORAGE_PORT} g ${KEY} | grep value1 | wc -l`
+        if [ "$PASS" -ne 1 ]
+        then
+            break
+        fi
+        PASS=`${LRUNNER} -port=${STORAGE_PORT} p ${KEY} value2 | grep OK | wc -l`
+        if [ "$PASS" -ne 1 ]
+        then
+            break
+        fi
+        PASS=`${LRUNNER} -port=${STORAGE_PORT} g ${KEY} | grep value2 | wc -l`
+        if [ "$PASS" -ne 1 ]
+        then
+            break
+        fi
+    done
+    if [ "$PASS" -eq 1 ]
+    then
+        echo "PASS"
+        PASS_COUNT=$((PASS_COUNT + 1))
+    else
+        echo "FAIL"
+        FAIL_COUNT=$((FAIL_COUNT + 1))
+    fi
+    stopStorageServers
+}
+
+# Testing a scan of the keys of a failed node that owns many points of the
+# ring, whose ranges are replicated on different nodes.
+function testScanAfterFailover {
+    echo "Running testScanAfterFailover:"
+    STORAGE_ID=('3000000000' '4000000000' '2000000000' '1000000000')
+    REPLICAS=2
+    VNODES=16
+    startStorageServers
+    for i in `seq 1 20`
+    do
+        ${LRUNNER} -port=${STORAGE_PORT} p scan${i}:key value > /dev/null
+    done
+    killSlave
+    PASS=`${LRUNNER} -port=${STORAGE_PORT} sp scan | grep ":key" | wc -l`
+    if [ "$PASS" -eq 20 ]
+    then
+        echo "PASS"
+        PASS_COUNT=$((PASS_COUNT + 1))
+    else
+        echo "FAIL"
+        FAIL_COUNT=$((FAIL_COUNT + 1))
+    fi
+    VNODES=1
+    stopStorageServers
+}
+
+# Run tests.
+PASS_COUNT=0
+FAIL_COUNT=0
+testReplicaFailover
+testReplicaListFailover
+testWriteAfterReplicaFailure
+testRemoveDeadNode
+testScanAfterFailover
+
+echo "Passed (${PASS_COUNT}/$((PASS_COUNT + FAIL_COUNT))) tests"
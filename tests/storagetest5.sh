@@ -0,0 +1,151 @@
+#!/bin/bash
+
+if [ -z $GOPATH ]; then
+    echo "FAIL: GOPATH environment variable is not set"
+    exit 1
+fi
+
+if [ -n "$(go version | grep 'darwin/amd64')" ]; then    
+    GOOS="darwin_amd64"
+elif [ -n "$(go version | grep 'linux/amd64')" ]; then
+    GOOS="linux_amd64"
+else
+    echo "FAIL: only 64-bit Mac OS X and Linux operating systems are supported"
+    exit 1
+fi
+
+# Build the srunner and lrunner binaries to use to test the student's
+# storage server implementation. Exit immediately if there was a
+# compile-time error.
+go install github.com/cmu440/tribbler/runners/srunner
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+go install github.com/cmu440/tribbler/runners/lrunner
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+
+# Pick random port between [10000, 20000).
+STORAGE_PORT=$(((RANDOM % 10000) + 10000))
+STORAGE_SERVER=$GOPATH/bin/srunner
+LRUNNER=$GOPATH/bin/lrunner
+
+function startStorageServers {
+    N=${#STORAGE_ID[@]}
+    # Start master storage server.
+    ${STORAGE_SERVER} -N=${N} -id=${STORAGE_ID[0]} -port=${STORAGE_PORT} 2> /dev/null &
+    STORAGE_SERVER_PID[0]=$!
+    # Start slave storage servers.
+    if [ "$N" -gt 1 ]
+    then
+        for i in `seq 1 $((N-1))`
+        do
+            startSlave $i
+        done
+    fi
+    sleep 5
+}
+
+# Start a slave storage server with ID ${STORAGE_ID[$1]}.
+function startSlave {
+    STORAGE_SLAVE_PORT=$(((RANDOM % 10000) + 10000))
+    ${STORAGE_SERVER} -port=${STORAGE_SLAVE_PORT} -id=${STORAGE_ID[$1]} -master="localhost:${STORAGE_PORT}" 2> /dev/null &
+    STORAGE_SERVER_PID[$1]=$!
+}
+
+function stopStorageServers {
+    for PID in "${STORAGE_SERVER_PID[@]}"
+    do
+        kill -9 ${PID} 2> /dev/null
+        wait ${PID} 2> /dev/null
+    done
+    STORAGE_SERVER_PID=()
+}
+
+# Store a value and a list under each key.
+function putKeys {
+    for KEY in "${KEYS[@]}"
+    do
+        ${LRUNNER} -port=${STORAGE_PORT} p ${KEY} value > /dev/null
+        ${LRUNNER} -port=${STORAGE_PORT} la ${KEY} item1 > /dev/null
+        ${LRUNNER} -port=${STORAGE_PORT} la ${KEY} item2 > /dev/null
+    done
+}
+
+# Check that every key's value and list survived.
+function checkKeys {
+    PASS=1
+    for KEY in "${KEYS[@]}"
+    do
+        VALUE=`${LRUNNER} -port=${STORAGE_PORT} g ${KEY} | grep value | wc -l`
+        ITEMS=`${LRUNNER} -port=${STORAGE_PORT} lg ${KEY} | grep item | wc -l`
+        if [ "$VALUE" -ne 1 ] || [ "$ITEMS" -ne 2 ]
+        then
+            PASS=0
+            break
+        fi
+    done
+}
+
+function reportResult {
+    if [ "$PASS" -eq 1 ]
+    then
+        echo "PASS"
+        PASS_COUNT=$((PASS_COUNT + 1))
+    else
+        echo "FAIL"
+        FAIL_COUNT=$((FAIL_COUNT + 1))
+    fi
+}
+
+# Testing nodes joining a running ring.
+function testJoinRing {
+    echo "Running testJoinRing:"
+    STORAGE_ID=('3000000000')
+    KEYS=('bubble:' 'insertion:' 'merge:' 'heap:' 'quick:' 'radix:' 'shell:' 'counting:')
+    startStorageServers
+    putKeys
+    STORAGE_ID=('3000000000' '1000000000' '2000000000')
+    startSlave 1
+    sleep 3
+    checkKeys
+    if [ "$PASS" -eq 1 ]
+    then
+        startSlave 2
+        sleep 3
+        checkKeys
+    fi
+    reportResult
+    stopStorageServers
+}
+
+# Testing nodes gracefully leaving a running ring.
+function testLeaveRing {
+    echo "Running testLeaveRing:"
+    STORAGE_ID=('3000000000' '1000000000' '2000000000')
+    KEYS=('bubble:' 'insertion:' 'merge:' 'heap:' 'quick:' 'radix:' 'shell:' 'counting:')
+    startStorageServers
+    putKeys
+    kill -TERM ${STORAGE_SERVER_PID[1]}
+    wait ${STORAGE_SERVER_PID[1]} 2> /dev/null
+    checkKeys
+    if [ "$PASS" -eq 1 ]
+    then
+        kill -TERM ${STORAGE_SERVER_PID[2]}
+        wait ${STORAGE_SERVER_PID[2]} 2> /dev/null
+        checkKeys
+    fi
+    reportResult
+    stopStorageServers
+}
+
+# Run tests.
+PASS_COUNT=0
+FAIL_COUNT=0
+testJoinRing
+testLeaveRing
+
+echo "Passed (${PASS_COUNT}/$((PASS_COUNT + FAIL_COUNT))) tests"
@@ -0,0 +1,177 @@
+#!/bin/bash
+
+if [ -z $GOPATH ]; then
+    echo "FAIL: GOPATH environment variable is not set"
+    exit 1
+fi
+
+if [ -n "$(go version | grep 'darwin/amd64')" ]; then    
+    GOOS="darwin_amd64"
+elif [ -n "$(go version | grep 'linux/amd64')" ]; then
+    GOOS="linux_amd64"
+else
+    echo "FAIL: only 64-bit Mac OS X and Linux operating systems are supported"
+    exit 1
+fi
+
+# Build the srunner and lrunner binaries to use to test the student's
+# storage server implementation. Exit immediately if there was a
+# compile-time error.
+go install github.com/cmu440/tribbler/runners/srunner
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+go install github.com/cmu440/tribbler/runners/lrunner
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+
+# Pick random port between [10000, 20000).
+STORAGE_PORT=$(((RANDOM % 10000) + 10000))
+STORAGE_SERVER=$GOPATH/bin/srunner
+LRUNNER=$GOPATH/bin/lrunner
+
+function startStorageServers {
+    N=${#STORAGE_ID[@]}
+    # Start master storage server.
+    ${STORAGE_SERVER} -N=${N} -replicas=${REPLICAS} -id=${STORAGE_ID[0]} -port=${STORAGE_PORT} 2> /dev/null &
+    STORAGE_SERVER_PID[0]=$!
+    # Start slave storage servers.
+    for i in `seq 1 $((N-1))`
+    do
+        startSlave $i "localhost:${STORAGE_PORT}"
+    done
+    sleep 5
+}
+
+# Start a slave storage server with ID ${STORAGE_ID[$1]} that joins the ring
+# through the storage server at $2.
+function startSlave {
+    SLAVE_PORT[$1]=$(((RANDOM % 10000) + 10000))
+    ${STORAGE_SERVER} -port=${SLAVE_PORT[$1]} -id=${STORAGE_ID[$1]} -master="$2" 2> /dev/null &
+    STORAGE_SERVER_PID[$1]=$!
+}
+
+function stopStorageServers {
+    for PID in "${STORAGE_SERVER_PID[@]}"
+    do
+        kill -9 ${PID} 2> /dev/null
+        wait ${PID} 2> /dev/null
+    done
+    STORAGE_SERVER_PID=()
+}
+
+# Kill the master and wait for the remaining nodes to elect a new leader.
+function killMaster {
+    kill -9 ${STORAGE_SERVER_PID[0]}
+    wait ${STORAGE_SERVER_PID[0]} 2> /dev/null
+    sleep 8
+}
+
+# Store a value and a list under each key through the storage server at port $1.
+function putKeys {
+    for KEY in "${KEYS[@]}"
+    do
+        ${LRUNNER} -port=$1 p ${KEY} value > /dev/null
+        ${LRUNNER} -port=$1 la ${KEY} item1 > /dev/null
+        ${LRUNNER} -port=$1 la ${KEY} item2 > /dev/null
+    done
+}
+
+# Check every key's value and list through the storage server at port $1.
+function checkKeys {
+    PASS=1
+    for KEY in "${KEYS[@]}"
+    do
+        VALUE=`${LRUNNER} -port=$1 g ${KEY} | grep value | wc -l`
+        ITEMS=`${LRUNNER} -port=$1 lg ${KEY} | grep item | wc -l`
+        if [ "$VALUE" -ne 1 ] || [ "$ITEMS" -ne 2 ]
+        then
+            PASS=0
+            break
+        fi
+    done
+}
+
+function reportResult {
+    if [ "$PASS" -eq 1 ]
+    then
+        echo "PASS"
+        PASS_COUNT=$((PASS_COUNT + 1))
+    else
+        echo "FAIL"
+        FAIL_COUNT=$((FAIL_COUNT + 1))
+    fi
+}
+
+# Testing reads and writes after the master fails.
+function testMasterFailover {
+    echo "Running testMasterFailover:"
+    STORAGE_ID=('3000000000' '1000000000' '2000000000')
+    KEYS=('bubble:' 'insertion:' 'merge:' 'heap:' 'quick:' 'radix:' 'shell:' 'counting:')
+    REPLICAS=2
+    startStorageServers
+    putKeys ${STORAGE_PORT}
+    killMaster
+    checkKeys ${SLAVE_PORT[1]}
+    if [ "$PASS" -eq 1 ]
+    then
+        KEYS=('selection:' 'gnome:' 'cocktail:' 'comb:')
+        putKeys ${SLAVE_PORT[2]}
+        checkKeys ${SLAVE_PORT[1]}
+    fi
+    reportResult
+    stopStorageServers
+}
+
+# Testing a node joining the ring after the master fails.
+function testJoinAfterFailover {
+    echo "Running testJoinAfterFailover:"
+    STORAGE_ID=('3000000000' '1000000000' '2000000000')
+    KEYS=('bubble:' 'insertion:' 'merge:' 'heap:' 'quick:' 'radix:' 'shell:' 'counting:')
+    REPLICAS=2
+    startStorageServers
+    putKeys ${STORAGE_PORT}
+    killMaster
+    STORAGE_ID=('3000000000' '1000000000' '2000000000' '4000000000')
+    startSlave 3 "localhost:${SLAVE_PORT[1]}"
+    sleep 3
+    checkKeys ${SLAVE_PORT[3]}
+    reportResult
+    stopStorageServers
+}
+
+# Testing reads and writes after the master and a slave fail together, so
+# that the new leader cannot reach the slave when it first changes the ring.
+function testMasterAndSlaveFailure {
+    echo "Running testMasterAndSlaveFailure:"
+    STORAGE_ID=('3000000000' '1000000000' '2000000000' '4000000000')
+    KEYS=('bubble:' 'insertion:' 'merge:' 'heap:' 'quick:' 'radix:' 'shell:' 'counting:')
+    REPLICAS=3
+    startStorageServers
+    putKeys ${STORAGE_PORT}
+    kill -9 ${STORAGE_SERVER_PID[3]}
+    wait ${STORAGE_SERVER_PID[3]} 2> /dev/null
+    killMaster
+    sleep 4
+    checkKeys ${SLAVE_PORT[1]}
+    if [ "$PASS" -eq 1 ]
+    then
+        KEYS=('selection:' 'gnome:' 'cocktail:' 'comb:')
+        putKeys ${SLAVE_PORT[2]}
+        checkKeys ${SLAVE_PORT[1]}
+    fi
+    reportResult
+    stopStorageServers
+}
+
+# Run tests.
+PASS_COUNT=0
+FAIL_COUNT=0
+testMasterFailover
+testJoinAfterFailover
+testMasterAndSlaveFailure
+
+echo "Passed (${PASS_COUNT}/$((PASS_COUNT + FAIL_COUNT))) tests"
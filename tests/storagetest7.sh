@@ -0,0 +1,132 @@
+#!/bin/bash
+
+if [ -z $GOPATH ]; then
+    echo "FAIL: GOPATH environment variable is not set"
+    exit 1
+fi
+
+if [ -n "$(go version | grep 'darwin/amd64')" ]; then    
+    GOOS="darwin_amd64"
+elif [ -n "$(go version | grep 'linux/amd64')" ]; then
+    GOOS="linux_amd64"
+else
+    echo "FAIL: only 64-bit Mac OS X and Linux operating systems are supported"
+    exit 1
+fi
+
+# Build the srunner and lrunner binaries to use to test the student's
+# storage server implementation. Exit immediately if there was a
+# compile-time error.
+go install github.com/cmu440/tribbler/runners/srunner
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+go install github.com/cmu440/tribbler/runners/lrunner
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+
+# Pick random port between [10000, 20000).
+STORAGE_PORT=$(((RANDOM % 10000) + 10000))
+STORAGE_SERVER=$GOPATH/bin/srunner
+LRUNNER=$GOPATH/bin/lrunner
+
+function startStorageServers {
+    N=${#STORAGE_ID[@]}
+    # Start master storage server.
+    ${STORAGE_SERVER} -N=${N} -replicas=${REPLICAS} -id=${STORAGE_ID[0]} -port=${STORAGE_PORT} 2> /dev/null &
+    STORAGE_SERVER_PID[0]=$!
+    # Start slave storage servers.
+    for i in `seq 1 $((N-1))`
+    do
+        STORAGE_SLAVE_PORT=$(((RANDOM % 10000) + 10000))
+        ${STORAGE_SERVER} -port=${STORAGE_SLAVE_PORT} -id=${STORAGE_ID[$i]} -master="localhost:${STORAGE_PORT}" 2> /dev/null &
+        STORAGE_SERVER_PID[$i]=$!
+    done
+    sleep 5
+}
+
+function stopStorageServers {
+    for PID in "${STORAGE_SERVER_PID[@]}"
+    do
+        kill -9 ${PID} 2> /dev/null
+        wait ${PID} 2> /dev/null
+    done
+    STORAGE_SERVER_PID=()
+}
+
+# Freeze the first slave, so that requests to it hang rather than fail, and
+# wait for the master to declare it dead.
+function freezeSlave {
+    kill -STOP ${STORAGE_SERVER_PID[1]}
+    sleep 8
+}
+
+# Testing reads after a node stops responding.
+function testReadsSkipDeadNode {
+    echo "Running testReadsSkipDeadNode:"
+    STORAGE_ID=('3000000000' '1000000000' '2000000000')
+    KEYS=('bubble:' 'insertion:' 'merge:' 'heap:' 'quick:' 'radix:' 'shell:' 'counting:')
+    REPLICAS=2
+    startStorageServers
+    for KEY in "${KEYS[@]}"
+    do
+        ${LRUNNER} -port=${STORAGE_PORT} p ${KEY} value > /dev/null
+    done
+    freezeSlave
+    PASS=1
+    for KEY in "${KEYS[@]}"
+    do
+        VALUE=`timeout 5 ${LRUNNER} -port=${STORAGE_PORT} g ${KEY} | grep value | wc -l`
+        if [ "$VALUE" -ne 1 ]
+        then
+            PASS=0
+            break
+        fi
+    done
+    reportResult
+    stopStorageServers
+}
+
+# Testing that writes to a node that stopped responding fail instead of hanging.
+function testWritesFailFast {
+    echo "Running testWritesFailFast:"
+    STORAGE_ID=('3000000000' '1000000000' '2000000000')
+    KEYS=('bubble:' 'insertion:' 'merge:' 'heap:' 'quick:' 'radix:' 'shell:' 'counting:')
+    REPLICAS=1
+    startStorageServers
+    freezeSlave
+    PASS=1
+    for KEY in "${KEYS[@]}"
+    do
+        timeout 5 ${LRUNNER} -port=${STORAGE_PORT} p ${KEY} value > /dev/null
+        if [ "$?" -eq 124 ]
+        then
+            PASS=0
+            break
+        fi
+    done
+    reportResult
+    stopStorageServers
+}
+
+function reportResult {
+    if [ "$PASS" -eq 1 ]
+    then
+        echo "PASS"
+        PASS_COUNT=$((PASS_COUNT + 1))
+    else
+        echo "FAIL"
+        FAIL_COUNT=$((FAIL_COUNT + 1))
+    fi
+}
+
+# Run tests.
+PASS_COUNT=0
+FAIL_COUNT=0
+testReadsSkipDeadNode
+testWritesFailFast
+
+echo "Passed (${PASS_COUNT}/$((PASS_COUNT + FAIL_COUNT))) tests"
@@ -0,0 +1,148 @@
+#!/bin/bash
+
+if [ -z $GOPATH ]; then
+    echo "FAIL: GOPATH environment variable is not set"
+    exit 1
+fi
+
+if [ -n "$(go version | grep 'darwin/amd64')" ]; then    
+    GOOS="darwin_amd64"
+elif [ -n "$(go version | grep 'linux/amd64')" ]; then
+    GOOS="linux_amd64"
+else
+    echo "FAIL: only 64-bit Mac OS X and Linux operating systems are supported"
+    exit 1
+fi
+
+# Build the srunner and lrunner binaries to use to test the student's
+# storage server implementation. Exit immediately if there was a
+# compile-time error.
+go install github.com/cmu440/tribbler/runners/srunner
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+go install github.com/cmu440/tribbler/runners/lrunner
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+
+# Pick random port between [10000, 20000).
+STORAGE_PORT=$(((RANDOM % 10000) + 10000))
+STORAGE_SERVER=$GOPATH/bin/srunner
+LRUNNER=$GOPATH/bin/lrunner
+
+function startStorageServers {
+    N=${#STORAGE_ID[@]}
+    # Start master storage server.
+    ${STORAGE_SERVER} -N=${N} -replicas=${REPLICAS} -id=${STORAGE_ID[0]} -port=${STORAGE_PORT} 2> /dev/null &
+    STORAGE_SERVER_PID[0]=$!
+    # Start slave storage servers.
+    if [ "$N" -gt 1 ]
+    then
+        for i in `seq 1 $((N-1))`
+        do
+	    STORAGE_SLAVE_PORT=$(((RANDOM % 10000) + 10000))
+            ${STORAGE_SERVER} -port=${STORAGE_SLAVE_PORT} -id=${STORAGE_ID[$i]} -master="localhost:${STORAGE_PORT}" 2> /dev/null &
+            STORAGE_SERVER_PID[$i]=$!
+        done
+    fi
+    sleep 5
+}
+
+function stopStorageServers {
+    N=${#STORAGE_ID[@]}
+    for i in `seq 0 $((N-1))`
+    do
+        kill -9 ${STORAGE_SERVER_PID[$i]} 2> /dev/null
+        wait ${STORAGE_SERVER_PID[$i]} 2> /dev/null
+    done
+}
+
+# Kill the first slave, leaving its replicas to serve its range.
+function killSlave {
+    kill -9 ${STORAGE_SERVER_PID[1]}
+    wait ${STORAGE_SERVER_PID[1]} 2> /dev/null
+}
+
+# Read all KEYS (plus one missing key) with a single MultiGet, and check
+# that every key was found.
+function checkMultiGet {
+    PASS=`${LRUNNER} -port=${STORAGE_PORT} mg "${KEYS[@]}" nullkey: | grep value | wc -l`
+    if [ "$PASS" -eq ${#KEYS[@]} ]
+    then
+        echo "PASS"
+        PASS_COUNT=$((PASS_COUNT + 1))
+    else
+        echo "FAIL"
+        FAIL_COUNT=$((FAIL_COUNT + 1))
+    fi
+}
+
+# Testing batched reads of keys stored on several nodes.
+function testMultiGet {
+    echo "Running testMultiGet:"
+    STORAGE_ID=('3000000000' '4000000000' '2000000000')
+    KEYS=('bubble:' 'insertion:' 'merge:' 'heap:' 'quick:' 'radix:')
+    REPLICAS=1
+    startStorageServers
+    for KEY in "${KEYS[@]}"
+    do
+        ${LRUNNER} -port=${STORAGE_PORT} p ${KEY} value > /dev/null
+    done
+    checkMultiGet
+    stopStorageServers
+}
+
+# Testing batched reads after a node fails.
+function testMultiGetFailover {
+    echo "Running testMultiGetFailover:"
+    STORAGE_ID=('3000000000' '4000000000' '2000000000')
+    KEYS=('bubble:' 'insertion:' 'merge:' 'heap:' 'quick:' 'radix:')
+    REPLICAS=2
+    startStorageServers
+    for KEY in "${KEYS[@]}"
+    do
+        ${LRUNNER} -port=${STORAGE_PORT} p ${KEY} value > /dev/null
+    done
+    killSlave
+    checkMultiGet
+    stopStorageServers
+}
+
+# Testing prefix scans of keys stored on several nodes, including after
+# a node fails.
+function testScanPrefix {
+    echo "Running testScanPrefix:"
+    STORAGE_ID=('3000000000' '4000000000' '2000000000')
+    KEYS=('bubble:' 'insertion:' 'merge:' 'heap:' 'quick:' 'radix:')
+    REPLICAS=2
+    startStorageServers
+    for KEY in "${KEYS[@]}"
+    do
+        ${LRUNNER} -port=${STORAGE_PORT} p ${KEY}sort value > /dev/null
+        ${LRUNNER} -port=${STORAGE_PORT} p ${KEY}other value > /dev/null
+    done
+    BEFORE=`${LRUNNER} -port=${STORAGE_PORT} sp "" | grep sort | wc -l`
+    killSlave
+    AFTER=`${LRUNNER} -port=${STORAGE_PORT} sp "" | grep sort | wc -l`
+    if [ "$BEFORE" -eq ${#KEYS[@]} ] && [ "$AFTER" -eq ${#KEYS[@]} ]
+    then
+        echo "PASS"
+        PASS_COUNT=$((PASS_COUNT + 1))
+    else
+        echo "FAIL"
+        FAIL_COUNT=$((FAIL_COUNT + 1))
+    fi
+    stopStorageServers
+}
+
+# Run tests.
+PASS_COUNT=0
+FAIL_COUNT=0
+testMultiGet
+testMultiGetFailover
+testScanPrefix
+
+echo "Passed (${PASS_COUNT}/$((PASS_COUNT + FAIL_COUNT))) tests"
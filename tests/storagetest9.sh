@@ -0,0 +1,127 @@
+#!/bin/bash
+
+if [ -z $GOPATH ]; then
+    echo "FAIL: GOPATH environment variable is not set"
+    exit 1
+fi
+
+if [ -n "$(go version | grep 'darwin/amd64')" ]; then    
+    GOOS="darwin_amd64"
+elif [ -n "$(go version | grep 'linux/amd64')" ]; then
+    GOOS="linux_amd64"
+else
+    echo "FAIL: only 64-bit Mac OS X and Linux operating systems are supported"
+    exit 1
+fi
+
+# Build the srunner and lrunner binaries to use to test the student's
+# storage server implementation. Exit immediately if there was a
+# compile-time error.
+go install github.com/cmu440/tribbler/runners/srunner
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+go install github.com/cmu440/tribbler/runners/lrunner
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+
+# Pick random port between [10000, 20000).
+STORAGE_PORT=$(((RANDOM % 10000) + 10000))
+STORAGE_SERVER=$GOPATH/bin/srunner
+LRUNNER=$GOPATH/bin/lrunner
+
+function startStorageServers {
+    N=${#STORAGE_ID[@]}
+    # Start master storage server.
+    ${STORAGE_SERVER} -N=${N} -replicas=${REPLICAS} -id=${STORAGE_ID[0]} -port=${STORAGE_PORT} 2> /dev/null &
+    STORAGE_SERVER_PID[0]=$!
+    # Start slave storage servers.
+    if [ "$N" -gt 1 ]
+    then
+        for i in `seq 1 $((N-1))`
+        do
+	    STORAGE_SLAVE_PORT=$(((RANDOM % 10000) + 10000))
+            ${STORAGE_SERVER} -port=${STORAGE_SLAVE_PORT} -id=${STORAGE_ID[$i]} -master="localhost:${STORAGE_PORT}" 2> /dev/null &
+            STORAGE_SERVER_PID[$i]=$!
+        done
+    fi
+    sleep 5
+}
+
+function stopStorageServers {
+    N=${#STORAGE_ID[@]}
+    for i in `seq 0 $((N-1))`
+    do
+        kill -9 ${STORAGE_SERVER_PID[$i]} 2> /dev/null
+        wait ${STORAGE_SERVER_PID[$i]} 2> /dev/null
+    done
+}
+
+# Build the arguments of a transaction that puts value into every key of KEYS.
+function putKeys {
+    TX=()
+    for KEY in "${KEYS[@]}"
+    do
+        TX+=(p ${KEY} value)
+    done
+}
+
+# Count how many keys of KEYS were found with value by a single MultiGet.
+function countKeys {
+    FOUND=`${LRUNNER} -port=${STORAGE_PORT} mg "${KEYS[@]}" | grep value | wc -l`
+}
+
+# Testing a transaction that writes keys stored on several nodes.
+function testTransaction {
+    echo "Running testTransaction:"
+    STORAGE_ID=('3000000000' '4000000000' '2000000000')
+    KEYS=('bubble:' 'insertion:' 'merge:' 'heap:' 'quick:' 'radix:')
+    REPLICAS=1
+    startStorageServers
+    putKeys
+    RESULT=`${LRUNNER} -port=${STORAGE_PORT} tx "${TX[@]}"`
+    countKeys
+    if [ "$RESULT" == "OK" ] && [ "$FOUND" -eq ${#KEYS[@]} ]
+    then
+        echo "PASS"
+        PASS_COUNT=$((PASS_COUNT + 1))
+    else
+        echo "FAIL"
+        FAIL_COUNT=$((FAIL_COUNT + 1))
+    fi
+    stopStorageServers
+}
+
+# Testing a transaction that writes keys stored on several nodes, but
+# cannot be committed because one of its list writes fails.
+function testTransactionAbort {
+    echo "Running testTransactionAbort:"
+    STORAGE_ID=('3000000000' '4000000000' '2000000000')
+    KEYS=('bubble:' 'insertion:' 'merge:' 'heap:' 'quick:' 'radix:')
+    REPLICAS=1
+    startStorageServers
+    ${LRUNNER} -port=${STORAGE_PORT} la sorts: item > /dev/null
+    putKeys
+    RESULT=`${LRUNNER} -port=${STORAGE_PORT} tx "${TX[@]}" la sorts: item`
+    countKeys
+    if [[ "$RESULT" == ERROR* ]] && [ "$FOUND" -eq 0 ]
+    then
+        echo "PASS"
+        PASS_COUNT=$((PASS_COUNT + 1))
+    else
+        echo "FAIL"
+        FAIL_COUNT=$((FAIL_COUNT + 1))
+    fi
+    stopStorageServers
+}
+
+# Run tests.
+PASS_COUNT=0
+FAIL_COUNT=0
+testTransaction
+testTransactionAbort
+
+echo "Passed (${PASS_COUNT}/$((PASS_COUNT + FAIL_COUNT))) tests"